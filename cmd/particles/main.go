@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -10,6 +11,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/amartorelli/particles/pkg/cdn"
+	"github.com/amartorelli/particles/pkg/util"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,6 +19,10 @@ func main() {
 	// signals
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
 
 	// config flags
 	var confFile = flag.String("conf", "conf.yml", "path to config file")
@@ -39,35 +45,73 @@ func main() {
 	}
 	logrus.SetFormatter(formatter)
 
-	conf, err := ioutil.ReadFile(*confFile)
+	confYML, err := loadConf(*confFile)
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	confYML := cdn.DefaultConf()
-	err = yaml.Unmarshal(conf, &confYML)
-	if err != nil {
-		logrus.Fatalf("invalid config: %s", err)
-	}
-
-	valid, reason := confYML.IsValid()
-	if !valid {
-		logrus.Fatalf("invalid configuration: %s", reason)
-	}
 
 	cdn, err := cdn.NewCDN(confYML)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	exit := cdn.Start()
+	// the previous process is only stopped once all the listeners are open
+	exit, err := cdn.Start()
+	if err != nil {
+		cdn.Shutdown()
+		logrus.Fatalf("error starting cdn: %s", err)
+	}
+	util.Ready()
+
+	// Graceful shutdown, reloading the backends on SIGHUP and starting a new process on SIGUSR2, which
+	// inherits the sockets and stops this one once ready
+	upgraded := make(chan struct{}, 1)
+	upgrading := false
+	for running := true; running; {
+		select {
+		case <-upgrade:
+			if upgrading {
+				logrus.Warnf("upgrade already in progress")
+				continue
+			}
+			p, err := util.Upgrade()
+			if err != nil {
+				logrus.Errorf("error starting the new process: %s", err)
+				continue
+			}
+			logrus.Infof("started the new process %d", p.Pid)
+			upgrading = true
+			go func() {
+				state, err := p.Wait()
+				if err == nil {
+					logrus.Errorf("the new process exited before taking over: %s", state)
+				}
+				upgraded <- struct{}{}
+			}()
+
+		case <-upgraded:
+			upgrading = false
+
+		case <-reload:
+			logrus.Infof("reloading configuration from %s", *confFile)
+			newConf, err := loadConf(*confFile)
+			if err != nil {
+				logrus.Errorf("configuration not reloaded: %s", err)
+				continue
+			}
+			err = cdn.Reload(newConf)
+			if err != nil {
+				logrus.Errorf("configuration not reloaded: %s", err)
+			}
 
-	// Graceful shutdown
-	select {
-	case sig := <-stop:
-		logrus.Infof("received signnal %s, gracefully shutting down", sig.String())
+		case sig := <-stop:
+			logrus.Infof("received signnal %s, gracefully shutting down", sig.String())
+			running = false
 
-	case <-exit:
-		logrus.Infof("one or more handlers exited")
+		case <-exit:
+			logrus.Infof("one or more handlers exited")
+			running = false
+		}
 	}
 
 	err = cdn.Shutdown()
@@ -75,3 +119,23 @@ func main() {
 		logrus.Fatalf("error terminating cdn: %s", err)
 	}
 }
+
+// loadConf reads and validates the configuration file
+func loadConf(file string) (cdn.Conf, error) {
+	confYML := cdn.DefaultConf()
+	conf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return confYML, err
+	}
+
+	err = yaml.Unmarshal(conf, &confYML)
+	if err != nil {
+		return confYML, fmt.Errorf("invalid config: %s", err)
+	}
+
+	valid, reason := confYML.IsValid()
+	if !valid {
+		return confYML, fmt.Errorf("invalid configuration: %s", reason)
+	}
+	return confYML, nil
+}
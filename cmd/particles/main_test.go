@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs main instead of the tests when the test binary is started as a new process
+func TestMain(m *testing.M) {
+	conf := os.Getenv("PARTICLES_TEST_CONF")
+	if conf != "" {
+		os.Args = []string{"particles", "-conf", conf}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// freePort returns a port nothing is listening on
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestUpgrade(t *testing.T) {
+	// the test is the previous process of the new ones
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	defer signal.Stop(term)
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	dir, err := ioutil.TempDir("", "particles-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		port    int
+		started bool
+		errMsg  string
+	}{
+		{freePort(t), true, "a new process should stop the previous one once its listeners are open"},
+		{busy.Addr().(*net.TCPAddr).Port, false, "a new process failing to open its listeners should not stop the previous one"},
+	}
+
+	for i, tc := range tt {
+		conf := filepath.Join(dir, fmt.Sprintf("conf-%d.yml", i))
+		yml := fmt.Sprintf("api:\n  address: 127.0.0.1\n  port: %d\nhttp:\n  address: 127.0.0.1\n  port: %d\n  backends:\n    - name: www\n      domain: www.example.com\n      ip: 127.0.0.1\n", freePort(t), tc.port)
+		err = ioutil.WriteFile(conf, []byte(yml), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), "PARTICLES_TEST_CONF="+conf, fmt.Sprintf("PARTICLES_UPGRADE_PARENT=%d", os.Getpid()))
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		stopped, running := false, true
+		select {
+		case <-term:
+			stopped = true
+		case err = <-exited:
+			running = false
+			if err == nil {
+				t.Errorf("%s: the new process should fail", tc.errMsg)
+			}
+			// a signal sent right before exiting is still delivered
+			select {
+			case <-term:
+				stopped = true
+			case <-time.After(500 * time.Millisecond):
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("%s: timeout waiting for the new process", tc.errMsg)
+		}
+		if stopped != tc.started {
+			t.Errorf("%s: previous process stopped %t", tc.errMsg, stopped)
+		}
+
+		if running {
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+}
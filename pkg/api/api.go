@@ -3,10 +3,15 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/amartorelli/particles/pkg/cache"
@@ -22,6 +27,42 @@ type API struct {
 	certFile string
 	keyFile  string
 	cache    cache.Cache
+	canaries Canaries
+	certs    Certificates
+	ln       net.Listener
+}
+
+// Canaries changes at runtime the share of clients sent to the canary origins
+type Canaries interface {
+	CanaryWeights() map[string]int
+	SetCanaryWeight(domain string, weight int) error
+}
+
+const (
+	maxCertificateUpload = 1 << 20 // bytes
+)
+
+var (
+	// ErrCertificateNotFound is returned when there's no certificate for a domain
+	ErrCertificateNotFound = errors.New("certificate not found")
+)
+
+// Certificates manages at runtime the certificates served by the CDN. Uploaded certificates are
+// validated before being served
+type Certificates interface {
+	Certificates() []Certificate
+	Certificate(domain string) (Certificate, error)
+	AddCertificate(domain string, cert, key []byte) (Certificate, error)
+	DeleteCertificate(domain string) error
+}
+
+// CertificateError is returned when a certificate is rejected
+type CertificateError struct {
+	Reason string
+}
+
+func (e CertificateError) Error() string {
+	return e.Reason
 }
 
 // NewAPI returns a new API object
@@ -39,21 +80,56 @@ func NewAPI(conf Conf, cache cache.Cache) (*API, error) {
 	return &API{server: s, mux: mux, certFile: conf.CertFile, keyFile: conf.KeyFile, cache: cache}, nil
 }
 
-// Start starts the API server
+// SetCanaries exposes the weights of the canary origins via the API
+func (a *API) SetCanaries(c Canaries) {
+	a.canaries = c
+}
+
+// SetCertificates exposes the certificates via the API
+func (a *API) SetCertificates(c Certificates) {
+	a.certs = c
+}
+
+// Listen opens the socket of the API, so that it's ready before Start is called. The socket is passed
+// to the new process on upgrades
+func (a *API) Listen() error {
+	ln, err := util.Listen("api", a.server.Addr, false)
+	if err != nil {
+		return err
+	}
+	a.ln = ln
+	return nil
+}
+
+// Start starts the API server, listening first if needed
 func (a *API) Start() error {
 	a.mux.Handle("/metrics", promhttp.Handler())
 	a.mux.Handle("/purge", util.HandlerWithLogging(a.purgeHandler))
+	if a.canaries != nil {
+		a.mux.Handle("/canary", util.HandlerWithLogging(a.canaryHandler))
+	}
+	if a.certs != nil {
+		a.mux.Handle("/certificates", util.HandlerWithLogging(a.certificatesHandler))
+		a.mux.Handle("/certificates/", util.HandlerWithLogging(a.certificatesHandler))
+	}
+	if a.ln == nil {
+		err := a.Listen()
+		if err != nil {
+			return err
+		}
+	}
+
 	// if certificates have been configured, start on HTTPS
 	// otherwise fold back to normal HTTP
 	if a.certFile != "" && a.keyFile != "" {
 		logrus.Infof("Starting API on %s (HTTPS)", a.server.Addr)
-		err := a.server.ListenAndServeTLS(a.certFile, a.keyFile)
+		err := a.server.ServeTLS(a.ln, a.certFile, a.keyFile)
 		if err != nil {
 			return err
 		}
 	} else {
 		logrus.Infof("Starting API on %s (HTTP)", a.server.Addr)
-		err := a.server.ListenAndServe()
+		err := a.server.Serve(a.ln)
 		if err != nil {
 			return err
 		}
@@ -83,7 +159,9 @@ type PurgeRequest struct {
 // purgeHandler exposes an endpoint to purge items from the cache
 func (a *API) purgeHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
-	defer purgeDuration.Observe(time.Since(start).Seconds())
+	defer func() {
+		purgeDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	defer req.Body.Close()
 	r := Response{}
@@ -136,3 +214,149 @@ func (a *API) purgeHandler(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(r)
 	return
 }
+
+// CanaryWeight is the share of clients, in percent, sent to the canary origin of a domain
+type CanaryWeight struct {
+	Domain string `json:"domain"`
+	Weight int    `json:"weight"`
+}
+
+// canaryHandler lists the weights of the canary origins on GET and changes one on POST
+func (a *API) canaryHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	r := Response{}
+	w.Header().Set("Content-Type", "application/json")
+
+	switch req.Method {
+	case http.MethodGet:
+		weights := a.canaries.CanaryWeights()
+		cw := make([]CanaryWeight, 0, len(weights))
+		for d, weight := range weights {
+			cw = append(cw, CanaryWeight{Domain: d, Weight: weight})
+		}
+		sort.Slice(cw, func(i, j int) bool { return cw[i].Domain < cw[j].Domain })
+
+		canaryMetric.WithLabelValues(strconv.Itoa(http.StatusOK)).Inc()
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(cw)
+		return
+	case http.MethodPost:
+	default:
+		canaryMetric.WithLabelValues(strconv.Itoa(http.StatusMethodNotAllowed)).Inc()
+		r.Message = "method not allowed"
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(r)
+		return
+	}
+
+	cw := CanaryWeight{}
+	err := json.NewDecoder(req.Body).Decode(&cw)
+	if err != nil || cw.Weight < 0 || cw.Weight > 100 {
+		logrus.Errorf("invalid canary weight request: %v", err)
+		canaryMetric.WithLabelValues(strconv.Itoa(http.StatusBadRequest)).Inc()
+		r.Message = "the request must contain a domain and a weight between 0 and 100"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(r)
+		return
+	}
+
+	err = a.canaries.SetCanaryWeight(cw.Domain, cw.Weight)
+	if err != nil {
+		logrus.Errorf("unable to change canary weight: %s", err)
+		canaryMetric.WithLabelValues(strconv.Itoa(http.StatusNotFound)).Inc()
+		r.Message = err.Error()
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(r)
+		return
+	}
+
+	logrus.Infof("canary weight of %s set to %d%%", cw.Domain, cw.Weight)
+	r.Message = "successfully changed canary weight"
+	canaryMetric.WithLabelValues(strconv.Itoa(http.StatusOK)).Inc()
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(r)
+}
+
+// Certificate describes a certificate served by the CDN
+type Certificate struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// CertificateUpload is used to receive a certificate and its key, PEM encoded, for a domain
+type CertificateUpload struct {
+	Domain string `json:"domain"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// certificatesHandler lists the certificates on GET /certificates and uploads one on POST. The
+// certificate of a domain is inspected with GET /certificates/<domain> and removed with DELETE
+func (a *API) certificatesHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	domain := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/certificates"), "/")
+
+	var (
+		code int
+		body interface{}
+		err  error
+	)
+	switch {
+	case domain == "" && req.Method == http.MethodGet:
+		certs := a.certs.Certificates()
+		sort.SliceStable(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+		code, body = http.StatusOK, certs
+	case domain == "" && req.Method == http.MethodPost:
+		cu := CertificateUpload{}
+		err = json.NewDecoder(io.LimitReader(req.Body, maxCertificateUpload)).Decode(&cu)
+		if err != nil || cu.Domain == "" || cu.Cert == "" || cu.Key == "" {
+			logrus.Errorf("invalid certificate upload: %v", err)
+			err = CertificateError{Reason: "the request must contain a domain, a cert and a key"}
+			break
+		}
+		var c Certificate
+		c, err = a.certs.AddCertificate(cu.Domain, []byte(cu.Cert), []byte(cu.Key))
+		if err == nil {
+			logrus.Infof("certificate for %s uploaded", cu.Domain)
+		}
+		code, body = http.StatusOK, c
+	case domain != "" && req.Method == http.MethodGet:
+		var c Certificate
+		c, err = a.certs.Certificate(domain)
+		code, body = http.StatusOK, c
+	case domain != "" && req.Method == http.MethodDelete:
+		err = a.certs.DeleteCertificate(domain)
+		if err == nil {
+			logrus.Infof("certificate for %s deleted", domain)
+		}
+		code, body = http.StatusOK, Response{Message: "successfully deleted certificate"}
+	default:
+		code, body = http.StatusMethodNotAllowed, Response{Message: "method not allowed"}
+	}
+
+	if err != nil {
+		code = http.StatusInternalServerError
+		msg := "internal error"
+		switch err.(type) {
+		case CertificateError:
+			code, msg = http.StatusBadRequest, err.Error()
+		default:
+			if err == ErrCertificateNotFound {
+				code, msg = http.StatusNotFound, err.Error()
+			} else {
+				logrus.Errorf("certificate request error: %s", err)
+			}
+		}
+		body = Response{Message: msg}
+	}
+
+	certificatesMetric.WithLabelValues(req.Method, strconv.Itoa(code)).Inc()
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -3,8 +3,10 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -71,3 +73,139 @@ func TestPurgeHandler(t *testing.T) {
 		}
 	}
 }
+
+// testCanaries keeps the weights of the canaries in a map
+type testCanaries map[string]int
+
+func (tc testCanaries) CanaryWeights() map[string]int {
+	return tc
+}
+
+func (tc testCanaries) SetCanaryWeight(domain string, weight int) error {
+	if _, ok := tc[domain]; !ok {
+		return fmt.Errorf("no canary for %s", domain)
+	}
+	tc[domain] = weight
+	return nil
+}
+
+func TestCanaryHandler(t *testing.T) {
+	tt := []struct {
+		method string
+		data   string
+		code   int
+		errMsg string
+	}{
+		{"GET", "", http.StatusOK, "Listing the weights should succeed"},
+		{"PUT", "", http.StatusMethodNotAllowed, "A put request should be not allowed"},
+		{"POST", `{"domain": "www.example.com", "weight": 150}`, http.StatusBadRequest, "A weight over 100 should return a bad request"},
+		{"POST", `{"domain": "www.other.com", "weight": 20}`, http.StatusNotFound, "Changing the weight of an unknown domain should return not found"},
+		{"POST", `{"domain": "www.example.com", "weight": 20}`, http.StatusOK, "Changing the weight of a canary should succeed"},
+	}
+
+	c, err := cache.NewCache(cache.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAPI(DefaultConf(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canaries := testCanaries{"www.example.com": 5}
+	a.SetCanaries(canaries)
+
+	for _, tc := range tt {
+		req, err := http.NewRequest(tc.method, "/canary", strings.NewReader(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		a.canaryHandler(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%s: expected %d, received %d", tc.errMsg, tc.code, rr.Code)
+		}
+	}
+
+	if canaries["www.example.com"] != 20 {
+		t.Errorf("expected the weight to be changed to 20, it's %d", canaries["www.example.com"])
+	}
+}
+
+// testCertificates keeps the certificates uploaded in a map
+type testCertificates map[string]Certificate
+
+func (tc testCertificates) Certificates() []Certificate {
+	certs := []Certificate{}
+	for _, c := range tc {
+		certs = append(certs, c)
+	}
+	return certs
+}
+
+func (tc testCertificates) Certificate(domain string) (Certificate, error) {
+	c, ok := tc[domain]
+	if !ok {
+		return Certificate{}, ErrCertificateNotFound
+	}
+	return c, nil
+}
+
+func (tc testCertificates) AddCertificate(domain string, cert, key []byte) (Certificate, error) {
+	if string(cert) != "valid" {
+		return Certificate{}, CertificateError{Reason: "invalid certificate"}
+	}
+	tc[domain] = Certificate{Name: domain}
+	return tc[domain], nil
+}
+
+func (tc testCertificates) DeleteCertificate(domain string) error {
+	if _, ok := tc[domain]; !ok {
+		return ErrCertificateNotFound
+	}
+	delete(tc, domain)
+	return nil
+}
+
+func TestCertificatesHandler(t *testing.T) {
+	tt := []struct {
+		method string
+		path   string
+		data   string
+		code   int
+		errMsg string
+	}{
+		{"GET", "/certificates", "", http.StatusOK, "Listing the certificates should succeed"},
+		{"PUT", "/certificates", "", http.StatusMethodNotAllowed, "A put request should be not allowed"},
+		{"POST", "/certificates", `{"domain": "www.example.com"}`, http.StatusBadRequest, "An upload without certificate should return a bad request"},
+		{"POST", "/certificates", `{"domain": "www.example.com", "cert": "invalid", "key": "key"}`, http.StatusBadRequest, "An invalid certificate should return a bad request"},
+		{"GET", "/certificates/www.example.com", "", http.StatusNotFound, "Inspecting a missing certificate should return not found"},
+		{"POST", "/certificates", `{"domain": "www.example.com", "cert": "valid", "key": "key"}`, http.StatusOK, "A valid certificate should be uploaded"},
+		{"GET", "/certificates/www.example.com", "", http.StatusOK, "Inspecting an uploaded certificate should succeed"},
+		{"DELETE", "/certificates/www.example.com", "", http.StatusOK, "Deleting an uploaded certificate should succeed"},
+		{"DELETE", "/certificates/www.example.com", "", http.StatusNotFound, "Deleting a missing certificate should return not found"},
+	}
+
+	c, err := cache.NewCache(cache.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAPI(DefaultConf(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetCertificates(testCertificates{})
+
+	for _, tc := range tt {
+		req, err := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		a.certificatesHandler(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%s: expected %d, received %d", tc.errMsg, tc.code, rr.Code)
+		}
+	}
+}
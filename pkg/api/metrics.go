@@ -15,4 +15,14 @@ var (
 		Name: "particles_api_purge_seconds",
 		Help: "Purge requests duration",
 	})
+
+	canaryMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_api_canary_total",
+		Help: "Canary weight requests received by the API",
+	}, []string{"code"})
+
+	certificatesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_api_certificates_total",
+		Help: "Certificate requests received by the API",
+	}, []string{"method", "code"})
 )
@@ -6,8 +6,18 @@ import (
 	"regexp"
 )
 
+const (
+	// variantSeparator separates the key of an object from the suffix identifying a variant of it,
+	// like a slice or the copy fetched from another version of the origin. Keys are URLs without
+	// fragment, so the separator never appears in the key itself
+	variantSeparator  = "#"
+	sliceSeparator    = variantSeparator + "slice-"
+	versionSeparator  = variantSeparator + "version-"
+	listenerSeparator = variantSeparator + "listener-"
+)
+
 var (
-	validCacheTypes     = []string{"memory", "memcached"}
+	validCacheTypes     = []string{"memory", "memcached", "disk"}
 	errInvalidCacheType = errors.New("invalid cache type specified")
 )
 
@@ -43,6 +53,12 @@ func NewCache(conf Conf) (Cache, error) {
 			return nil, err
 		}
 		return c, nil
+	case "disk":
+		c, err := NewDiskCache(conf.Options)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
 	default:
 		return nil, errInvalidCacheType
 	}
@@ -73,6 +89,24 @@ func (co *ContentObject) CachedTimestamp() int64 {
 	return co.cachedTimestamp
 }
 
+// SliceKey returns the key of a slice of the object stored at key. The version identifies the
+// copy of the object the slice belongs to, so that slices of different copies are never mixed
+func SliceKey(key string, version string, index int64) string {
+	return fmt.Sprintf("%s%s%s-%d", key, sliceSeparator, version, index)
+}
+
+// VersionKey returns the key of the object stored at key when fetched from a given version of the
+// origin, so that objects of different versions are cached separately
+func VersionKey(key string, version string) string {
+	return key + versionSeparator + version
+}
+
+// ListenerKey returns the key of the object stored at key when served on a given listener, so that
+// the objects of backends pinned to different listeners are cached separately
+func ListenerKey(key string, listener string) string {
+	return key + listenerSeparator + listener
+}
+
 // contentTypeRegex compiles a regex to be used to check cachable Content-Type
 func contentTypeRegex(patterns string) (*regexp.Regexp, error) {
 	if patterns != "" {
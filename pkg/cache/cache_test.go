@@ -12,6 +12,8 @@ func TestIsValid(t *testing.T) {
 	}{
 		{Conf{Type: "invalid", Options: make(map[string]string, 0)}, false, "An invalid configuration should be invalid"},
 		{Conf{Type: "memory", Options: make(map[string]string, 0)}, true, "A valid configuration should be valid"},
+		{Conf{Type: "disk", Options: map[string]string{"dir": "/var/cache/particles"}}, true, "A disk cache with a directory should be valid"},
+		{Conf{Type: "disk", Options: make(map[string]string, 0)}, false, "A disk cache without directory should be invalid"},
 	}
 
 	for _, tc := range tt {
@@ -20,10 +20,18 @@ func DefaultConf() Conf {
 
 // IsValid checks the cache configuration is valid
 func (c Conf) IsValid() (bool, string) {
+	valid := false
 	for _, t := range validCacheTypes {
 		if c.Type == t {
-			return true, ""
+			valid = true
 		}
 	}
-	return false, "invalid cache type"
+	if !valid {
+		return false, "invalid cache type"
+	}
+
+	if c.Type == "disk" && c.Options["dir"] == "" {
+		return false, "the disk cache requires a directory"
+	}
+	return true, ""
 }
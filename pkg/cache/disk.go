@@ -0,0 +1,550 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// diskObjectsDir is the directory of the objects, fanned out in subdirectories by the hash of their key
+	diskObjectsDir = "objects"
+	// diskTmpDir is the directory where the objects are written before being moved to their path
+	diskTmpDir = "tmp"
+	// diskFileMagic starts the files of the objects, followed by the length of the metadata, the
+	// metadata and the content
+	diskFileMagic = "PRT1"
+	// diskMaxMetaSize is the longest metadata accepted when reading a file
+	diskMaxMetaSize = 1048576 // 1MB
+)
+
+var (
+	// defaultDiskLimit is the maximum amount of disk used by the cache
+	defaultDiskLimit int64 = 10737418240 // 10GB default disk limit
+
+	// errors
+	errConfDiskDir     = errors.New("the directory of the disk cache is required")
+	errConfDiskLimit   = errors.New("error parsing disk limit")
+	errInvalidDiskFile = errors.New("invalid cache file")
+	errFreeDisk        = errors.New("unable to free up disk space")
+	errNotEnoughDisk   = errors.New("unable to fit new item in disk cache")
+)
+
+// DiskCache represents a cache object stored on disk. The index of the objects is kept in memory
+// and rebuilt from the files at startup, so that the cache is warm after a restart
+type DiskCache struct {
+	dir               string
+	objs              map[string]*DiskItem
+	contentTypeRegexp *regexp.Regexp
+	objsMutex         sync.Mutex
+	diskLimit         int64
+	diskSize          int64
+	hits              int
+	forcePurge        bool
+}
+
+// DiskCacheConfig is how the configuration for the disk cache is represented in the config file
+type DiskCacheConfig struct {
+	Dir        string   `yaml:"dir"`         // directory of the cache files
+	DiskLimit  int64    `yaml:"disk_limit"`  // optional, how much disk in bytes to use
+	Patterns   []string `yaml:"patterns"`    // optional, content-type patterns
+	ForcePurge bool     `yaml:"force_purge"` // optional, delete random items if disk space can't be freed up
+}
+
+// DiskItem is the entry of an object in the index of the disk cache
+type DiskItem struct {
+	path       string
+	expiration time.Time
+	fileSize   int64
+	hits       int
+}
+
+// diskMeta is the metadata written with the content of an object. It's enough to rebuild the index
+type diskMeta struct {
+	Key             string
+	ContentType     string
+	Headers         map[string]string
+	TTL             int
+	CachedTimestamp int64
+	Expiration      int64
+	ContentSize     int64
+}
+
+// NewDiskCache initialises a new cache, loading the objects already stored in its directory
+func NewDiskCache(options map[string]string) (*DiskCache, error) {
+	// directory
+	dir, ok := options["dir"]
+	if !ok || dir == "" {
+		return nil, errConfDiskDir
+	}
+
+	// disk limit
+	dl := defaultDiskLimit
+	v, ok := options["disk_limit"]
+	if ok {
+		tmp, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || tmp <= 0 {
+			return nil, errConfDiskLimit
+		}
+		dl = tmp
+	}
+
+	// patterns
+	var patterns string
+	v, ok = options["patterns"]
+	if ok {
+		patterns = v
+	}
+	regex, err := contentTypeRegex(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	// force purge
+	fp := defaultForcePurge
+	v, ok = options["force_purge"]
+	if ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errConfForcePurge
+		}
+		fp = b
+	}
+
+	c := &DiskCache{dir: dir, objs: make(map[string]*DiskItem), contentTypeRegexp: regex, diskLimit: dl, forcePurge: fp}
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load rebuilds the index from the files of the objects. The files left by a store interrupted by
+// a crash, the invalid ones and the expired ones are removed
+func (c *DiskCache) load() error {
+	for _, d := range []string{diskObjectsDir, diskTmpDir} {
+		err := os.MkdirAll(filepath.Join(c.dir, d), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.ReadDir(filepath.Join(c.dir, diskTmpDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range tmp {
+		os.Remove(filepath.Join(c.dir, diskTmpDir, fi.Name()))
+	}
+
+	now := time.Now()
+	err = filepath.Walk(filepath.Join(c.dir, diskObjectsDir), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		meta, err := readDiskMeta(path, fi.Size())
+		if err == nil && c.objectPath(meta.Key) != path {
+			err = errInvalidDiskFile
+		}
+		if err != nil {
+			logrus.Warnf("removing the invalid cache file %s: %s", path, err)
+			os.Remove(path)
+			return nil
+		}
+
+		expiration := time.Unix(meta.Expiration, 0)
+		if now.After(expiration) {
+			os.Remove(path)
+			return nil
+		}
+		c.objs[meta.Key] = &DiskItem{path: path, expiration: expiration, fileSize: fi.Size()}
+		c.diskSize += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.diskSize > c.diskLimit {
+		// the limit was lowered since the objects were stored
+		err = c.freeDisk(0, "")
+		if err != nil {
+			logrus.Warnf("the disk cache is over its limit: %s", err)
+		}
+	}
+	logrus.Infof("loaded %d objects (%d bytes) from the disk cache in %s", len(c.objs), c.diskSize, c.dir)
+	return nil
+}
+
+// objectPath returns the path of the file of an object, in subdirectories named after the first
+// bytes of the hash of its key so that no directory grows too large
+func (c *DiskCache) objectPath(key string) string {
+	h := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(c.dir, diskObjectsDir, name[0:2], name[2:4], name)
+}
+
+// readDiskMeta reads the metadata of an object, checking the file contains all of its content
+func readDiskMeta(path string, fileSize int64) (*diskMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta, offset, err := decodeDiskMeta(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	if offset+meta.ContentSize != fileSize {
+		return nil, errInvalidDiskFile
+	}
+	return meta, nil
+}
+
+// decodeDiskMeta decodes the metadata at the start of a file and returns the offset of the content
+func decodeDiskMeta(r io.Reader) (*diskMeta, int64, error) {
+	hdr := make([]byte, len(diskFileMagic)+4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil || string(hdr[:len(diskFileMagic)]) != diskFileMagic {
+		return nil, 0, errInvalidDiskFile
+	}
+	size := binary.BigEndian.Uint32(hdr[len(diskFileMagic):])
+	if size > diskMaxMetaSize {
+		return nil, 0, errInvalidDiskFile
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, 0, errInvalidDiskFile
+	}
+	var meta diskMeta
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&meta)
+	if err != nil || meta.ContentSize < 0 {
+		return nil, 0, errInvalidDiskFile
+	}
+	return &meta, int64(len(hdr)) + int64(size), nil
+}
+
+// encodeDiskMeta returns the start of the file of an object, before its content
+func encodeDiskMeta(meta *diskMeta) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := append([]byte(diskFileMagic), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(hdr[len(diskFileMagic):], uint32(buf.Len()))
+	return append(hdr, buf.Bytes()...), nil
+}
+
+// IsCachableContentType returns true in case the content type is one that can be cached
+func (c *DiskCache) IsCachableContentType(contentType string) bool {
+	return c.contentTypeRegexp.MatchString(contentType)
+}
+
+// Lookup returns the content if present and a boolean to represent if it's been found
+func (c *DiskCache) Lookup(key string) (*ContentObject, bool, error) {
+	start := time.Now()
+	defer func() {
+		lookupDuration.WithLabelValues("disk").Observe(time.Since(start).Seconds())
+	}()
+
+	c.objsMutex.Lock()
+	di, found := c.objs[key]
+	if !found {
+		c.objsMutex.Unlock()
+		lookupMetric.WithLabelValues("disk", "miss").Inc()
+		logrus.Debugf("item %s not found", key)
+		return nil, false, nil
+	}
+	// if the entry has expired, don't return it and delete it
+	if time.Now().After(di.expiration) {
+		c.remove(key, di)
+		c.objsMutex.Unlock()
+		lookupMetric.WithLabelValues("disk", "miss").Inc()
+		logrus.Debugf("item %s is expired", key)
+		return nil, false, errExpiredItem
+	}
+	di.hits++
+	c.hits++
+	c.objsMutex.Unlock()
+
+	// the file is read without lock: a file replaced or removed meanwhile stays readable once opened
+	co, err := readDiskObject(di.path, key)
+	if err != nil {
+		logrus.Debugf("error reading item %s: %s", key, err)
+		lookupMetric.WithLabelValues("disk", "error").Inc()
+		c.objsMutex.Lock()
+		if c.objs[key] == di {
+			c.remove(key, di)
+		}
+		c.objsMutex.Unlock()
+		return nil, false, nil
+	}
+
+	lookupMetric.WithLabelValues("disk", "hit").Inc()
+	logrus.Debugf("successfully looked up %s", key)
+	return co, true, nil
+}
+
+// readDiskObject reads the file of an object
+func readDiskObject(path string, key string) (*ContentObject, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	meta, _, err := decodeDiskMeta(r)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Key != key {
+		return nil, errInvalidDiskFile
+	}
+	content := make([]byte, meta.ContentSize)
+	_, err = io.ReadFull(r, content)
+	if err != nil {
+		return nil, errInvalidDiskFile
+	}
+	return NewContentObject(content, meta.ContentType, meta.Headers, meta.TTL, meta.CachedTimestamp), nil
+}
+
+// freeDisk frees up some space to fit a new object of size bytes, with the same policy as the
+// memory cache: expired entries and entries hit less than 10% of the total hits are deleted first,
+// raising the threshold up to 50%, then random entries if force purge is set. The entry of keep,
+// which is being replaced, isn't deleted. It must be called with the lock held
+func (c *DiskCache) freeDisk(size int64, keep string) error {
+	logrus.Debugf("freeing up disk to allocate %d bytes", size)
+	now := time.Now()
+	fits := func() bool { return c.diskSize+size <= c.diskLimit }
+
+	for i := 10; i <= 50 && !fits(); i++ {
+		percentHits := i * c.hits / 100
+		for k, di := range c.objs {
+			// delete any expired item or items with a low percentage of hit rate
+			if k != keep && (now.After(di.expiration) || di.hits < percentHits) {
+				c.remove(k, di)
+				if fits() {
+					break
+				}
+			}
+		}
+	}
+
+	// if we couldn't free enough space and the force purge is set, delete random items
+	if !fits() && c.forcePurge {
+		for k, di := range c.objs {
+			if k == keep {
+				continue
+			}
+			c.remove(k, di)
+			if fits() {
+				break
+			}
+		}
+	}
+
+	if !fits() {
+		logrus.Debugf("unable to free enough disk (%d/%d)", c.diskSize+size, c.diskLimit)
+		return errFreeDisk
+	}
+	return nil
+}
+
+// remove deletes an entry and its file. It must be called with the lock held
+func (c *DiskCache) remove(key string, di *DiskItem) {
+	logrus.Debugf("purging %s", key)
+	err := os.Remove(di.path)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("error removing the cache file %s: %s", di.path, err)
+	}
+	c.diskSize -= di.fileSize
+	delete(c.objs, key)
+}
+
+// Store inserts a new entry into the cache. The object is written to a temporary file which is
+// synced and renamed, so that a crash never leaves a partially written object in the cache
+func (c *DiskCache) Store(key string, co *ContentObject) error {
+	start := time.Now()
+	defer func() {
+		storeDuration.WithLabelValues("disk").Observe(time.Since(start).Seconds())
+	}()
+
+	now := time.Now()
+	if co.TTL() == 0 {
+		co.ttl = defaultTTL
+	}
+	meta := &diskMeta{Key: key, ContentType: co.ContentType, Headers: co.Headers(), TTL: co.TTL(), CachedTimestamp: co.CachedTimestamp(),
+		Expiration: now.Add(time.Duration(co.TTL()) * time.Second).Unix(), ContentSize: int64(len(co.Content()))}
+	hdr, err := encodeDiskMeta(meta)
+	if err != nil {
+		logrus.Debugf("error encoding item to store for %s: %s", key, err)
+		storeMetric.WithLabelValues("disk", "error").Inc()
+		return errStoringItem
+	}
+
+	size := int64(len(hdr)) + meta.ContentSize
+	if size > c.diskLimit {
+		logrus.Debugf("item %s can't fit in the disk cache", key)
+		return errNotEnoughDisk
+	}
+
+	tmp, err := c.writeTmp(hdr, co.Content())
+	if err != nil {
+		logrus.Errorf("error writing item %s to the disk cache: %s", key, err)
+		storeMetric.WithLabelValues("disk", "error").Inc()
+		return err
+	}
+
+	// the space is reserved before renaming the file, and the entry being replaced is only dropped
+	// once the new file is in place, so that a failure keeps the previous copy
+	c.objsMutex.Lock()
+	var oldSize int64
+	if old, ok := c.objs[key]; ok {
+		oldSize = old.fileSize
+	}
+	if c.diskSize-oldSize+size > c.diskLimit {
+		storeMetric.WithLabelValues("disk", "disk_limit").Inc()
+		logrus.Debugf("disk: %d/%d", c.diskSize-oldSize+size, c.diskLimit)
+		err = c.freeDisk(size-oldSize, key)
+		if err != nil {
+			c.objsMutex.Unlock()
+			os.Remove(tmp)
+			logrus.Debugf("error storing item %s: %s", key, err)
+			return err
+		}
+	}
+	c.diskSize += size
+	c.objsMutex.Unlock()
+
+	path := c.objectPath(key)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		c.objsMutex.Lock()
+		c.diskSize -= size
+		c.objsMutex.Unlock()
+		os.Remove(tmp)
+		logrus.Errorf("error storing item %s in the disk cache: %s", key, err)
+		storeMetric.WithLabelValues("disk", "error").Inc()
+		return err
+	}
+	syncDir(filepath.Dir(path))
+
+	// the file of the replaced entry has been overwritten by the rename
+	c.objsMutex.Lock()
+	if old, ok := c.objs[key]; ok {
+		c.diskSize -= old.fileSize
+	}
+	c.objs[key] = &DiskItem{path: path, expiration: time.Unix(meta.Expiration, 0), fileSize: size}
+	c.objsMutex.Unlock()
+
+	logrus.Debugf("successfully stored item for %s", key)
+	storeMetric.WithLabelValues("disk", "success").Inc()
+	return nil
+}
+
+// writeTmp writes the file of an object in the temporary directory and syncs it
+func (c *DiskCache) writeTmp(hdr []byte, content []byte) (string, error) {
+	f, err := ioutil.TempFile(filepath.Join(c.dir, diskTmpDir), "object-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(hdr)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// syncDir syncs a directory, so that the files renamed in it survive a crash
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		logrus.Debugf("error syncing %s: %s", dir, err)
+	}
+}
+
+// Purge deletes an item from the cache
+func (c *DiskCache) Purge(key string) error {
+	start := time.Now()
+	defer func() {
+		purgeDuration.WithLabelValues("disk").Observe(time.Since(start).Seconds())
+	}()
+
+	c.objsMutex.Lock()
+	di, ok := c.objs[key]
+	if ok {
+		c.remove(key, di)
+	}
+
+	// the variants of the object, like its slices, are purged with it
+	for k, di := range c.objs {
+		if strings.HasPrefix(k, key+variantSeparator) {
+			c.remove(k, di)
+			ok = true
+		}
+	}
+	c.objsMutex.Unlock()
+
+	if !ok {
+		purgeMetric.WithLabelValues("disk", "miss").Inc()
+		return errNotFound
+	}
+	logrus.Debugf("successfully purged item %s", key)
+	purgeMetric.WithLabelValues("disk", "success").Inc()
+	return nil
+}
+
+// Expiration returns the expiration time for an entry
+func (di *DiskItem) Expiration() time.Time {
+	return di.expiration
+}
+
+// Size returns the size of the file of the entry
+func (di *DiskItem) Size() int64 {
+	return di.fileSize
+}
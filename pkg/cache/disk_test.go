@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDiskCache returns a disk cache in a temporary directory
+func newTestDiskCache(t *testing.T, options map[string]string) (*DiskCache, string) {
+	dir, err := ioutil.TempDir("", "particles-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options["dir"] = dir
+	c, err := NewDiskCache(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func TestDiskCache(t *testing.T) {
+	c, dir := newTestDiskCache(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		key     string
+		data    []byte
+		ttl     int
+		present bool
+		err     error
+		errMsg  string
+	}{
+		{"www.example.com/default.js", []byte("default"), 0, true, nil, "an item should be found with the default ttl"},
+		{"www.example.com/custom.js", []byte("custom"), 45, true, nil, "an item should be found with its ttl"},
+		{"www.example.com/empty.js", []byte{}, 45, true, nil, "an empty item should be found"},
+		{"www.example.com/expired.js", []byte("expired"), -3600, false, errExpiredItem, "an expired item should not be found"},
+	}
+
+	for _, tc := range tt {
+		co := NewContentObject(tc.data, "application/javascript", map[string]string{"Cache-Control": "max-age=45"}, tc.ttl, 1234)
+		err := c.Store(tc.key, co)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.errMsg, err)
+		}
+
+		r, found, err := c.Lookup(tc.key)
+		if found != tc.present || err != tc.err {
+			t.Errorf("%s: found %t, error %v", tc.errMsg, found, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		ttl := tc.ttl
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+		if !bytes.Equal(r.Content(), tc.data) || r.TTL() != ttl || r.ContentType != "application/javascript" ||
+			r.Headers()["Cache-Control"] != "max-age=45" || r.CachedTimestamp() != 1234 {
+			t.Errorf("%s: received %+v", tc.errMsg, r)
+		}
+	}
+
+	_, found, err := c.Lookup("www.example.com/missing.js")
+	if found || err != nil {
+		t.Error("a missing item should not be found")
+	}
+
+	// the variants of the object are purged with it
+	co := NewContentObject([]byte("0123"), "video/mp4", nil, 0, time.Now().Unix())
+	keys := []string{"www.example.com/video.mp4", SliceKey("www.example.com/video.mp4", "v1", 0), VersionKey("www.example.com/video.mp4", "canary"), "www.example.com/video.mp4.jpg"}
+	for _, k := range keys {
+		err = c.Store(k, co)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Purge("www.example.com/video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		_, found, _ := c.Lookup(k)
+		if found != (i == 3) {
+			t.Errorf("unexpected presence of %s after purging the object: %t", k, found)
+		}
+		if _, err := os.Stat(c.objectPath(k)); os.IsNotExist(err) != (i != 3) {
+			t.Errorf("unexpected presence of the file of %s after purging the object", k)
+		}
+	}
+	err = c.Purge("www.example.com/video.mp4")
+	if err != errNotFound {
+		t.Error("purging an object which isn't cached should fail")
+	}
+}
+
+func TestDiskCacheRestart(t *testing.T) {
+	c, dir := newTestDiskCache(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	keys := []string{"www.example.com/valid.js", "www.example.com/truncated.js", "www.example.com/corrupt.js", "www.example.com/moved.js", "www.example.com/expired.js"}
+	for _, k := range keys {
+		ttl := 60
+		if k == "www.example.com/expired.js" {
+			ttl = 1
+		}
+		err := c.Store(k, NewContentObject([]byte("content of "+k), "application/javascript", nil, ttl, time.Now().Unix()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a crash can leave temporary files, and files can be damaged or misplaced
+	err := ioutil.WriteFile(filepath.Join(dir, diskTmpDir, "object-123"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(c.objectPath(keys[1]), c.objs[keys[1]].Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(c.objectPath(keys[2]), []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := c.objectPath("www.example.com/other.js")
+	err = os.MkdirAll(filepath.Dir(moved), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(c.objectPath(keys[3]), moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+
+	c, err = NewDiskCache(map[string]string{"dir": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := 0
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files++
+		}
+		return nil
+	})
+	if files != 1 {
+		t.Errorf("the invalid, expired and temporary files should be removed at startup, %d files left", files)
+	}
+	di, ok := c.objs[keys[0]]
+	if !ok || c.diskSize != di.Size() {
+		t.Errorf("the size of the cache should be rebuilt, received %d", c.diskSize)
+	}
+
+	for i, k := range keys {
+		co, found, _ := c.Lookup(k)
+		if found != (i == 0) {
+			t.Errorf("unexpected presence of %s after a restart: %t", k, found)
+		}
+		if found && string(co.Content()) != "content of "+k {
+			t.Errorf("unexpected content of %s after a restart: %s", k, co.Content())
+		}
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	co := func(size int) *ContentObject {
+		return NewContentObject(bytes.Repeat([]byte("a"), size), "image/png", nil, 0, time.Now().Unix())
+	}
+	c, dir := newTestDiskCache(t, map[string]string{"disk_limit": "10000", "force_purge": "false"})
+	defer os.RemoveAll(dir)
+
+	err := c.Store("www.example.com/too-large.png", co(10000))
+	if err != errNotEnoughDisk {
+		t.Errorf("an item larger than the cache should not be stored: %v", err)
+	}
+
+	for _, k := range []string{"www.example.com/popular.png", "www.example.com/unpopular.png"} {
+		err = c.Store(k, co(3000))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		c.Lookup("www.example.com/popular.png")
+	}
+
+	// the items hit less are evicted first
+	err = c.Store("www.example.com/new.png", co(4000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, present := range map[string]bool{"www.example.com/popular.png": true, "www.example.com/unpopular.png": false, "www.example.com/new.png": true} {
+		_, found, _ := c.Lookup(k)
+		if found != present {
+			t.Errorf("unexpected presence of %s after the eviction: %t", k, found)
+		}
+	}
+	if c.diskSize > c.diskLimit {
+		t.Errorf("the cache should not exceed its limit: %d/%d", c.diskSize, c.diskLimit)
+	}
+
+	// without force purge the items hit often are kept
+	err = c.Store("www.example.com/other.png", co(7000))
+	if err != errFreeDisk {
+		t.Errorf("an item should not be stored if the space can't be freed up: %v", err)
+	}
+
+	c.forcePurge = true
+	err = c.Store("www.example.com/other.png", co(7000))
+	if err != nil {
+		t.Errorf("an item should be stored deleting random items with force purge: %v", err)
+	}
+	if c.diskSize > c.diskLimit {
+		t.Errorf("the cache should not exceed its limit: %d/%d", c.diskSize, c.diskLimit)
+	}
+}
+
+func TestDiskCacheReplace(t *testing.T) {
+	c, dir := newTestDiskCache(t, map[string]string{"disk_limit": "10000", "force_purge": "false"})
+	defer os.RemoveAll(dir)
+
+	store := func(key string, content string) error {
+		return c.Store(key, NewContentObject([]byte(content), "image/png", nil, 0, time.Now().Unix()))
+	}
+	for _, k := range []string{"www.example.com/replaced.png", "www.example.com/popular.png"} {
+		err := store(k, string(bytes.Repeat([]byte("a"), 3000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			c.Lookup(k)
+		}
+	}
+	size := c.diskSize
+
+	tt := []struct {
+		content string
+		err     error
+		errMsg  string
+	}{
+		{string(bytes.Repeat([]byte("b"), 7500)), errFreeDisk, "the previous copy should be kept if the new one can't be stored"},
+		{string(bytes.Repeat([]byte("c"), 4000)), nil, "the previous copy should be replaced by the new one"},
+	}
+
+	for _, tc := range tt {
+		err := store("www.example.com/replaced.png", tc.content)
+		if err != tc.err {
+			t.Errorf("%s: received %v", tc.errMsg, err)
+		}
+		expected := tc.content
+		if err != nil {
+			expected = string(bytes.Repeat([]byte("a"), 3000))
+		} else {
+			size += int64(len(tc.content) - 3000)
+		}
+
+		co, found, _ := c.Lookup("www.example.com/replaced.png")
+		if !found || string(co.Content()) != expected {
+			t.Errorf("%s: found %t", tc.errMsg, found)
+		}
+		_, found, _ = c.Lookup("www.example.com/popular.png")
+		if !found {
+			t.Errorf("%s: the other items should be kept", tc.errMsg)
+		}
+		if c.diskSize != size {
+			t.Errorf("%s: the size of the cache should be %d, received %d", tc.errMsg, size, c.diskSize)
+		}
+	}
+}
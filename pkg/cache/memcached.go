@@ -2,7 +2,9 @@ package cache
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"regexp"
 	"time"
@@ -12,6 +14,11 @@ import (
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+const (
+	// memcachedMaxKeyLength is the longest key accepted by memcached
+	memcachedMaxKeyLength = 250
+)
+
 var (
 	errDecodingItem = errors.New("error decoding item")
 	errStoringItem  = errors.New("error storing item")
@@ -69,9 +76,11 @@ func (c *MemcachedCache) IsCachableContentType(contentType string) bool {
 // value ="content-type|bytes" so we split on "|"
 func (c *MemcachedCache) Lookup(key string) (*ContentObject, bool, error) {
 	start := time.Now()
-	defer lookupDuration.WithLabelValues("memcached").Observe(time.Since(start).Seconds())
+	defer func() {
+		lookupDuration.WithLabelValues("memcached").Observe(time.Since(start).Seconds())
+	}()
 
-	i, err := c.mc.Get(key)
+	i, err := c.mc.Get(memcachedKey(key))
 	if err == memcache.ErrCacheMiss {
 		logrus.Debugf("cache miss for %s: %s", key, err)
 		lookupMetric.WithLabelValues("memcached", "miss").Inc()
@@ -101,7 +110,9 @@ func (c *MemcachedCache) Lookup(key string) (*ContentObject, bool, error) {
 // Store inserts a new entry into the cache
 func (c *MemcachedCache) Store(key string, co *ContentObject) error {
 	start := time.Now()
-	defer storeDuration.WithLabelValues("memcached").Observe(time.Since(start).Seconds())
+	defer func() {
+		storeDuration.WithLabelValues("memcached").Observe(time.Since(start).Seconds())
+	}()
 
 	var buf bytes.Buffer
 	mi := &MemcachedItem{Content: co.Content(), Headers: co.Headers(), ContentType: co.ContentType, CachedTimestamp: time.Now().Unix()}
@@ -113,7 +124,7 @@ func (c *MemcachedCache) Store(key string, co *ContentObject) error {
 	}
 
 	i := memcache.Item{
-		Key:        key,
+		Key:        memcachedKey(key),
 		Value:      buf.Bytes(),
 		Expiration: int32(co.TTL()),
 	}
@@ -132,9 +143,11 @@ func (c *MemcachedCache) Store(key string, co *ContentObject) error {
 // Purge deletes an item from the cache
 func (c *MemcachedCache) Purge(key string) error {
 	start := time.Now()
-	defer purgeDuration.WithLabelValues("memcached").Observe(time.Since(start).Seconds())
+	defer func() {
+		purgeDuration.WithLabelValues("memcached").Observe(time.Since(start).Seconds())
+	}()
 
-	err := c.mc.Delete(key)
+	err := c.mc.Delete(memcachedKey(key))
 	if err == memcache.ErrCacheMiss {
 		purgeMetric.WithLabelValues("memcached", "miss").Inc()
 		return nil
@@ -148,3 +161,18 @@ func (c *MemcachedCache) Purge(key string) error {
 	purgeMetric.WithLabelValues("memcached", "success").Inc()
 	return nil
 }
+
+// memcachedKey returns a key accepted by memcached. Keys which are too long, like the ones of the
+// slices of an object with a long URL, or contain spaces or control characters are hashed
+func memcachedKey(key string) string {
+	valid := len(key) <= memcachedMaxKeyLength
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+
+	h := sha256.Sum256([]byte(key))
+	return "particles:" + hex.EncodeToString(h[:])
+}
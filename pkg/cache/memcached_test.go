@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemcachedKey(t *testing.T) {
+	tt := []struct {
+		key    string
+		hashed bool
+	}{
+		{"http://www.example.com/video.mp4", false},
+		{SliceKey("http://www.example.com/video.mp4", "v1", 3), false},
+		{"http://www.example.com/" + strings.Repeat("a", 250), true},
+		{"http://www.example.com/a b", true},
+	}
+
+	for _, tc := range tt {
+		k := memcachedKey(tc.key)
+		if (k != tc.key) != tc.hashed || len(k) > memcachedMaxKeyLength {
+			t.Errorf("unexpected memcached key %s for %s", k, tc.key)
+		}
+	}
+
+	if memcachedKey(tt[2].key) == memcachedKey(tt[2].key+"b") {
+		t.Error("different keys should have different hashes")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -102,30 +103,33 @@ func (c *MemoryCache) IsCachableContentType(contentType string) bool {
 // Lookup returns the content if present and a boolean to represent if it's been found
 func (c *MemoryCache) Lookup(key string) (*ContentObject, bool, error) {
 	start := time.Now()
-	defer lookupDuration.WithLabelValues("memory").Observe(time.Since(start).Seconds())
+	defer func() {
+		lookupDuration.WithLabelValues("memory").Observe(time.Since(start).Seconds())
+	}()
 
-	c.objsMutex.RLock()
+	// the hits are counted, so the map is locked for writing
+	c.objsMutex.Lock()
 	mi, found := c.objs[key]
 	if found {
 		// if the entry has expired, don't return it and delete it
 		if time.Now().After(mi.Expiration()) {
 			lookupMetric.WithLabelValues("memory", "miss").Inc()
 			c.misses++
-			delete(c.objs, key)
-			c.objsMutex.RUnlock()
+			c.purgeEntries([]string{key})
+			c.objsMutex.Unlock()
 			logrus.Debugf("item %s is expired", key)
 			return nil, false, errExpiredItem
 		}
 		lookupMetric.WithLabelValues("memory", "hit").Inc()
 		mi.hits++
 		c.hits++
-		c.objsMutex.RUnlock()
+		c.objsMutex.Unlock()
 		logrus.Debugf("successfully looked up %s", key)
 		return mi.co, found, nil
 	}
 	lookupMetric.WithLabelValues("memory", "miss").Inc()
 	c.misses++
-	c.objsMutex.RUnlock()
+	c.objsMutex.Unlock()
 
 	logrus.Debugf("item %s not found", key)
 	return nil, found, nil
@@ -133,50 +137,51 @@ func (c *MemoryCache) Lookup(key string) (*ContentObject, bool, error) {
 
 // freeMemory frees up some space in the hash map to at least fit a new object of size bytes
 // By default it deletes entries that have been hit less than 10% of the current total hits received
-// by the cache.
-// freeMemory is not accurate, to make sure we don't block requests, we avoid locking the map during the check.
+// by the cache, raising the threshold up to 50%, then random entries if force purge is set.
+// freeMemory must be called with the lock held.
 func (c *MemoryCache) freeMemory(size int) error {
 	logrus.Debugf("freeing up memory to allocate %d bytes", size)
-	var tbd []string
+	tbd := make(map[string]bool)
 	var fs int
+	fits := func() bool { return c.memSize-fs+size <= c.memLimit }
+	now := time.Now()
+
 	// free memory by removing an entry that has been hit less than
 	// 10% of total hits
-	i := 10
-	done := false
-
-	for i <= 50 && !done {
+	for i := 10; i <= 50 && !fits(); i++ {
 		percentHits := i * c.hits / 100
 
 		for k, co := range c.objs {
 			// delete any expired item or items with a low percentage of hit rate
-			if time.Now().After(co.Expiration()) || co.hits < percentHits {
-				tbd = append(tbd, k)
+			if !tbd[k] && (now.After(co.Expiration()) || co.hits < percentHits) {
+				tbd[k] = true
 				fs = fs + co.Size()
-			}
-
-			if fs+c.memSize > size {
-				done = true
-				break
+				if fits() {
+					break
+				}
 			}
 		}
-		i++
 	}
 
 	// if we couldn't free enough space and the force purge is set, delete random items
-	if len(tbd) == 0 && c.forcePurge {
+	if !fits() && c.forcePurge {
 		for k, co := range c.objs {
-			tbd = append(tbd, k)
-			fs = fs + co.Size()
-
-			if fs+c.memSize > size {
-				done = true
-				break
+			if !tbd[k] {
+				tbd[k] = true
+				fs = fs + co.Size()
+				if fits() {
+					break
+				}
 			}
 		}
 	}
 
-	c.purgeEntries(tbd)
-	if fs+c.memSize < size {
+	keys := make([]string, 0, len(tbd))
+	for k := range tbd {
+		keys = append(keys, k)
+	}
+	c.purgeEntries(keys)
+	if c.memSize+size > c.memLimit {
 		logrus.Debugf("unable to free enough memory (%d/%d)", fs, size)
 		return errFreeMemory
 	}
@@ -184,20 +189,26 @@ func (c *MemoryCache) freeMemory(size int) error {
 	return nil
 }
 
-// PurgeEntries deletes a batch of keys
+// purgeEntries deletes a batch of keys. It must be called with the lock held
 func (c *MemoryCache) purgeEntries(keys []string) {
-	c.objsMutex.Lock()
 	for _, k := range keys {
+		co, ok := c.objs[k]
+		if !ok {
+			continue
+		}
 		logrus.Debugf("purging %s", k)
+		c.memSize = c.memSize - co.Size()
 		delete(c.objs, k)
 	}
-	c.objsMutex.Unlock()
 }
 
-// Store inserts a new entry into the cache
+// Store inserts a new entry into the cache. The size is checked and updated with the lock held,
+// since objects like slices are stored concurrently
 func (c *MemoryCache) Store(key string, co *ContentObject) error {
 	start := time.Now()
-	defer storeDuration.WithLabelValues("memory").Observe(time.Since(start).Seconds())
+	defer func() {
+		storeDuration.WithLabelValues("memory").Observe(time.Since(start).Seconds())
+	}()
 
 	size := len(co.Content())
 
@@ -205,6 +216,12 @@ func (c *MemoryCache) Store(key string, co *ContentObject) error {
 		logrus.Debugf("item %s can't fit in memory", key)
 		return errNotEnoughMemory
 	}
+
+	c.objsMutex.Lock()
+	defer c.objsMutex.Unlock()
+
+	// the entry replaced doesn't take any space anymore
+	c.purgeEntries([]string{key})
 	newSize := c.memSize + size
 	if newSize > c.memLimit {
 		storeMetric.WithLabelValues("memory", "memory_limit").Inc()
@@ -224,10 +241,8 @@ func (c *MemoryCache) Store(key string, co *ContentObject) error {
 	}
 
 	mi := &MemoryItem{co: co, timestamp: now, ttl: ttl, expiration: now.Add(time.Duration(ttl) * time.Second), contentSize: size}
-	c.objsMutex.Lock()
 	c.objs[key] = mi
-	c.memSize = newSize
-	c.objsMutex.Unlock()
+	c.memSize = c.memSize + size
 
 	logrus.Debugf("successfully stored item for %s", key)
 	storeMetric.WithLabelValues("memory", "success").Inc()
@@ -237,18 +252,31 @@ func (c *MemoryCache) Store(key string, co *ContentObject) error {
 // Purge deletes an item from the cache
 func (c *MemoryCache) Purge(key string) error {
 	start := time.Now()
-	defer purgeDuration.WithLabelValues("memory").Observe(time.Since(start).Seconds())
+	defer func() {
+		purgeDuration.WithLabelValues("memory").Observe(time.Since(start).Seconds())
+	}()
 
 	c.objsMutex.Lock()
 	co, ok := c.objs[key]
+	if ok {
+		c.memSize = c.memSize - co.Size()
+		delete(c.objs, key)
+	}
+
+	// the variants of the object, like its slices, are purged with it
+	for k, co := range c.objs {
+		if strings.HasPrefix(k, key+variantSeparator) {
+			c.memSize = c.memSize - co.Size()
+			delete(c.objs, k)
+			ok = true
+		}
+	}
+	c.objsMutex.Unlock()
+
 	if !ok {
-		c.objsMutex.Unlock()
 		purgeMetric.WithLabelValues("memory", "miss").Inc()
 		return errNotFound
 	}
-	c.memSize = c.memSize - co.Size()
-	delete(c.objs, key)
-	c.objsMutex.Unlock()
 	logrus.Debugf("successfully purged item %s", key)
 	purgeMetric.WithLabelValues("memory", "success").Inc()
 	return nil
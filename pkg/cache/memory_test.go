@@ -2,6 +2,7 @@ package cache
 
 import (
 	"bytes"
+	"sync"
 	"testing"
 	"time"
 )
@@ -217,6 +218,48 @@ func TestPurge(t *testing.T) {
 	}
 }
 
+func TestPurgeVariants(t *testing.T) {
+	c, err := NewCache(DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	co := NewContentObject([]byte("0123"), "video/mp4", nil, 0, time.Now().Unix())
+	keys := []string{"www.example.com/video.mp4", SliceKey("www.example.com/video.mp4", "v1", 0), VersionKey("www.example.com/video.mp4", "canary"), "www.example.com/video.mp4.jpg"}
+	for _, k := range keys {
+		err = c.Store(k, co)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = c.Purge("www.example.com/video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		_, found, _ := c.Lookup(k)
+		if found != (i == 3) {
+			t.Errorf("unexpected presence of %s after purging the object: %t", k, found)
+		}
+	}
+
+	// an object cached only for another version of the origin can be purged too
+	err = c.Store(VersionKey("www.example.com/logo.png", "canary"), co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Purge("www.example.com/logo.png")
+	if err != nil {
+		t.Error("purging an object cached only for another version should succeed")
+	}
+	err = c.Purge("www.example.com/logo.png")
+	if err != errNotFound {
+		t.Error("purging an object which isn't cached should fail")
+	}
+}
+
 func TestPurgeEntries(t *testing.T) {
 	tt := []struct {
 		keys      []string
@@ -273,3 +316,33 @@ func TestPurgeEntries(t *testing.T) {
 	}
 
 }
+
+func TestConcurrentStore(t *testing.T) {
+	cc := DefaultConf()
+	cc.Options["memory_limit"] = "100"
+	c, err := NewMemoryCache(cc.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// slices of an object are stored at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := SliceKey("www.example.com/video.mp4", "v1", int64(i%8))
+			c.Store(key, NewContentObject([]byte("0123456789"), "video/mp4", nil, 0, time.Now().Unix()))
+			c.Lookup(key)
+		}(i)
+	}
+	wg.Wait()
+
+	size := 0
+	for _, mi := range c.objs {
+		size += mi.Size()
+	}
+	if size != c.memSize || c.memSize > c.memLimit {
+		t.Errorf("the memory used should match the items stored, %d bytes stored, %d/%d counted", size, c.memSize, c.memLimit)
+	}
+}
@@ -0,0 +1,151 @@
+package cdn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeOrderTimeout = 5 * time.Minute
+)
+
+// acmeSolver proves the control of a name by answering a challenge, with the key authorization for
+// HTTP-01 challenges or the certificate for TLS-ALPN-01 challenges
+type acmeSolver interface {
+	present(name, token, keyAuth string, cert *tls.Certificate) error
+	cleanup(name, token string)
+}
+
+// acmeClient is a client of an ACME (RFC 8555) server, like Let's Encrypt, registered with an account key
+type acmeClient struct {
+	client *acme.Client
+	email  string
+
+	// registration is done once, by the first certificate ordered
+	registerMu sync.Mutex
+	registered bool
+}
+
+// newACMEClient returns a client for the ACME server at directoryURL
+func newACMEClient(directoryURL, email string, key *ecdsa.PrivateKey, client *http.Client) *acmeClient {
+	return &acmeClient{
+		client: &acme.Client{Key: key, DirectoryURL: directoryURL, HTTPClient: client, UserAgent: "particles"},
+		email:  email,
+	}
+}
+
+// obtain orders a certificate for names, answering the challenges with the solver, and returns the
+// PEM encoded certificate chain
+func (c *acmeClient) obtain(names []string, challengeType string, solver acmeSolver, csr []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeOrderTimeout)
+	defer cancel()
+
+	err := c.register(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error registering ACME account: %s", err)
+	}
+
+	order, err := c.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ACME order: %s", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		err = c.authorize(ctx, authzURL, challengeType, solver)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = c.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for ACME order: %s", err)
+	}
+	chain, _, err := c.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("error finalizing ACME order: %s", err)
+	}
+
+	var b []byte
+	for _, der := range chain {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return b, nil
+}
+
+// authorize proves the control of the name of an authorization, unless it's valid already
+func (c *acmeClient) authorize(ctx context.Context, authzURL, challengeType string, solver acmeSolver) error {
+	authz, err := c.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var ch *acme.Challenge
+	for _, ac := range authz.Challenges {
+		if ac.Type == challengeType {
+			ch = ac
+		}
+	}
+	name := authz.Identifier.Value
+	if ch == nil {
+		return fmt.Errorf("the ACME server doesn't offer %s challenges for %s", challengeType, name)
+	}
+
+	var keyAuth string
+	var cert *tls.Certificate
+	if challengeType == acmeTLSALPN01 {
+		var alpnCert tls.Certificate
+		alpnCert, err = c.client.TLSALPN01ChallengeCert(ch.Token, name)
+		cert = &alpnCert
+	} else {
+		keyAuth, err = c.client.HTTP01ChallengeResponse(ch.Token)
+	}
+	if err != nil {
+		return err
+	}
+	err = solver.present(name, ch.Token, keyAuth, cert)
+	if err != nil {
+		return err
+	}
+	defer solver.cleanup(name, ch.Token)
+
+	_, err = c.client.Accept(ctx, ch)
+	if err != nil {
+		return fmt.Errorf("error answering challenge for %s: %s", name, err)
+	}
+	_, err = c.client.WaitAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("challenge for %s failed: %s", name, err)
+	}
+	return nil
+}
+
+// register creates the account, or finds the existing one for the key
+func (c *acmeClient) register(ctx context.Context) error {
+	c.registerMu.Lock()
+	defer c.registerMu.Unlock()
+	if c.registered {
+		return nil
+	}
+
+	account := &acme.Account{}
+	if c.email != "" {
+		account.Contact = []string{"mailto:" + c.email}
+	}
+	_, err := c.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	c.registered = true
+	return nil
+}
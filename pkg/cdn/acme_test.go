@@ -0,0 +1,316 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// idPeACMEIdentifier is the extension of TLS-ALPN-01 challenge certificates (RFC 8737)
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// fakeACMEIdentifier, fakeACMEChallenge and fakeACMEOrder are the resources of the fake ACME server
+type fakeACMEIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type fakeACMEChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+type fakeACMEOrder struct {
+	Status         string               `json:"status"`
+	Identifiers    []fakeACMEIdentifier `json:"identifiers"`
+	Authorizations []string             `json:"authorizations"`
+	Finalize       string               `json:"finalize"`
+	Certificate    string               `json:"certificate,omitempty"`
+}
+
+// fakeACMEServer is a minimal ACME server validating the challenges by calling the CDN directly
+type fakeACMEServer struct {
+	*httptest.Server
+	t      *testing.T
+	cdn    *CDN
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu      sync.Mutex
+	account *ecdsa.PublicKey
+	names   []string
+	valid   map[string]bool
+	csr     *x509.CertificateRequest
+	nonce   int
+}
+
+func newFakeACMEServer(t *testing.T) *fakeACMEServer {
+	s := &fakeACMEServer{t: t, valid: make(map[string]bool)}
+	s.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &s.caKey.PublicKey, s.caKey)
+	s.caCert, _ = x509.ParseCertificate(der)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *fakeACMEServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", s.nonce))
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{"newNonce": s.URL + "/nonce", "newAccount": s.URL + "/account", "newOrder": s.URL + "/order"})
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	payload, err := s.verify(r)
+	if err != nil {
+		s.t.Errorf("invalid ACME request to %s: %s", r.URL.Path, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case "order":
+		w.Header().Set("Location", s.URL+"/order/1")
+		if len(parts) == 1 {
+			o := fakeACMEOrder{}
+			json.Unmarshal(payload, &o)
+			s.names = nil
+			for _, id := range o.Identifiers {
+				s.names = append(s.names, id.Value)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(s.order())
+	case "authz":
+		name := parts[1]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     s.status(name),
+			"identifier": fakeACMEIdentifier{Type: "dns", Value: name},
+			"challenges": []fakeACMEChallenge{
+				{Type: acmeHTTP01, URL: s.URL + "/challenge/http-01/" + name, Token: "token-" + name, Status: s.status(name)},
+				{Type: acmeTLSALPN01, URL: s.URL + "/challenge/tls-alpn-01/" + name, Token: "token-" + name, Status: s.status(name)},
+			},
+		})
+	case "challenge":
+		name := parts[2]
+		s.valid[name] = s.validate(parts[1], name)
+		json.NewEncoder(w).Encode(fakeACMEChallenge{Type: parts[1], URL: s.URL + r.URL.Path, Token: "token-" + name, Status: s.status(name)})
+	case "finalize":
+		w.Header().Set("Location", s.URL+"/order/1")
+		req := map[string]string{}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req["csr"])
+		s.csr, err = x509.ParseCertificateRequest(der)
+		if err != nil {
+			s.t.Errorf("invalid CSR: %s", err)
+		}
+		json.NewEncoder(w).Encode(s.order())
+	case "certificate":
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: s.csr.DNSNames[0]},
+			DNSNames:     s.csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, s.csr.PublicKey, s.caKey)
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})
+	}
+}
+
+// status returns the status of the authorization of a name
+func (s *fakeACMEServer) status(name string) string {
+	valid, validated := s.valid[name]
+	if !validated {
+		return acme.StatusPending
+	}
+	if !valid {
+		return acme.StatusInvalid
+	}
+	return acme.StatusValid
+}
+
+// order returns the order of the names requested, ready once they're authorized and valid once finalized
+func (s *fakeACMEServer) order() fakeACMEOrder {
+	o := fakeACMEOrder{Status: acme.StatusReady, Finalize: s.URL + "/finalize/1"}
+	for _, n := range s.names {
+		o.Identifiers = append(o.Identifiers, fakeACMEIdentifier{Type: "dns", Value: n})
+		o.Authorizations = append(o.Authorizations, s.URL+"/authz/"+n)
+		if !s.valid[n] {
+			o.Status = acme.StatusPending
+		}
+	}
+	if s.csr != nil {
+		o.Status = acme.StatusValid
+		o.Certificate = s.URL + "/certificate/1"
+	}
+	return o
+}
+
+// verify checks the signature of a request and returns its payload
+func (s *fakeACMEServer) verify(r *http.Request) ([]byte, error) {
+	jws := map[string]string{}
+	err := json.NewDecoder(r.Body).Decode(&jws)
+	if err != nil {
+		return nil, err
+	}
+
+	ph, _ := base64.RawURLEncoding.DecodeString(jws["protected"])
+	protected := struct {
+		URL string            `json:"url"`
+		JWK map[string]string `json:"jwk"`
+		KID string            `json:"kid"`
+	}{}
+	err = json.Unmarshal(ph, &protected)
+	if err != nil {
+		return nil, err
+	}
+	if protected.URL != s.URL+r.URL.Path {
+		return nil, fmt.Errorf("unexpected url %s", protected.URL)
+	}
+
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		s.account = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if protected.KID != s.URL+"/account/1" || s.account == nil {
+		return nil, fmt.Errorf("unknown account %s", protected.KID)
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(jws["signature"])
+	h := sha256.Sum256([]byte(jws["protected"] + "." + jws["payload"]))
+	if len(sig) != 64 || !ecdsa.Verify(s.account, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return base64.RawURLEncoding.DecodeString(jws["payload"])
+}
+
+// validate checks the answer to a challenge, asking it to the CDN as the ACME server would do
+func (s *fakeACMEServer) validate(challenge, name string) bool {
+	thumbprint, err := acme.JWKThumbprint(s.account)
+	if err != nil {
+		return false
+	}
+	keyAuth := "token-" + name + "." + thumbprint
+
+	if challenge == acmeHTTP01 {
+		rr := httptest.NewRecorder()
+		s.cdn.httpHandler(rr, httptest.NewRequest("GET", "http://"+name+acmeChallengePath+"token-"+name, nil))
+		return rr.Code == http.StatusOK && rr.Body.String() == keyAuth
+	}
+
+	cert, err := s.cdn.acme.getCertificate(&tls.ClientHelloInfo{ServerName: name, SupportedProtos: []string{acmeTLSALPNProto}})
+	if err != nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	h := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && bytes.HasSuffix(ext.Value, h[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestACME(t *testing.T) {
+	for _, challenge := range validACMEChallenges {
+		s := newFakeACMEServer(t)
+		storage, err := ioutil.TempDir("", "particles-acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(storage)
+
+		c := DefaultConf()
+		c.HTTPS.Backends = []BackendConf{{
+			Name:    "example",
+			Domain:  "www.example.com",
+			Aliases: []string{"example.com"},
+			IP:      "127.0.0.1",
+			ACME:    ACMEConf{Directory: s.URL + "/directory", Challenge: challenge, Storage: storage},
+		}}
+		valid, reason := c.IsValid()
+		if !valid {
+			t.Fatal(reason)
+		}
+		s.cdn, err = NewCDN(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.cdn.httpEnabled != (challenge == acmeHTTP01) {
+			t.Errorf("%s: the HTTP listener should only be enabled for HTTP-01 challenges", challenge)
+		}
+
+		err = s.cdn.acme.obtain(s.cdn.acme.certs[0])
+		if err != nil {
+			t.Fatalf("%s: %s", challenge, err)
+		}
+
+		cert, err := s.cdn.acme.getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		if err != nil || cert == nil {
+			t.Fatalf("%s: no certificate for example.com: %v", challenge, err)
+		}
+		if strings.Join(cert.Leaf.DNSNames, ",") != "www.example.com,example.com" {
+			t.Errorf("%s: unexpected names %v", challenge, cert.Leaf.DNSNames)
+		}
+
+		// the certificate stored is served after a restart, without ordering a new one
+		am, err := newACMEManager(c.HTTPS.Backends)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if am.certs[0].renewIn() <= 0 {
+			t.Errorf("%s: the stored certificate should be loaded at startup", challenge)
+		}
+
+		s.Close()
+	}
+}
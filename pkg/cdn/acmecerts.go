@@ -0,0 +1,460 @@
+package cdn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeTLSALPNProto  = "acme-tls/1"
+	acmeHTTP01        = "http-01"
+	acmeTLSALPN01     = "tls-alpn-01"
+
+	defaultACMEStorage     = "/var/lib/particles/acme"
+	defaultACMERenewBefore = 30 // days
+	acmeCheckInterval      = 12 * time.Hour
+	acmeMinRetry           = time.Minute
+	acmeMaxRetry           = 6 * time.Hour
+	acmeRequestTimeout     = 30 * time.Second
+)
+
+var (
+	validACMEChallenges = []string{acmeHTTP01, acmeTLSALPN01}
+)
+
+// acmeCert is the certificate of a HTTPS backend obtained from an ACME server
+type acmeCert struct {
+	names       []string
+	challenge   string
+	certFile    string
+	keyFile     string
+	renewBefore time.Duration
+	client      *acmeClient
+	cert        atomic.Value // *tls.Certificate
+}
+
+// acmeManager obtains and renews the certificates of the HTTPS backends configured with ACME, and
+// answers the challenges of the ACME server on the HTTP and HTTPS listeners
+type acmeManager struct {
+	certs []*acmeCert
+	names map[string]*acmeCert
+	stop  chan struct{}
+
+	mu        sync.Mutex
+	tokens    map[string]string
+	alpnCerts map[string]*tls.Certificate
+}
+
+// newACMEManager returns the manager of the certificates of the backends using ACME, nil if there
+// are none. Certificates already on disk are loaded straight away
+func newACMEManager(backends []BackendConf) (*acmeManager, error) {
+	m := &acmeManager{
+		names:     make(map[string]*acmeCert),
+		stop:      make(chan struct{}),
+		tokens:    make(map[string]string),
+		alpnCerts: make(map[string]*tls.Certificate),
+	}
+	clients := make(map[string]*acmeClient)
+
+	for _, b := range backends {
+		ac := b.ACME
+		if ac.Directory == "" {
+			continue
+		}
+
+		storage := defaultACMEStorage
+		if ac.Storage != "" {
+			storage = ac.Storage
+		}
+		err := os.MkdirAll(storage, 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		// the account is shared by the backends using the same server and storage
+		ck := ac.Directory + "|" + storage
+		client, ok := clients[ck]
+		if !ok {
+			client, err = newStoredACMEClient(ac, storage)
+			if err != nil {
+				return nil, fmt.Errorf("ACME error for %s: %s", b.Domain, err)
+			}
+			clients[ck] = client
+		}
+
+		challenge := acmeHTTP01
+		if ac.Challenge != "" {
+			challenge = ac.Challenge
+		}
+		renewBefore := defaultACMERenewBefore
+		if ac.RenewBefore > 0 {
+			renewBefore = ac.RenewBefore
+		}
+
+		c := &acmeCert{
+			challenge:   challenge,
+			certFile:    filepath.Join(storage, normalizeHost(b.Domain)+".crt"),
+			keyFile:     filepath.Join(storage, normalizeHost(b.Domain)+".key"),
+			renewBefore: time.Duration(renewBefore) * 24 * time.Hour,
+			client:      client,
+		}
+		for _, n := range append([]string{b.Domain}, b.Aliases...) {
+			n = normalizeHost(n)
+			c.names = append(c.names, n)
+			m.names[n] = c
+		}
+
+		cert, err := loadCertificate(c.certFile, c.keyFile)
+		if err == nil {
+			c.cert.Store(cert)
+			certExpiryMetric.WithLabelValues(c.certFile).Set(float64(cert.Leaf.NotAfter.Unix()))
+		} else if !os.IsNotExist(err) {
+			logrus.Warnf("ignoring stored certificate of %s: %s", b.Domain, err)
+		}
+		m.certs = append(m.certs, c)
+	}
+
+	if len(m.certs) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// newStoredACMEClient returns a client using the account key in the storage, which is created if missing
+func newStoredACMEClient(ac ACMEConf, storage string) (*acmeClient, error) {
+	keyFile := filepath.Join(storage, "account.key")
+	b, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, err = encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = writeFileAtomic(keyFile, b, 0600)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("invalid account key %s", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account key %s: %s", keyFile, err)
+	}
+
+	tlsCfg := &tls.Config{}
+	if ac.CAFile != "" {
+		ca, err := ioutil.ReadFile(ac.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", ac.CAFile)
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   acmeRequestTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsCfg},
+	}
+	return newACMEClient(ac.Directory, ac.Email, key, client), nil
+}
+
+// start obtains the missing certificates and renews them before they expire, until stopped
+func (m *acmeManager) start() {
+	if m == nil {
+		return
+	}
+	for _, c := range m.certs {
+		go m.maintain(c)
+	}
+}
+
+// shutdown stops renewing the certificates
+func (m *acmeManager) shutdown() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+}
+
+// maintain obtains a certificate when it's missing or about to expire, retrying with an exponential
+// backoff on errors
+func (m *acmeManager) maintain(c *acmeCert) {
+	retry := acmeMinRetry
+	for {
+		wait := c.renewIn()
+		if wait <= 0 {
+			err := m.obtain(c)
+			if err != nil {
+				logrus.Errorf("error obtaining certificate for %s: %s", c.names[0], err)
+				acmeCertificatesMetric.WithLabelValues(c.names[0], "error").Inc()
+				wait = retry
+				retry *= 2
+				if retry > acmeMaxRetry {
+					retry = acmeMaxRetry
+				}
+			} else {
+				acmeCertificatesMetric.WithLabelValues(c.names[0], "obtained").Inc()
+				retry = acmeMinRetry
+				continue
+			}
+		}
+		if wait > acmeCheckInterval {
+			wait = acmeCheckInterval
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewIn returns how long until the certificate should be renewed
+func (c *acmeCert) renewIn() time.Duration {
+	cert, _ := c.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return 0
+	}
+	return time.Until(cert.Leaf.NotAfter.Add(-c.renewBefore))
+}
+
+// obtain orders a new certificate, stores it on disk and starts serving it
+func (m *acmeManager) obtain(c *acmeCert) error {
+	logrus.Infof("obtaining certificate for %s via ACME", strings.Join(c.names, ", "))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: c.names[0]},
+		DNSNames: c.names,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	chain, err := c.client.obtain(c.names, c.challenge, m, csr)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate received: %s", err)
+	}
+
+	err = writeFileAtomic(c.keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(c.certFile, chain, 0644)
+	if err != nil {
+		return err
+	}
+
+	c.cert.Store(&cert)
+	certExpiryMetric.WithLabelValues(c.certFile).Set(float64(cert.Leaf.NotAfter.Unix()))
+	logrus.Infof("obtained certificate for %s, valid until %s", strings.Join(c.names, ", "), cert.Leaf.NotAfter)
+	return nil
+}
+
+// present answers the challenge of a name, on the HTTP listener with the key authorization
+// (HTTP-01) or on the HTTPS listener with the certificate (TLS-ALPN-01)
+func (m *acmeManager) present(name, token, keyAuth string, cert *tls.Certificate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if keyAuth != "" {
+		m.tokens[token] = keyAuth
+	}
+	if cert != nil {
+		m.alpnCerts[name] = cert
+	}
+	return nil
+}
+
+// cleanup removes the answer to a challenge once it has been validated
+func (m *acmeManager) cleanup(name, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, token)
+	delete(m.alpnCerts, name)
+}
+
+// serveChallenge answers the HTTP-01 challenges, returning false for any other request
+func (m *acmeManager) serveChallenge(w http.ResponseWriter, req *http.Request) bool {
+	if m == nil || req.TLS != nil || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return false
+	}
+
+	m.mu.Lock()
+	keyAuth, ok := m.tokens[strings.TrimPrefix(req.URL.Path, acmeChallengePath)]
+	m.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+	return true
+}
+
+// getCertificate returns the certificate obtained for the name requested, or the challenge
+// certificate when the ACME server is validating a TLS-ALPN-01 challenge. It returns nil for names
+// which aren't managed, so that the certificates configured are used
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m == nil {
+		return nil, nil
+	}
+	name := normalizeHost(hello.ServerName)
+
+	for _, p := range hello.SupportedProtos {
+		if p == acmeTLSALPNProto {
+			m.mu.Lock()
+			cert, ok := m.alpnCerts[name]
+			m.mu.Unlock()
+			if !ok {
+				return nil, fmt.Errorf("no ACME challenge pending for %s", name)
+			}
+			return cert, nil
+		}
+	}
+
+	c, ok := m.names[name]
+	if !ok {
+		return nil, nil
+	}
+	cert, _ := c.cert.Load().(*tls.Certificate)
+	return cert, nil
+}
+
+// entries returns the certificates obtained
+func (m *acmeManager) entries() []*certEntry {
+	if m == nil {
+		return nil
+	}
+	var entries []*certEntry
+	for _, c := range m.certs {
+		if cert, _ := c.cert.Load().(*tls.Certificate); cert != nil {
+			entries = append(entries, &certEntry{name: c.names[0], source: certSourceACME, file: c.certFile, cert: cert})
+		}
+	}
+	return entries
+}
+
+// entry returns the certificate obtained for a domain, nil if the domain doesn't use ACME
+func (m *acmeManager) entry(domain string) *certEntry {
+	if m == nil {
+		return nil
+	}
+	c, ok := m.names[normalizeHost(domain)]
+	if !ok {
+		return nil
+	}
+	cert, _ := c.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil
+	}
+	return &certEntry{name: c.names[0], source: certSourceACME, file: c.certFile, cert: cert}
+}
+
+// manages checks whether the certificate of a domain is obtained via ACME
+func (m *acmeManager) manages(domain string) bool {
+	if m == nil {
+		return false
+	}
+	_, ok := m.names[normalizeHost(domain)]
+	return ok
+}
+
+// usesHTTP checks whether any certificate is validated on the HTTP listener
+func (m *acmeManager) usesHTTP() bool {
+	if m == nil {
+		return false
+	}
+	for _, c := range m.certs {
+		if c.challenge == acmeHTTP01 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCertificate loads a certificate and its key, parsing the leaf certificate
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// encodeKey returns an ECDSA private key PEM encoded
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFileAtomic writes a file via a temporary file, so that it's never left half written
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,123 @@
+package cdn
+
+import (
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+)
+
+const (
+	// mainVersion is the version label of the requests sent to the backend origin
+	mainVersion = "main"
+)
+
+var (
+	canaryVersionRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// canary is another version of the origin of a backend, receiving a share of the clients. The weight
+// can be changed at runtime and is shared by every copy of the endpoint
+type canary struct {
+	domain       string
+	version      string
+	header       string
+	cookie       string
+	stickyCookie string
+	weight       *int64
+	endpoint     endpoint
+}
+
+// newCanary returns the canary of a backend, nil if there's none
+func newCanary(bc BackendConf, proto string, defaultPort int) (*canary, error) {
+	cc := bc.Canary
+	if cc.Version == "" {
+		return nil, nil
+	}
+
+	e, err := newEndpoint(cc.backendConf(bc), proto, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+	e.Version = cc.Version
+
+	c := &canary{
+		domain:       bc.Domain,
+		version:      cc.Version,
+		header:       cc.Header,
+		cookie:       cc.Cookie,
+		stickyCookie: cc.StickyCookie,
+		weight:       new(int64),
+		endpoint:     e,
+	}
+	c.setWeight(cc.Weight)
+	return c, nil
+}
+
+// choose returns the canary endpoint if the request should be sent to it. Clients asking for a
+// version via the header or the cookie get it, the others are assigned according to the weight.
+// Assignments are sticky: the same client is always sent to the same origin, and increasing the
+// weight only moves clients from the origin to the canary
+func (c *canary) choose(req *http.Request, vars *headerVars) (endpoint, bool) {
+	if c == nil {
+		return endpoint{}, false
+	}
+
+	toCanary := c.assign(req, vars)
+	version := mainVersion
+	if toCanary {
+		version = c.version
+	}
+	canaryRequestsMetric.WithLabelValues(c.domain, version).Inc()
+	return c.endpoint, toCanary
+}
+
+// assign decides whether a request goes to the canary
+func (c *canary) assign(req *http.Request, vars *headerVars) bool {
+	if c.header != "" {
+		if v := req.Header.Get(c.header); v != "" {
+			return v == c.version
+		}
+	}
+
+	if c.cookie != "" {
+		if ck, err := req.Cookie(c.cookie); err == nil && ck.Value != "" {
+			return ck.Value == c.version
+		}
+	}
+
+	id := vars.clientIP
+	if c.stickyCookie != "" {
+		if ck, err := req.Cookie(c.stickyCookie); err == nil && ck.Value != "" {
+			id = ck.Value
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int64(h.Sum32()%100) < atomic.LoadInt64(c.weight)
+}
+
+// setWeight changes the percentage of the clients sent to the canary
+func (c *canary) setWeight(weight int) {
+	atomic.StoreInt64(c.weight, int64(weight))
+	canaryWeightMetric.WithLabelValues(c.domain, c.version).Set(float64(weight))
+}
+
+// backendConf returns the configuration of the backend with the origin replaced by the canary
+func (cc CanaryConf) backendConf(bc BackendConf) BackendConf {
+	bc.Routes = nil
+	bc.Canary = CanaryConf{}
+	// only the traffic of the origin is mirrored
+	bc.Mirror = MirrorConf{}
+	bc.IP = cc.IP
+	bc.Hostname = cc.Hostname
+	bc.Origin = cc.Origin
+	if cc.Port > 0 {
+		bc.Port = cc.Port
+	}
+	if cc.OriginHost != "" {
+		bc.OriginHost = cc.OriginHost
+	}
+	return bc
+}
@@ -0,0 +1,106 @@
+package cdn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCanary(t *testing.T) {
+	newOrigin := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte(body))
+		}))
+	}
+	origin := newOrigin("main")
+	defer origin.Close()
+	canaryOrigin := newOrigin("canary")
+	defer canaryOrigin.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:   "example",
+		Domain: "www.example.com",
+		IP:     "127.0.0.1",
+		Port:   listenerPort(t, origin),
+		Canary: CanaryConf{Version: "v2", IP: "127.0.0.1", Port: listenerPort(t, canaryOrigin), Header: "X-Version"},
+		Routes: []RouteConf{{Name: "static", Match: "prefix", Path: "/static/"}},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, version, clientIP string) string {
+		req := httptest.NewRequest("GET", "http://www.example.com"+path, nil)
+		req.RemoteAddr = clientIP + ":1234"
+		if version != "" {
+			req.Header.Set("X-Version", version)
+		}
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		// responses are stored asynchronously
+		time.Sleep(50 * time.Millisecond)
+		return rr.Body.String()
+	}
+
+	tt := []struct {
+		path     string
+		version  string
+		weight   int
+		expected string
+		errMsg   string
+	}{
+		{"/logo.png", "v2", 0, "canary", "clients asking for the canary version should get it"},
+		{"/logo.png", "", 0, "main", "the response of the canary shouldn't be served to other clients"},
+		{"/logo.png", "v1", 100, "main", "clients asking for another version should get the origin"},
+		{"/banner.png", "", 100, "canary", "every client should get the canary with a weight of 100"},
+		{"/static/app.png", "v2", 100, "main", "requests matching a route shouldn't be sent to the canary"},
+	}
+
+	for _, tc := range tt {
+		err := cdn.SetCanaryWeight("www.example.com", tc.weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := get(tc.path, tc.version, "10.0.0.1")
+		if body != tc.expected {
+			t.Errorf("%s: received %s", tc.errMsg, body)
+		}
+	}
+
+	if w := cdn.CanaryWeights()["www.example.com"]; w != 100 {
+		t.Errorf("expected a weight of 100, received %d", w)
+	}
+
+	if cdn.SetCanaryWeight("www.other.com", 10) == nil {
+		t.Error("changing the weight of a domain without a canary should fail")
+	}
+}
+
+func TestCanaryStickiness(t *testing.T) {
+	c := &canary{version: "v2", weight: new(int64)}
+	vars := &headerVars{clientIP: "10.0.0.1"}
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+
+	// once a client is sent to the canary it stays there as the weight increases
+	assigned := false
+	for w := 0; w <= 100; w += 10 {
+		c.setWeight(w)
+		toCanary := c.assign(req, vars)
+		if assigned && !toCanary {
+			t.Fatalf("the client was moved back to the origin with a weight of %d", w)
+		}
+		if toCanary != c.assign(req, vars) {
+			t.Fatal("the same client should always be sent to the same origin")
+		}
+		assigned = toCanary
+	}
+	if !assigned {
+		t.Error("every client should be sent to the canary with a weight of 100")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/amartorelli/particles/pkg/api"
@@ -37,16 +40,43 @@ type CDN struct {
 	httpsServer  *http.Server
 	httpsEnabled bool
 	httpMux      *http.ServeMux
-	endpoints    map[string]endpoint
-	httpClient   *http.Client
+	endpoints    atomic.Value // *hostTables, replaced on reload
+	acme         *acmeManager
+	certs        *certStore
+	ocsp         *ocspStapler
+	tickets      *ticketRotator
+	listeners    []*listener
 }
 
 // endpoint is a structure to represent an endpoint handled by the Particles
 type endpoint struct {
+	Domain               string
 	IP                   string
 	Port                 int
 	Proto                string
 	IfModifiedValidation int
+	Retry                *retryPolicy
+	OriginHost           string
+	Route                string
+	NoCache              bool
+	TTL                  int
+	SliceSize            int
+	Version              string
+	pinned               bool
+	client               *http.Client
+	dns                  *dnsOrigin
+	socket               string
+	files                *fileTransport
+	s3                   *s3Bucket
+	pathRewrite          *pathRewriter
+	rules                *edgeRules
+	upgrade              *upgradeTunnel
+	mirror               *mirror
+	canary               *canary
+	clientAuth           *clientAuth
+	requestHeaders       headerRules
+	responseHeaders      headerRules
+	routes               []route
 }
 
 // NewCDN returns a new CDN object
@@ -66,154 +96,459 @@ func NewCDN(conf Conf) (*CDN, error) {
 	mux := http.NewServeMux()
 
 	// HTTP
-	lHTTPAddr := fmt.Sprintf("%s:%d", conf.HTTP.Address, conf.HTTP.Port)
+	httpListeners, err := newListeners(conf.HTTP, "http")
+	if err != nil {
+		return nil, err
+	}
 	s := &http.Server{
-		Addr:           lHTTPAddr,
 		Handler:        mux,
+		ConnContext:    withListener,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		Protocols:      serverProtocols(conf.HTTP.HTTP2, false),
+		HTTP2:          newHTTP2Config(conf.HTTP.HTTP2),
 	}
 
 	// HTTPS
-	cfg := &tls.Config{}
-	for _, b := range conf.HTTPS.Backends {
-		cert, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("certificate error for %s (%s)", b.Name, b.Domain)
+	am, err := newACMEManager(conf.HTTPS.Backends)
+	if err != nil {
+		return nil, err
+	}
+
+	cs, err := newCertStore(conf.HTTPS)
+	if err != nil {
+		return nil, err
+	}
+
+	ocsp := newOCSPStapler(conf.HTTPS.TLS, func() []*certEntry { return append(am.entries(), cs.certificates()...) })
+
+	cfg, err := newServerTLSConfig(conf.HTTPS.TLS)
+	if err != nil {
+		return nil, err
+	}
+	var cdn *CDN
+	// certificates obtained via ACME take precedence over the configured ones
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := am.getCertificate(hello)
+		if cert == nil && err == nil {
+			cert, err = cs.getCertificate(hello)
 		}
-		cfg.Certificates = append(cfg.Certificates, cert)
+		return ocsp.staple(cert), err
+	}
+	cfg.NextProtos = nextProtos(conf.HTTPS.HTTP2)
+	// the certificates of the clients are asked depending on the backend requested via SNI
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return cdn.getConfigForClient(hello)
+	}
+	if am != nil {
+		cfg.NextProtos = append(cfg.NextProtos, acmeTLSALPNProto)
 	}
-	cfg.BuildNameToCertificate()
 
-	lHTTPSAddr := fmt.Sprintf("%s:%d", conf.HTTPS.Address, conf.HTTPS.Port)
+	httpsListeners, err := newListeners(conf.HTTPS, "https")
+	if err != nil {
+		return nil, err
+	}
 	ss := &http.Server{
-		Addr:           lHTTPSAddr,
 		Handler:        mux,
+		ConnContext:    withListener,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 		TLSConfig:      cfg,
+		Protocols:      serverProtocols(conf.HTTPS.HTTP2, true),
+		HTTP2:          newHTTP2Config(conf.HTTPS.HTTP2),
 	}
 
 	// populate endpoints
-	eps := make(map[string]endpoint, 0)
+	eps, err := newEndpoints(conf)
+	if err != nil {
+		return nil, err
+	}
 
-	var ifModVal int
-	for _, e := range conf.HTTP.Backends {
-		port := conf.HTTP.Port
-		if e.Port > 0 {
-			port = e.Port
-		}
+	cdn = &CDN{
+		api:          a,
+		cache:        c,
+		httpServer:   s,
+		httpEnabled:  len(conf.HTTP.Backends) > 0 || am.usesHTTP(),
+		httpsServer:  ss,
+		httpsEnabled: len(conf.HTTPS.Backends) > 0,
+		httpMux:      mux,
+		acme:         am,
+		certs:        cs,
+		ocsp:         ocsp,
+		tickets:      newTicketRotator(cfg, conf.HTTPS.TLS),
+		listeners:    append(httpListeners, httpsListeners...),
+	}
+	cdn.endpoints.Store(eps)
+	a.SetCanaries(cdn)
+	a.SetCertificates(cdn)
+	return cdn, nil
+}
 
-		if e.IfModifiedValidation != 0 {
-			ifModVal = e.IfModifiedValidation
-		} else {
-			ifModVal = defaultIfModifiedValidation
-		}
+// Reload replaces the backends with the ones in the configuration, which should have been validated.
+// Requests in flight complete with the previous backends. Listeners, certificates, cache and API
+// settings aren't reloaded
+func (c *CDN) Reload(conf Conf) error {
+	eps, err := newEndpoints(conf)
+	if err != nil {
+		return err
+	}
+
+	old := c.hosts()
+	c.endpoints.Store(eps)
+	// the clients of the previous backends aren't used anymore, their connections would stay open
+	old.closeIdleConnections()
+	logrus.Infof("backends reloaded")
+	return nil
+}
+
+// hosts returns the current host tables
+func (c *CDN) hosts() *hostTables {
+	return c.endpoints.Load().(*hostTables)
+}
 
-		eps[e.Domain] = endpoint{IP: e.IP, Port: port, Proto: "http", IfModifiedValidation: ifModVal}
+// requestListener returns the listener which accepted the connection of a request. Requests which
+// weren't received by a listener, like in tests, use the first listener of their protocol
+func (c *CDN) requestListener(req *http.Request) *listener {
+	if l, ok := req.Context().Value(listenerContextKey{}).(*listener); ok {
+		return l
 	}
-	for _, e := range conf.HTTPS.Backends {
-		port := conf.HTTPS.Port
-		if e.Port > 0 {
-			port = e.Port
-		}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	return c.defaultListener(proto)
+}
 
-		if e.IfModifiedValidation != 0 {
-			ifModVal = e.IfModifiedValidation
-		} else {
-			ifModVal = defaultIfModifiedValidation
+// defaultListener returns the first listener of a protocol
+func (c *CDN) defaultListener(proto string) *listener {
+	for _, l := range c.listeners {
+		if l.proto == proto {
+			return l
 		}
+	}
+	return nil
+}
 
-		eps[e.Domain] = endpoint{IP: e.IP, Port: port, Proto: "https", IfModifiedValidation: ifModVal}
+// CanaryWeights returns the percentage of clients sent to the canary origin of each domain
+func (c *CDN) CanaryWeights() map[string]int {
+	weights := make(map[string]int)
+	for d, cs := range c.hosts().canaries {
+		weights[d] = int(atomic.LoadInt64(cs[0].weight))
 	}
+	return weights
+}
 
-	return &CDN{
-		api:          a,
-		cache:        c,
-		httpServer:   s,
-		httpEnabled:  len(conf.HTTP.Backends) > 0,
-		httpsServer:  ss,
-		httpsEnabled: len(conf.HTTPS.Backends) > 0,
-		httpMux:      mux,
-		endpoints:    eps,
-		httpClient:   &http.Client{Timeout: 10 * time.Second},
-	}, nil
+// SetCanaryWeight changes the percentage of clients sent to the canary origin of a domain, until the
+// configuration is reloaded
+func (c *CDN) SetCanaryWeight(domain string, weight int) error {
+	cs, ok := c.hosts().canaries[normalizeHost(domain)]
+	if !ok {
+		return fmt.Errorf("no canary configured for %s", domain)
+	}
+
+	for _, ca := range cs {
+		ca.setWeight(weight)
+	}
+	return nil
 }
 
-// Start starts the CDN by starting the HTTP/HTTPS endpoint and API. It returns a channel which can be
-// used to understand when an error occurs in one of the handlers
-func (c *CDN) Start() <-chan struct{} {
-	exit := make(chan struct{})
-	// The server where the CDN runs should know what the real IP address for a website is
-	// For now we override it forcibly
-	dialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 10 * time.Second,
-		DualStack: true,
-	}
-	http.DefaultTransport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		// the address always includes the port, so we split
-		host, port, err := net.SplitHostPort(addr)
+// Certificates returns the certificates served, the ones obtained via ACME first
+func (c *CDN) Certificates() []api.Certificate {
+	certs := []api.Certificate{}
+	for _, e := range append(c.acme.entries(), c.certs.certificates()...) {
+		certs = append(certs, certificateInfo(e))
+	}
+	return certs
+}
+
+// Certificate returns the certificate served for a domain
+func (c *CDN) Certificate(domain string) (api.Certificate, error) {
+	e := c.acme.entry(domain)
+	if e == nil {
+		e = c.certs.certificate(domain)
+	}
+	if e == nil {
+		return api.Certificate{}, api.ErrCertificateNotFound
+	}
+	return certificateInfo(e), nil
+}
+
+// AddCertificate validates a certificate for a domain served by a HTTPS backend, stores it in the
+// certificates directory and starts serving it
+func (c *CDN) AddCertificate(domain string, certPEM, keyPEM []byte) (api.Certificate, error) {
+	domain = normalizeHost(domain)
+	if !isValidDomain(domain) {
+		return api.Certificate{}, api.CertificateError{Reason: fmt.Sprintf("invalid domain %s", domain)}
+	}
+	if _, ok := c.hosts().match("https", domain); !ok {
+		return api.Certificate{}, api.CertificateError{Reason: fmt.Sprintf("%s isn't served by any HTTPS backend", domain)}
+	}
+	if c.acme.manages(domain) {
+		return api.Certificate{}, api.CertificateError{Reason: fmt.Sprintf("the certificate of %s is obtained via ACME", domain)}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return api.Certificate{}, api.CertificateError{Reason: fmt.Sprintf("invalid certificate or key: %s", err)}
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return api.Certificate{}, api.CertificateError{Reason: fmt.Sprintf("invalid certificate: %s", err)}
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return api.Certificate{}, api.CertificateError{Reason: "the certificate is expired or not valid yet"}
+	}
+	err = leaf.VerifyHostname(domain)
+	if err != nil {
+		return api.Certificate{}, api.CertificateError{Reason: err.Error()}
+	}
+	cert.Leaf = leaf
+
+	err = c.certs.add(domain, certPEM, keyPEM)
+	if err == errNoCertDir {
+		return api.Certificate{}, api.CertificateError{Reason: err.Error()}
+	}
+	if err != nil {
+		return api.Certificate{}, err
+	}
+	return certificateInfo(&certEntry{name: domain, source: certSourceDir, cert: &cert}), nil
+}
+
+// DeleteCertificate removes the certificate uploaded for a domain
+func (c *CDN) DeleteCertificate(domain string) error {
+	domain = normalizeHost(domain)
+	if !isValidDomain(domain) {
+		return api.ErrCertificateNotFound
+	}
+
+	err := c.certs.remove(domain)
+	if err == errNoCertDir {
+		return api.CertificateError{Reason: err.Error()}
+	}
+	return err
+}
+
+// certificateInfo describes a certificate for the API
+func certificateInfo(e *certEntry) api.Certificate {
+	leaf := e.cert.Leaf
+	return api.Certificate{
+		Name:      e.name,
+		Source:    e.source,
+		Subject:   leaf.Subject.String(),
+		SANs:      leaf.DNSNames,
+		Issuer:    leaf.Issuer.String(),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+}
+
+// newEndpoints builds the host tables of the listeners with the backends of both the HTTP and HTTPS
+// servers
+func newEndpoints(conf Conf) (*hostTables, error) {
+	eps := newHostTables()
+	err := addEndpoints(eps, conf.HTTP, "http")
+	if err != nil {
+		return nil, err
+	}
+	err = addEndpoints(eps, conf.HTTPS, "https")
+	if err != nil {
+		return nil, err
+	}
+	return eps, nil
+}
+
+// addEndpoints registers the backends of a server, with their aliases, in the host tables of their
+// listeners
+func addEndpoints(hts *hostTables, hc HTTPConf, proto string) error {
+	for _, name := range listenerNames(hc) {
+		hts.table(proto, name)
+	}
+
+	for _, b := range hc.Backends {
+		e, err := newEndpoint(b, proto, hc.Port)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("origin error for %s (%s): %s", b.Name, b.Domain, err)
 		}
 
-		// check we manage that endpoint
-		e, ok := c.endpoints[host]
-		if !ok {
-			return nil, fmt.Errorf("unhandled endpoint")
+		for _, name := range backendListeners(hc, b) {
+			ht := hts.table(proto, name)
+			ht.add(b.Domain, e)
+			for _, a := range b.Aliases {
+				ht.add(a, e)
+			}
+			if b.Default {
+				ht.setDefault(e)
+			}
 		}
+		if e.canary != nil {
+			hts.addCanary(b.Domain, e.canary)
+		}
+	}
+	return nil
+}
+
+// newEndpoint builds the endpoint for a backend, using the default port of the server it's attached to
+// when the backend doesn't override it
+func newEndpoint(bc BackendConf, proto string, defaultPort int) (endpoint, error) {
+	port := defaultPort
+	if bc.Port > 0 {
+		port = bc.Port
+	}
+
+	ifModVal := defaultIfModifiedValidation
+	if bc.IfModifiedValidation != 0 {
+		ifModVal = bc.IfModifiedValidation
+	}
+
+	tlsCfg, err := newOriginTLSConfig(bc.OriginTLS)
+	if err != nil {
+		return endpoint{}, err
+	}
 
-		// override IP and/or port if defined
-		if e.IP != "" {
-			host = e.IP
+	pr, err := newPathRewriter(bc.PathRewrite)
+	if err != nil {
+		return endpoint{}, err
+	}
+
+	e := endpoint{Domain: bc.Domain, IP: bc.IP, Port: port, Proto: proto, IfModifiedValidation: ifModVal, Retry: newRetryPolicy(bc.Retry), OriginHost: bc.OriginHost, Route: defaultRouteName, SliceSize: bc.SliceSize, pinned: len(bc.Listeners) > 0, pathRewrite: pr}
+	e.rules, err = newEdgeRules(bc)
+	if err != nil {
+		return endpoint{}, err
+	}
+	e.upgrade = newUpgradeTunnel(bc.Domain, bc.Upgrade)
+	e.clientAuth, err = newClientAuth(bc)
+	if err != nil {
+		return endpoint{}, err
+	}
+	e.requestHeaders = newHeaderRules(bc.RequestHeaders)
+	e.responseHeaders = newHeaderRules(bc.ResponseHeaders)
+	// HSTS comes first, so that the response header rules can override it
+	if hsts := hstsHeader(bc.HSTS); hsts != "" && proto == "https" {
+		e.responseHeaders = append(headerRules{{action: headerSet, name: "Strict-Transport-Security", value: hsts}}, e.responseHeaders...)
+	}
+	if bc.Hostname != "" {
+		e.dns = newDNSOrigin(bc.Domain, bc.Hostname, port, bc.DNS, newDNSResolver(bc.DNS.Nameserver))
+	}
+	if bc.Origin != "" {
+		kind, p, err := parseOrigin(bc.Origin)
+		if err != nil {
+			return endpoint{}, err
 		}
-		if e.Port > 0 {
-			port = strconv.Itoa(e.Port)
+		switch kind {
+		case unixOrigin:
+			e.socket = p
+		case fileOrigin:
+			e.files, err = newFileTransport(p, bc.FileOrigin)
+			if err != nil {
+				return endpoint{}, err
+			}
+		case s3Origin:
+			e.s3, err = newS3Bucket(p, bc.S3)
+			if err != nil {
+				return endpoint{}, err
+			}
 		}
+	}
+	e.client = newClient(e, bc.Transport, tlsCfg)
+	e.mirror, err = newMirror(bc.Domain, bc.Mirror, tlsCfg)
+	if err != nil {
+		return endpoint{}, err
+	}
 
-		addr = fmt.Sprintf("%s:%s", host, port)
-		return dialer.DialContext(ctx, network, addr)
+	e.routes, err = newRoutes(bc, proto, defaultPort)
+	if err != nil {
+		return endpoint{}, err
+	}
+	// the routes share the queue of the backend
+	for i := range e.routes {
+		e.routes[i].endpoint.mirror = e.mirror
 	}
 
+	e.canary, err = newCanary(bc, proto, defaultPort)
+	if err != nil {
+		return endpoint{}, fmt.Errorf("canary error: %s", err)
+	}
+	return e, nil
+}
+
+// Start starts the CDN by starting the HTTP/HTTPS endpoint and API. The listeners are open when it
+// returns, or an error is returned if one can't be opened. It returns a channel which can be used to
+// understand when an error occurs in one of the handlers
+func (c *CDN) Start() (<-chan struct{}, error) {
+	exit := make(chan struct{})
+	// any server or listener exiting stops the CDN
+	var exitOnce sync.Once
+	stop := func() { exitOnce.Do(func() { close(exit) }) }
 	c.httpMux.Handle("/", util.HandlerWithLogging(c.httpHandler))
 
-	// API server
+	// API server, the sockets are opened before returning so that the CDN is ready
+	err := c.api.Listen()
+	if err != nil {
+		return nil, fmt.Errorf("API server: %s", err)
+	}
 	go func() {
 		err := c.api.Start()
 		if err != nil {
 			logrus.Errorf("API server exited: %s", err)
-			close(exit)
+			stop()
 		}
 	}()
 
 	// HTTP server
 	if c.httpEnabled {
-		go func() {
-			logrus.Infof("Starting listerner on %s (HTTP)", c.httpServer.Addr)
-			err := c.httpServer.ListenAndServe()
-			if err != nil {
-				logrus.Errorf("HTTP server exited: %s", err)
-				close(exit)
-			}
-		}()
+		err = c.serve(c.httpServer, "http", stop)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	// certificates are obtained once the listeners are ready to answer the challenges
+	c.acme.start()
+
 	// HTTPS server
 	if c.httpsEnabled {
-		go func() {
-			logrus.Infof("Starting listerner on %s (HTTPS)", c.httpsServer.Addr)
-			err := c.httpsServer.ListenAndServeTLS("", "")
+		go c.certs.watch()
+		c.ocsp.start()
+		c.tickets.start()
+		err = c.serve(c.httpsServer, "https", stop)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return exit, nil
+}
+
+// serve opens the listeners of a protocol and serves them with the server of the protocol
+func (c *CDN) serve(s *http.Server, proto string, stop func()) error {
+	for _, l := range c.listeners {
+		if l.proto != proto {
+			continue
+		}
+
+		logrus.Infof("Starting listerner %s on %s (%s)", l.name, l.addr, strings.ToUpper(proto))
+		ln, err := l.listen()
+		if err != nil {
+			return fmt.Errorf("%s listener %s: %s", strings.ToUpper(proto), l.name, err)
+		}
+
+		go func(l *listener) {
+			var err error
+			if proto == "https" {
+				err = s.ServeTLS(ln, "", "")
+			} else {
+				err = s.Serve(ln)
+			}
 			if err != nil {
-				logrus.Errorf("HTTPS server exited: %s", err)
-				close(exit)
+				logrus.Errorf("%s listener %s exited: %s", strings.ToUpper(proto), l.name, err)
+				stop()
 			}
-		}()
+		}(l)
 	}
-
-	return exit
+	return nil
 }
 
 // Shutdown terminates the CDN in a clean way
@@ -221,6 +556,11 @@ func (c *CDN) Shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	c.acme.shutdown()
+	c.certs.shutdown()
+	c.ocsp.shutdown()
+	c.tickets.shutdown()
+
 	err := c.httpServer.Shutdown(ctx)
 	if err != nil {
 		return err
@@ -304,20 +644,31 @@ func cleanHeadersMap(hh map[string]string) map[string]string {
 }
 
 // validate implements the validation by sending a request with the If-Modified-Since header
-func (c *CDN) validate(req *http.Request) (validated bool, resp *http.Response, err error) {
+func (c *CDN) validate(domain string, e endpoint, req *http.Request) (validated bool, resp *http.Response, err error) {
 	// execute the request to the backend
-	resp, err = c.httpClient.Do(req)
+	resp, err = doRequest(e.client, domain, e.Retry, req)
 	if err != nil {
 		return false, nil, err
 	}
 
 	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
 		return false, nil, nil
 	}
 
 	return true, resp, nil
 }
 
+// cacheKey returns the key of the object requested, its public URL. The host is always part of
+// it, since wildcard, alias and default backends serve several hosts
+func cacheKey(req *http.Request, host string) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + normalizeHost(host) + req.URL.RequestURI()
+}
+
 // shouldValidate checks if the content has changed since we cached it
 func shouldValidate(c *cache.ContentObject, d time.Duration) bool {
 	// always validate if the cached timestamp isn't specified for any reason
@@ -329,11 +680,12 @@ func shouldValidate(c *cache.ContentObject, d time.Duration) bool {
 }
 
 // respond sends the response back to the client
-func respond(w http.ResponseWriter, hh http.Header, body []byte) error {
+func respond(w http.ResponseWriter, code int, hh http.Header, body []byte) error {
 	for k, v := range hh {
 		w.Header().Set(k, v[0])
 	}
 
+	w.WriteHeader(code)
 	w.Write(body)
 	return nil
 }
@@ -342,25 +694,140 @@ func respond(w http.ResponseWriter, hh http.Header, body []byte) error {
 func (c *CDN) httpHandler(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 
-	host := req.Host
-	defer requestDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	// metrics are labelled with the configured domain rather than the host requested to
+	// avoid unbounded cardinality when wildcard and default backends are used
+	domain := "unknown"
+	route := "unknown"
+	defer func() {
+		requestDuration.WithLabelValues(domain, route).Observe(time.Since(start).Seconds())
+		requestProtocolMetric.WithLabelValues(domain, req.Proto).Inc()
+	}()
+
+	// challenges of the ACME server are answered for any host
+	if c.acme.serveChallenge(w, req) {
+		return
+	}
 
+	host := req.Host
 	h, _, err := net.SplitHostPort(req.Host)
 	if err == nil {
 		host = h
 	}
-	port := c.endpoints[host].Port
-	proto := c.endpoints[host].Proto
-	backend := fmt.Sprintf("%s://%s:%d", proto, host, port)
-	fr := fmt.Sprintf("%s%s", backend, req.URL.Path)
 
-	reqURL := req.URL.String()
+	l := c.requestListener(req)
+	e, ok := c.hosts().lookup(l.proto, l.name, host)
+	if !ok {
+		// on a TLS connection the client could be reusing a connection opened for another domain
+		code := http.StatusNotFound
+		if req.TLS != nil {
+			code = http.StatusMisdirectedRequest
+		}
+		logrus.Debugf("unhandled endpoint: %s", host)
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(code), "error").Inc()
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	domain = e.Domain
+
+	// the certificate was selected using SNI, it must be for the same host being requested
+	if req.TLS != nil && req.TLS.ServerName != "" && normalizeHost(req.TLS.ServerName) != normalizeHost(host) {
+		logrus.Debugf("SNI %s doesn't match host %s", req.TLS.ServerName, host)
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusMisdirectedRequest), "error").Inc()
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
+
+	// the connection must have been authenticated for the backend
+	if !e.clientAuth.allows(req) {
+		code := http.StatusForbidden
+		if req.TLS != nil {
+			code = http.StatusMisdirectedRequest
+		}
+		logrus.Debugf("connection not authenticated for host %s", host)
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(code), "error").Inc()
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	vars := newHeaderVars(req)
+	vars.clientCertSubject, vars.clientCertFingerprint = e.clientAuth.certificate(req)
+
+	// redirects are answered straight away, while rewrites change the path used from now on
+	location, code, redirect := e.rules.apply(req)
+	if redirect {
+		route = e.Route
+		w = e.responseHeaders.writer(w, vars)
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(code), "redirect").Inc()
+		http.Redirect(w, req, location, code)
+		return
+	}
+
+	e = e.forPath(req.URL.Path)
+	// requests which don't match any route can be sent to the canary origin
+	if ce, ok := e.canary.choose(req, vars); ok {
+		e = ce
+	}
+	route = e.Route
+	w = e.responseHeaders.writer(w, vars)
+
+	backend := fmt.Sprintf("%s://%s:%d", e.Proto, host, e.Port)
+	// the origin request can differ from the public one, but the cache key is always the public URL
+	fr := fmt.Sprintf("%s%s", backend, e.pathRewrite.rewrite(req.URL.Path))
+
+	// upgraded connections are tunnelled to the origin, bypassing the cache
+	if isUpgrade(req) {
+		r, err := newUpgradeRequest(req, fr, e, vars)
+		if err != nil {
+			logrus.Errorf("error creating upgrade request: %s", err)
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusBadRequest), "error").Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		code, err := e.upgrade.serve(w, r, e.client.Transport)
+		if err != nil {
+			logrus.Errorf("error upgrading connection: %s", err)
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(code), "error").Inc()
+			return
+		}
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(code), "success").Inc()
+		return
+	}
+
+	// responses of backends pinned to listeners and of the canary are cached separately, so that
+	// they're only served on those listeners and to the clients of the canary
+	reqURL := cacheKey(req, host)
+	if e.pinned {
+		reqURL = cache.ListenerKey(reqURL, l.name)
+	}
+	if e.Version != "" {
+		reqURL = cache.VersionKey(reqURL, e.Version)
+	}
+
+	// large objects are cached in slices
+	if e.SliceSize > 0 && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		if e.NoCache {
+			vars.cacheStatus = cacheStatusBypass
+		}
+		c.serveSliced(w, req, e, fr, reqURL, vars, domain, route)
+		return
+	}
 
 	// Do a lookup and if present return directly without making a HTTP request
-	content, found, err := c.cache.Lookup(reqURL)
-	if err != nil {
-		logrus.Debugf("error while looking up %s: %s", fr, err)
-		cacheMetric.WithLabelValues(host, "lookup_error").Inc()
+	var content *cache.ContentObject
+	var found bool
+	if e.NoCache {
+		vars.cacheStatus = cacheStatusBypass
+	} else {
+		content, found, err = c.cache.Lookup(reqURL)
+		if err != nil {
+			logrus.Debugf("error while looking up %s: %s", fr, err)
+			cacheMetric.WithLabelValues(domain, "lookup_error").Inc()
+		}
+		// the object was cached in slices before the configuration changed
+		if found && content.Headers()[sliceMetaHeader] != "" {
+			found = false
+		}
 	}
 
 	var reqBody []byte
@@ -368,7 +835,7 @@ func (c *CDN) httpHandler(w http.ResponseWriter, req *http.Request) {
 		reqBody, err = ioutil.ReadAll(req.Body)
 		if err != nil {
 			logrus.Errorf("error reading request body: %s", err)
-			requestsMetric.WithLabelValues(host, strconv.Itoa(http.StatusBadRequest), "error").Inc()
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusBadRequest), "error").Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -376,58 +843,67 @@ func (c *CDN) httpHandler(w http.ResponseWriter, req *http.Request) {
 
 	if found {
 		// check if the URL needs to be validated. Validate if 15m have elapsed
-		if shouldValidate(content, time.Duration(c.endpoints[host].IfModifiedValidation)*time.Second) {
+		if shouldValidate(content, time.Duration(e.IfModifiedValidation)*time.Second) {
 			// validate
-			tmpReq, err := http.NewRequest(req.Method, fr, bytes.NewReader(reqBody))
+			tmpReq, err := http.NewRequestWithContext(req.Context(), req.Method, fr, bytes.NewReader(reqBody))
 			if err != nil {
 				logrus.Errorf("error creating validation request: %s", err)
-				validationErrorsMetric.WithLabelValues(host).Inc()
+				validationErrorsMetric.WithLabelValues(domain).Inc()
 				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
 			for k, v := range req.Header {
-				req.Header.Set(k, strings.Join(v, " "))
+				tmpReq.Header.Set(k, strings.Join(v, " "))
+			}
+			if e.OriginHost != "" {
+				tmpReq.Host = e.OriginHost
 			}
+			vars.cacheStatus = cacheStatusRevalidated
+			e.requestHeaders.apply(tmpReq.Header, vars)
 
-			validated, resp, err := c.validate(tmpReq)
-			defer resp.Body.Close()
+			validated, resp, err := c.validate(domain, e, tmpReq)
 			if err != nil {
 				logrus.Errorf("error validating cached item: %s", err)
-				validationErrorsMetric.WithLabelValues(host).Inc()
-				w.WriteHeader(http.StatusInternalServerError)
+				validationErrorsMetric.WithLabelValues(domain).Inc()
+				w.WriteHeader(http.StatusBadGateway)
+				return
 			}
 
 			if validated && resp != nil {
-				validationMetric.WithLabelValues(host).Inc()
+				defer resp.Body.Close()
+				validationMetric.WithLabelValues(domain).Inc()
 				body, err := ioutil.ReadAll(resp.Body)
 				if err != nil {
 					logrus.Errorf("error reading validated body: %s", err)
-					validationErrorsMetric.WithLabelValues(host).Inc()
+					validationErrorsMetric.WithLabelValues(domain).Inc()
 					w.WriteHeader(http.StatusInternalServerError)
+					return
 				}
-				respond(w, resp.Header, body)
+				respond(w, resp.StatusCode, resp.Header, body)
 			}
 			return
 		}
 
 		logrus.Infof("cache hit: %s (%s)", fr, content.ContentType)
-		cacheMetric.WithLabelValues(host, "hit").Inc()
-		requestsMetric.WithLabelValues(host, strconv.Itoa(http.StatusOK), "success").Inc()
+		cacheMetric.WithLabelValues(domain, "hit").Inc()
+		vars.cacheStatus = cacheStatusHit
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusOK), "success").Inc()
 
 		hh := http.Header{}
 		for k, v := range content.Headers() {
 			hh[k] = []string{v}
 		}
 
-		respond(w, hh, content.Content())
+		respond(w, http.StatusOK, hh, content.Content())
 		return
 	}
 
-	// cache miss, fetch content again
+	// cache miss, fetch content again. The request is cancelled if the client goes away
 	logrus.Infof("cache miss: %s", fr)
-	r, err := http.NewRequest(req.Method, fr, bytes.NewReader(reqBody))
+	r, err := http.NewRequestWithContext(req.Context(), req.Method, fr, bytes.NewReader(reqBody))
 	if err != nil {
 		logrus.Errorf("error creating a new proxy request: %s", err)
-		requestsMetric.WithLabelValues(host, strconv.Itoa(http.StatusBadRequest), "error").Inc()
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusBadRequest), "error").Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -437,40 +913,55 @@ func (c *CDN) httpHandler(w http.ResponseWriter, req *http.Request) {
 		logrus.Debugf("propagating headers to backend %s: %s", k, v[0])
 		r.Header.Add(k, v[0])
 	}
+	if e.OriginHost != "" {
+		r.Host = e.OriginHost
+	}
+	e.requestHeaders.apply(r.Header, vars)
 
 	// execute the request to the backend
-	resp, err := c.httpClient.Do(r)
+	originStart := time.Now()
+	resp, err := doRequest(e.client, domain, e.Retry, r)
 	if err != nil {
 		logrus.Errorf("error proxying request: %s", err)
-		requestsMetric.WithLabelValues(host, strconv.Itoa(http.StatusBadRequest), "error").Inc()
-		w.WriteHeader(http.StatusBadRequest)
+		e.mirror.send(r, reqBody, http.StatusBadGateway, time.Since(originStart))
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusBadGateway), "error").Inc()
+		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	e.mirror.send(r, reqBody, resp.StatusCode, time.Since(originStart))
 
 	// read the response body
 	rb, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logrus.Errorf("error reading response body: %s", err)
-		requestsMetric.WithLabelValues(host, strconv.Itoa(http.StatusInternalServerError), "error").Inc()
+		requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusInternalServerError), "error").Inc()
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	requestsMetric.WithLabelValues(host, strconv.Itoa(resp.StatusCode), "success").Inc()
+	requestsMetric.WithLabelValues(domain, route, strconv.Itoa(resp.StatusCode), "success").Inc()
 
 	// respond to client as soon as possible
-	respond(w, resp.Header, rb)
+	respond(w, resp.StatusCode, resp.Header, rb)
+
+	// only complete responses are cached, cache hits are always served as 200
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
 
 	cachable, cii := c.isCachable(resp.Header)
-	if !cachable {
+	if !cachable || e.NoCache {
 		return
 	}
+	if e.TTL > 0 {
+		cii.MaxAge = e.TTL
+	}
 
 	logrus.Debugf("[%s] Content-type: %s", fr, cii.ContentType)
-	ccParserMetric.WithLabelValues(host, "content_type_present").Inc()
-	ccParserMetric.WithLabelValues(host, "content_type_cachable").Inc()
-	ccParserMetric.WithLabelValues(host, "cache_control_cachable").Inc()
+	ccParserMetric.WithLabelValues(domain, "content_type_present").Inc()
+	ccParserMetric.WithLabelValues(domain, "content_type_cachable").Inc()
+	ccParserMetric.WithLabelValues(domain, "cache_control_cachable").Inc()
 	logrus.Infof("storing a new object in cache: %s (%s)", fr, cii.ContentType)
 
 	// we also want to store the headers
@@ -483,9 +974,9 @@ func (c *CDN) httpHandler(w http.ResponseWriter, req *http.Request) {
 		err := c.cache.Store(reqURL, co)
 		if err != nil {
 			logrus.Errorf("error storing cache item %s: %s", reqURL, err)
-			cacheMetric.WithLabelValues(host, "store_error").Inc()
+			cacheMetric.WithLabelValues(domain, "store_error").Inc()
 		}
 		logrus.Debugf("successfully stored item %s", reqURL)
-		cacheMetric.WithLabelValues(host, "stored").Inc()
+		cacheMetric.WithLabelValues(domain, "stored").Inc()
 	}()
 }
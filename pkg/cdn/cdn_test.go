@@ -1,12 +1,9 @@
 package cdn
 
 import (
-	"context"
 	"fmt"
-	"net"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
 	"testing"
 	"time"
 
@@ -70,7 +67,7 @@ func TestHTTPHandler(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/html")
-		fmt.Fprintf(w, exampleContent)
+		fmt.Fprint(w, exampleContent)
 	})
 	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/css")
@@ -92,23 +89,15 @@ func TestHTTPHandler(t *testing.T) {
 		fmt.Fprintf(w, "max-age")
 	})
 
-	s := &http.Server{
-		Addr:           ":7887",
-		Handler:        mux,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
+	s := httptest.NewServer(mux)
 	defer s.Close()
 
-	go s.ListenAndServe()
-
 	c := DefaultConf()
 	bc := BackendConf{
 		Name:   "example",
 		Domain: "www.example.com",
 		IP:     "127.0.0.1",
-		Port:   7887,
+		Port:   listenerPort(t, s),
 	}
 	c.HTTP.Backends = []BackendConf{bc}
 	cdn, err := NewCDN(c)
@@ -126,37 +115,6 @@ func TestHTTPHandler(t *testing.T) {
 	)
 	cdn.cache.Store("http://www.example.com/style.css", co)
 
-	// Override client connection to use local temporary server
-	dialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 10 * time.Second,
-		DualStack: true,
-	}
-	http.DefaultTransport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		// the address always includes the port, so we split
-		host, port, err := net.SplitHostPort(addr)
-		if err != nil {
-			return nil, err
-		}
-
-		// check we manage that endpoint
-		e, ok := cdn.endpoints[host]
-		if !ok {
-			return nil, fmt.Errorf("unhandled endpoint")
-		}
-
-		// override IP and/or port if defined
-		if e.IP != "" {
-			host = e.IP
-		}
-		if e.Port > 0 {
-			port = strconv.Itoa(e.Port)
-		}
-
-		addr = fmt.Sprintf("%s:%s", host, port)
-		return dialer.DialContext(ctx, network, addr)
-	}
-
 	req, err := http.NewRequest("GET", "http://www.example.com/style.css", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -325,5 +283,81 @@ func TestCleanHeadersMap(t *testing.T) {
 }
 
 func TestValidate(t *testing.T) {
-	// TODO
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/css")
+		w.Header().Add("Cache-Control", "public")
+		fmt.Fprintf(w, "%s %s %s", r.Host, r.Header.Get("X-Client"), r.Header.Get("X-Rule"))
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:           "example",
+		Domain:         "www.example.com",
+		IP:             "127.0.0.1",
+		Port:           listenerPort(t, s),
+		OriginHost:     "origin.internal",
+		RequestHeaders: []HeaderRuleConf{{Action: "set", Name: "X-Rule", Value: "on"}},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an object without the time it was cached at is always validated
+	err = cdn.cache.Store("http://www.example.com/style.css", cache.NewContentObject([]byte("stale"), "text/css", map[string]string{}, 60, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/style.css", nil)
+	req.Header.Set("X-Client", "a")
+	rr := httptest.NewRecorder()
+	cdn.httpHandler(rr, req)
+	if rr.Body.String() != "origin.internal a on" {
+		t.Errorf("expected the validation request to carry the client headers, the origin host and the header rules, received '%s'", rr.Body.String())
+	}
+}
+
+func TestOriginHostAndPathRewrite(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/css")
+		w.Header().Add("Cache-Control", "public")
+		fmt.Fprintf(w, "%s%s", r.Host, r.URL.Path)
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:        "example",
+		Domain:      "www.example.com",
+		IP:          "127.0.0.1",
+		Port:        listenerPort(t, s),
+		OriginHost:  "origin.internal",
+		PathRewrite: PathRewriteConf{StripPrefix: "/assets", AddPrefix: "/static/v2"},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.example.com/assets/style.css", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	cdn.httpHandler(rr, req)
+	if rr.Body.String() != "origin.internal/static/v2/style.css" {
+		t.Errorf("expected the origin to receive the rewritten host and path, received '%s'", rr.Body.String())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, found, err := cdn.cache.Lookup("http://www.example.com/assets/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("the object should be cached using the public URL")
+	}
 }
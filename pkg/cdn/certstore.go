@@ -0,0 +1,397 @@
+package cdn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amartorelli/particles/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCertReloadInterval = 30 // seconds
+
+	// sources of the certificates
+	certSourceBackend = "backend"
+	certSourceDir     = "directory"
+	certSourceACME    = "acme"
+)
+
+var (
+	errNoCertificate = errors.New("no certificate available")
+	errNoCertDir     = errors.New("no certificate directory configured")
+)
+
+// certFiles is a certificate and its key
+type certFiles struct {
+	name     string // what the certificate is used for, used in logs and in the API
+	source   string
+	certFile string
+	keyFile  string
+}
+
+// certEntry is a certificate loaded from files
+type certEntry struct {
+	name   string
+	source string
+	file   string
+	cert   *tls.Certificate
+}
+
+// certTable selects a certificate by SNI. Names are matched exactly first, then against wildcard
+// certificates. When more certificates match, the one expiring last is preferred
+type certTable struct {
+	entries   []*certEntry
+	exact     map[string][]*certEntry
+	wildcards map[string][]*certEntry
+}
+
+// newCertTable indexes certificates by the names they're valid for
+func newCertTable(entries []*certEntry) *certTable {
+	ct := &certTable{entries: entries, exact: make(map[string][]*certEntry), wildcards: make(map[string][]*certEntry)}
+	for _, e := range entries {
+		leaf := e.cert.Leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, n := range names {
+			n = normalizeHost(n)
+			if isWildcardDomain(n) {
+				ct.wildcards[strings.TrimPrefix(n, "*")] = append(ct.wildcards[strings.TrimPrefix(n, "*")], e)
+				continue
+			}
+			ct.exact[n] = append(ct.exact[n], e)
+		}
+	}
+
+	for _, m := range []map[string][]*certEntry{ct.exact, ct.wildcards} {
+		for _, es := range m {
+			sort.SliceStable(es, func(i, j int) bool { return es[i].cert.Leaf.NotAfter.After(es[j].cert.Leaf.NotAfter) })
+		}
+	}
+	return ct
+}
+
+// match returns the certificate valid for the name requested by the client, preferring the ones
+// supported by the client, like an ECDSA certificate over an RSA one. It returns nil if none is valid
+func (ct *certTable) match(hello *tls.ClientHelloInfo) *certEntry {
+	name := normalizeHost(hello.ServerName)
+	candidates := ct.exact[name]
+	if i := strings.Index(name, "."); i > 0 {
+		candidates = append(candidates[:len(candidates):len(candidates)], ct.wildcards[name[i:]]...)
+	}
+
+	for _, e := range candidates {
+		if hello.SupportsCertificate(e.cert) == nil {
+			return e
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// lookup returns the certificate for the name requested by the client
+func (ct *certTable) lookup(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if e := ct.match(hello); e != nil {
+		return e.cert
+	}
+
+	// clients not sending SNI get the first certificate, like with tls.Config.Certificates
+	if len(ct.entries) > 0 {
+		return ct.entries[0].cert
+	}
+	return nil
+}
+
+// certStore holds the certificates of the HTTPS listener, loaded from the files of the backends and
+// from a directory. Files are checked periodically and certificates are replaced atomically when they
+// change, so that new handshakes use the new certificates without affecting open connections
+type certStore struct {
+	files    []certFiles
+	dir      string
+	interval time.Duration
+	table    atomic.Value // *certTable
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// mu serializes the reloads with the changes made via the API
+	mu        sync.Mutex
+	loaded    map[string]*certEntry
+	modTimes  map[string]time.Time
+	expiryFor map[string]bool
+}
+
+// newCertStore loads the certificates of the HTTPS backends and the ones in the certificates directory
+func newCertStore(hc HTTPConf) (*certStore, error) {
+	interval := defaultCertReloadInterval
+	if hc.CertReloadInterval > 0 {
+		interval = hc.CertReloadInterval
+	}
+
+	cs := &certStore{
+		dir:       hc.CertDir,
+		interval:  time.Duration(interval) * time.Second,
+		stop:      make(chan struct{}),
+		loaded:    make(map[string]*certEntry),
+		modTimes:  make(map[string]time.Time),
+		expiryFor: make(map[string]bool),
+	}
+	for _, b := range hc.Backends {
+		if b.ACME.Directory != "" || (b.CertFile == "" && b.KeyFile == "" && hc.CertDir != "") {
+			continue
+		}
+		cs.files = append(cs.files, certFiles{name: b.Name, source: certSourceBackend, certFile: b.CertFile, keyFile: b.KeyFile})
+	}
+
+	// at startup every certificate must be valid
+	_, err := cs.reload(true)
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// getCertificate returns the certificate for the name requested by the client
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c := cs.table.Load().(*certTable).lookup(hello)
+	if c == nil {
+		return nil, errNoCertificate
+	}
+	return c, nil
+}
+
+// watch reloads the certificates when their files change, until stopped
+func (cs *certStore) watch() {
+	t := time.NewTicker(cs.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-cs.stop:
+			return
+		case <-t.C:
+			cs.reload(false)
+		}
+	}
+}
+
+// shutdown stops watching the certificate files
+func (cs *certStore) shutdown() {
+	cs.stopOnce.Do(func() { close(cs.stop) })
+}
+
+// sources returns the certificates to load: the ones of the backends and the pairs of name.crt and
+// name.key files in the directory
+func (cs *certStore) sources() ([]certFiles, error) {
+	files := append([]certFiles{}, cs.files...)
+	if cs.dir == "" {
+		return files, nil
+	}
+
+	entries, err := ioutil.ReadDir(cs.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".crt") || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".crt")
+		certFile, keyFile := cs.dirFiles(name)
+		files = append(files, certFiles{name: name, source: certSourceDir, certFile: certFile, keyFile: keyFile})
+	}
+	return files, nil
+}
+
+// dirFiles returns the files of a certificate in the directory
+func (cs *certStore) dirFiles(name string) (string, string) {
+	return filepath.Join(cs.dir, name+".crt"), filepath.Join(cs.dir, name+".key")
+}
+
+// reload loads the certificates whose files changed and replaces the table if anything changed. When
+// a certificate can't be loaded, the previous one is kept, unless strict is set
+func (cs *certStore) reload(strict bool) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.load(strict)
+}
+
+// load is reload with the lock held
+func (cs *certStore) load(strict bool) (bool, error) {
+	sources, err := cs.sources()
+	if err != nil {
+		logrus.Errorf("error listing certificates: %s", err)
+		certReloadsMetric.WithLabelValues("error").Inc()
+		if strict {
+			return false, err
+		}
+		return false, nil
+	}
+
+	changed := false
+	seen := make(map[string]bool)
+	for _, f := range sources {
+		key := f.certFile + "|" + f.keyFile
+		seen[key] = true
+
+		mt := latestModTime(f.certFile, f.keyFile)
+		if _, ok := cs.loaded[key]; ok && mt.Equal(cs.modTimes[key]) {
+			continue
+		}
+
+		c, err := loadCertificate(f.certFile, f.keyFile)
+		if err != nil {
+			certReloadsMetric.WithLabelValues("error").Inc()
+			if strict {
+				return false, fmt.Errorf("certificate error for %s: %s", f.name, err)
+			}
+			logrus.Errorf("error loading certificate for %s, keeping the previous one: %s", f.name, err)
+			continue
+		}
+
+		if _, ok := cs.loaded[key]; ok {
+			logrus.Infof("certificate for %s reloaded", f.name)
+		}
+		cs.loaded[key] = &certEntry{name: f.name, source: f.source, file: f.certFile, cert: c}
+		cs.modTimes[key] = mt
+		changed = true
+	}
+
+	// certificates removed from the directory
+	for key := range cs.loaded {
+		if !seen[key] {
+			delete(cs.loaded, key)
+			delete(cs.modTimes, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	keys := make([]string, 0, len(cs.loaded))
+	for k := range cs.loaded {
+		keys = append(keys, k)
+	}
+	// the backend certificates come first, so that the first one is used for clients without SNI
+	order := make(map[string]int)
+	for i, f := range sources {
+		order[f.certFile+"|"+f.keyFile] = i
+	}
+	sort.Slice(keys, func(i, j int) bool { return order[keys[i]] < order[keys[j]] })
+
+	entries := make([]*certEntry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, cs.loaded[k])
+	}
+	cs.table.Store(newCertTable(entries))
+	cs.updateExpiry(entries)
+	certReloadsMetric.WithLabelValues("success").Inc()
+	return true, nil
+}
+
+// certificates returns the certificates loaded, in the order they were configured
+func (cs *certStore) certificates() []*certEntry {
+	return cs.table.Load().(*certTable).entries
+}
+
+// certificate returns the certificate served for a domain, nil if none is valid for it
+func (cs *certStore) certificate(domain string) *certEntry {
+	return cs.table.Load().(*certTable).match(&tls.ClientHelloInfo{ServerName: domain})
+}
+
+// add stores a certificate and its key in the directory, named after the domain, and loads it. The
+// key is written first so that a concurrent reload never sees a certificate with the previous key
+func (cs *certStore) add(domain string, certPEM, keyPEM []byte) error {
+	if cs.dir == "" {
+		return errNoCertDir
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	certFile, keyFile := cs.dirFiles(domain)
+	err := writeFileAtomic(keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(certFile, certPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	// the files could have the same modification time as the ones replaced
+	delete(cs.loaded, certFile+"|"+keyFile)
+	_, err = cs.load(false)
+	return err
+}
+
+// remove deletes the certificate of a domain from the directory and stops serving it
+func (cs *certStore) remove(domain string) error {
+	if cs.dir == "" {
+		return errNoCertDir
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	certFile, keyFile := cs.dirFiles(domain)
+	err := os.Remove(certFile)
+	if os.IsNotExist(err) {
+		return api.ErrCertificateNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(keyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = cs.load(false)
+	return err
+}
+
+// updateExpiry exposes the expiry of the certificates, by file since certificates can share their
+// names, removing the ones not used anymore
+func (cs *certStore) updateExpiry(entries []*certEntry) {
+	current := make(map[string]bool)
+	for _, e := range entries {
+		current[e.file] = true
+		certExpiryMetric.WithLabelValues(e.file).Set(float64(e.cert.Leaf.NotAfter.Unix()))
+	}
+
+	for file := range cs.expiryFor {
+		if !current[file] {
+			certExpiryMetric.DeleteLabelValues(file)
+		}
+	}
+	cs.expiryFor = current
+}
+
+// latestModTime returns the latest modification time of the files, zero if any is missing
+func latestModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
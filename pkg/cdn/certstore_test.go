@@ -0,0 +1,243 @@
+package cdn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amartorelli/particles/pkg/api"
+)
+
+// testCertificate returns a self signed certificate valid for the names until notAfter
+func testCertificate(t *testing.T, notAfter time.Time, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// certificatePEM returns a certificate and its key PEM encoded
+func certificatePEM(t *testing.T, cert tls.Certificate) ([]byte, []byte) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+}
+
+func TestCertTable(t *testing.T) {
+	now := time.Now()
+	first := testCertificate(t, now.Add(24*time.Hour), "www.example.com")
+	older := testCertificate(t, now.Add(24*time.Hour), "*.example.com")
+	newer := testCertificate(t, now.Add(48*time.Hour), "*.example.com")
+	other := testCertificate(t, now.Add(24*time.Hour), "example.org")
+
+	ct := newCertTable([]*certEntry{{cert: &first}, {cert: &older}, {cert: &newer}, {cert: &other}})
+
+	tt := []struct {
+		serverName string
+		expected   *tls.Certificate
+		errMsg     string
+	}{
+		{"www.example.com", &first, "a name should be matched exactly"},
+		{"WWW.example.com.", &first, "names should be matched case insensitively and without the trailing dot"},
+		{"img.example.com", &newer, "the wildcard certificate expiring last should be preferred"},
+		{"a.img.example.com", &first, "a wildcard should only match a single label"},
+		{"example.org", &other, "a name should be matched exactly"},
+		{"", &first, "clients without SNI should get the first certificate"},
+	}
+
+	for _, tc := range tt {
+		c := ct.lookup(&tls.ClientHelloInfo{ServerName: tc.serverName})
+		if c != tc.expected {
+			t.Errorf("%s: %s", tc.serverName, tc.errMsg)
+		}
+	}
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "particles-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeCertificate(t, testCertificate(t, now.Add(24*time.Hour), "www.example.com"), filepath.Join(dir, "example.crt"), filepath.Join(dir, "example.key"))
+
+	cs, err := newCertStore(HTTPConf{CertDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &tls.ClientHelloInfo{ServerName: "www.example.com"}
+	c, err := cs.getCertificate(hello)
+	if err != nil {
+		t.Fatalf("the certificate in the directory should be loaded: %s", err)
+	}
+
+	// a new certificate replaces the previous one
+	writeCertificate(t, testCertificate(t, now.Add(48*time.Hour), "www.example.com"), filepath.Join(dir, "example.crt"), filepath.Join(dir, "example.key"))
+	later := now.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "example.crt"), later, later)
+	changed, _ := cs.reload(false)
+	renewed, _ := cs.getCertificate(hello)
+	if !changed || renewed == c {
+		t.Error("a changed certificate should be reloaded")
+	}
+
+	// an invalid certificate doesn't replace the working one
+	err = ioutil.WriteFile(filepath.Join(dir, "example.crt"), []byte("invalid"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "example.crt"), later, later)
+	cs.reload(false)
+	kept, _ := cs.getCertificate(hello)
+	if kept != renewed {
+		t.Error("the previous certificate should be kept when the new one is invalid")
+	}
+
+	// removed certificates aren't served anymore
+	os.Remove(filepath.Join(dir, "example.crt"))
+	os.Remove(filepath.Join(dir, "example.key"))
+	cs.reload(false)
+	_, err = cs.getCertificate(hello)
+	if err != errNoCertificate {
+		t.Error("a removed certificate should not be served")
+	}
+
+	// at startup invalid certificates are rejected
+	_, err = newCertStore(HTTPConf{Backends: []BackendConf{{Name: "example", Domain: "www.example.com", CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "missing.key")}}})
+	if err == nil {
+		t.Error("a backend with a missing certificate should be rejected at startup")
+	}
+}
+
+func TestCertStoreExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "particles-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// certificates for the same name, like the one being replaced and its replacement
+	now := time.Now()
+	writeCertificate(t, testCertificate(t, now.Add(24*time.Hour), "www.example.com"), filepath.Join(dir, "old.crt"), filepath.Join(dir, "old.key"))
+	writeCertificate(t, testCertificate(t, now.Add(48*time.Hour), "www.example.com"), filepath.Join(dir, "new.crt"), filepath.Join(dir, "new.key"))
+
+	cs, err := newCertStore(HTTPConf{CertDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.expiryFor) != 2 || !cs.expiryFor[filepath.Join(dir, "old.crt")] || !cs.expiryFor[filepath.Join(dir, "new.crt")] {
+		t.Errorf("the expiry of each certificate file should be exposed, received %v", cs.expiryFor)
+	}
+
+	os.Remove(filepath.Join(dir, "old.crt"))
+	os.Remove(filepath.Join(dir, "old.key"))
+	cs.reload(false)
+	if len(cs.expiryFor) != 1 || !cs.expiryFor[filepath.Join(dir, "new.crt")] {
+		t.Errorf("the expiry of the removed certificate should not be exposed, received %v", cs.expiryFor)
+	}
+}
+
+func TestCertificateAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "particles-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := DefaultConf()
+	c.HTTPS.CertDir = dir
+	c.HTTPS.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1"}}
+	valid, reason := c.IsValid()
+	if !valid {
+		t.Fatal(reason)
+	}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	valid24h := testCertificate(t, now.Add(24*time.Hour), "www.example.com")
+	expired := testCertificate(t, now.Add(-time.Minute), "www.example.com")
+	otherDomain := testCertificate(t, now.Add(24*time.Hour), "www.example.org")
+
+	tt := []struct {
+		domain string
+		cert   tls.Certificate
+		key    tls.Certificate
+		valid  bool
+		errMsg string
+	}{
+		{"www.example.org", otherDomain, otherDomain, false, "a domain without HTTPS backend should be rejected"},
+		{"www.example.com", otherDomain, otherDomain, false, "a certificate not valid for the domain should be rejected"},
+		{"www.example.com", expired, expired, false, "an expired certificate should be rejected"},
+		{"www.example.com", valid24h, otherDomain, false, "a certificate not matching the key should be rejected"},
+		{"../www.example.com", valid24h, valid24h, false, "an invalid domain should be rejected"},
+		{"www.example.com", valid24h, valid24h, true, "a valid certificate should be accepted"},
+	}
+
+	for _, tc := range tt {
+		certPEM, _ := certificatePEM(t, tc.cert)
+		_, keyPEM := certificatePEM(t, tc.key)
+
+		_, err := cdn.AddCertificate(tc.domain, certPEM, keyPEM)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: %v", tc.errMsg, err)
+		}
+	}
+
+	info, err := cdn.Certificate("WWW.example.com")
+	if err != nil || info.Source != certSourceDir || info.Subject != "CN=www.example.com" || !info.NotAfter.Equal(valid24h.Leaf.NotAfter) {
+		t.Errorf("the uploaded certificate should be served: %+v %v", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "www.example.com.crt")); err != nil {
+		t.Error("the uploaded certificate should be persisted in the directory")
+	}
+	if len(cdn.Certificates()) != 1 {
+		t.Errorf("expected 1 certificate, got %d", len(cdn.Certificates()))
+	}
+
+	err = cdn.DeleteCertificate("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cdn.Certificate("www.example.com")
+	if err != api.ErrCertificateNotFound {
+		t.Error("a deleted certificate should not be served")
+	}
+	err = cdn.DeleteCertificate("www.example.com")
+	if err != api.ErrCertificateNotFound {
+		t.Error("deleting a missing certificate should return not found")
+	}
+}
@@ -0,0 +1,166 @@
+package cdn
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// client certificates asked by HTTPS backends
+	clientAuthRequest = "request" // optional, verified when client_ca is set
+	clientAuthRequire = "require" // required, not verified
+	clientAuthVerify  = "verify"  // required and verified with client_ca
+)
+
+var (
+	validClientAuthModes = []string{clientAuthRequest, clientAuthRequire, clientAuthVerify}
+)
+
+// clientAuth is how a HTTPS backend authenticates the clients via certificates
+type clientAuth struct {
+	mode     string
+	authType tls.ClientAuthType
+	pool     *x509.CertPool
+	// the raw certificates in the pool, to check which CA verified a connection
+	cas map[string]bool
+}
+
+// newClientAuth returns the client authentication of a backend, nil if it doesn't ask for certificates
+func newClientAuth(bc BackendConf) (*clientAuth, error) {
+	if bc.ClientAuth == "" {
+		return nil, nil
+	}
+
+	ca := &clientAuth{mode: bc.ClientAuth}
+	switch bc.ClientAuth {
+	case clientAuthRequest:
+		ca.authType = tls.RequestClientCert
+		if bc.ClientCA != "" {
+			ca.authType = tls.VerifyClientCertIfGiven
+		}
+	case clientAuthRequire:
+		ca.authType = tls.RequireAnyClientCert
+	case clientAuthVerify:
+		ca.authType = tls.RequireAndVerifyClientCert
+	}
+
+	if bc.ClientCA != "" {
+		err := ca.loadCAs(bc.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+// loadCAs reads the PEM bundle of the CAs verifying the client certificates
+func (ca *clientAuth) loadCAs(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	ca.pool = x509.NewCertPool()
+	ca.cas = make(map[string]bool)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		ca.pool.AddCert(cert)
+		ca.cas[string(cert.Raw)] = true
+	}
+
+	if len(ca.cas) == 0 {
+		return errInvalidCABundle
+	}
+	return nil
+}
+
+// config returns the TLS configuration of the handshakes for the backend
+func (ca *clientAuth) config(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.ClientAuth = ca.authType
+	cfg.ClientCAs = ca.pool
+	return cfg
+}
+
+// allows checks the connection of a request was authenticated as required by the backend. The
+// certificate is asked during the handshake, which only knows the host sent via SNI, so a client
+// could reuse a connection opened for another host or skip SNI to avoid it
+func (ca *clientAuth) allows(req *http.Request) bool {
+	if ca == nil {
+		return true
+	}
+	if req.TLS == nil || req.TLS.ServerName == "" {
+		return false
+	}
+
+	switch ca.mode {
+	case clientAuthRequire:
+		return len(req.TLS.PeerCertificates) > 0
+	case clientAuthVerify:
+		return ca.verified(req.TLS) != nil
+	}
+	// a certificate sent in request mode must have been verified by the CAs of the backend
+	return len(req.TLS.PeerCertificates) == 0 || ca.pool == nil || ca.verified(req.TLS) != nil
+}
+
+// verified returns the client certificate if it was verified by one of the CAs of the backend.
+// Sessions can be resumed across backends, so the CA of the chain is checked as well
+func (ca *clientAuth) verified(cs *tls.ConnectionState) *x509.Certificate {
+	for _, chain := range cs.VerifiedChains {
+		if len(chain) > 0 && ca.cas[string(chain[len(chain)-1].Raw)] {
+			return chain[0]
+		}
+	}
+	return nil
+}
+
+// certificate returns the subject and the SHA-256 fingerprint of the client certificate of a request,
+// empty if it wasn't verified by the CAs of the backend
+func (ca *clientAuth) certificate(req *http.Request) (string, string) {
+	if ca == nil || req.TLS == nil {
+		return "", ""
+	}
+
+	cert := ca.verified(req.TLS)
+	if cert == nil {
+		return "", ""
+	}
+	fp := sha256.Sum256(cert.Raw)
+	return cert.Subject.String(), hex.EncodeToString(fp[:])
+}
+
+// getConfigForClient asks a client certificate when the backend requested via SNI authenticates the
+// clients. TLS-ALPN-01 challenges of the ACME server are never asked for a certificate
+func (c *CDN) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	for _, p := range hello.SupportedProtos {
+		if p == acmeTLSALPNProto {
+			return nil, nil
+		}
+	}
+
+	l := connListener(hello.Conn)
+	if l == nil {
+		l = c.defaultListener("https")
+	}
+	e, ok := c.hosts().lookup(l.proto, l.name, hello.ServerName)
+	if !ok || e.clientAuth == nil {
+		return nil, nil
+	}
+	return e.clientAuth.config(c.httpsServer.TLSConfig), nil
+}
@@ -0,0 +1,150 @@
+package cdn
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientAuth(t *testing.T) {
+	// the origin answers with the client certificate forwarded by the CDN
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Subject")))
+	}))
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "particles-clientauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "example.crt"), filepath.Join(dir, "example.key")
+	writeCertificate(t, testCertificate(t, time.Now().Add(time.Hour), "secure.example.com", "optional.example.com", "www.example.com"), certFile, keyFile)
+
+	// the trusted client certificate is self-signed, so it's its own CA
+	trusted := testCertificate(t, time.Now().Add(time.Hour), "trusted-client")
+	untrusted := testCertificate(t, time.Now().Add(time.Hour), "untrusted-client")
+	caFile := filepath.Join(dir, "ca.crt")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: trusted.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := DefaultConf()
+	headers := []HeaderRuleConf{{Action: headerSet, Name: "X-Client-Subject", Value: "${client_cert_subject}"}}
+	backend := func(name string, auth string, ca string) BackendConf {
+		return BackendConf{Name: name, Domain: name + ".example.com", IP: "127.0.0.1", Port: listenerPort(t, origin), CertFile: certFile, KeyFile: keyFile,
+			OriginTLS: OriginTLSConf{InsecureSkipVerify: true}, ClientAuth: auth, ClientCA: ca, RequestHeaders: headers}
+	}
+	c.HTTPS.Backends = []BackendConf{backend("secure", clientAuthVerify, caFile), backend("optional", clientAuthRequest, caFile), backend("www", "", "")}
+	valid, reason := c.IsValid()
+	if !valid {
+		t.Fatal(reason)
+	}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdn.Shutdown()
+	cdn.httpMux.HandleFunc("/", cdn.httpHandler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go cdn.httpsServer.ServeTLS(ln, "", "")
+
+	tt := []struct {
+		url     string
+		host    string
+		cert    *tls.Certificate
+		code    int
+		subject string
+		errMsg  string
+	}{
+		{"https://secure.example.com/", "", &trusted, http.StatusOK, "CN=trusted-client", "a trusted certificate should be accepted and forwarded"},
+		{"https://secure.example.com/", "", nil, 0, "", "a connection without a certificate should be refused"},
+		{"https://secure.example.com/", "", &untrusted, 0, "", "an untrusted certificate should be refused"},
+		{"https://optional.example.com/", "", nil, http.StatusOK, "", "a certificate should be optional in request mode"},
+		{"https://optional.example.com/", "", &trusted, http.StatusOK, "CN=trusted-client", "an optional certificate should be forwarded"},
+		{"https://www.example.com/", "", &trusted, http.StatusOK, "", "certificates should not be forwarded by backends without client authentication"},
+		{"https://127.0.0.1/", "secure.example.com", &trusted, http.StatusMisdirectedRequest, "", "a connection without SNI should not reach a protected backend"},
+	}
+
+	for _, tc := range tt {
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial(network, ln.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		// the certificate is sent even if the CDN doesn't accept its CA
+		cert := tc.cert
+		if cert != nil {
+			tr.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		req.Host = tc.host
+		// the client can't forge the forwarded certificate
+		req.Header.Set("X-Client-Subject", "CN=forged")
+		resp, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			if tc.code != 0 {
+				t.Errorf("%s: %s", tc.errMsg, err)
+			}
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.code || (tc.code == http.StatusOK && string(body) != tc.subject) {
+				t.Errorf("%s: received %d with subject '%s'", tc.errMsg, resp.StatusCode, string(body))
+			}
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestClientAuthIsValid(t *testing.T) {
+	tt := []struct {
+		auth   string
+		ca     string
+		result bool
+		errMsg string
+	}{
+		{"", "", true, "client authentication should be disabled by default"},
+		{clientAuthRequest, "", true, "certificates should be requested without a CA"},
+		{clientAuthRequest, "/etc/ssl/ca.crt", true, "requested certificates should be verified with a CA"},
+		{clientAuthRequire, "", true, "certificates should be required without a CA"},
+		{clientAuthVerify, "/etc/ssl/ca.crt", true, "certificates should be verified with a CA"},
+		{clientAuthVerify, "", false, "certificates can't be verified without a CA"},
+		{clientAuthRequire, "/etc/ssl/ca.crt", false, "certificates required aren't verified with a CA"},
+		{"", "/etc/ssl/ca.crt", false, "a CA should not be used without client authentication"},
+		{"optional", "", false, "an unknown mode should be invalid"},
+	}
+
+	for _, tc := range tt {
+		c := DefaultConf()
+		c.HTTPS.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1", CertFile: "example.crt", KeyFile: "example.key", ClientAuth: tc.auth, ClientCA: tc.ca}}
+		valid, _ := c.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1", ClientAuth: clientAuthRequest}}
+	if valid, _ := c.IsValid(); valid {
+		t.Error("HTTP backends should not authenticate the clients with certificates")
+	}
+}
@@ -1,7 +1,12 @@
 package cdn
 
 import (
+	"fmt"
 	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
 
 	"github.com/amartorelli/particles/pkg/api"
 	"github.com/amartorelli/particles/pkg/cache"
@@ -17,20 +22,250 @@ type Conf struct {
 
 // HTTPConf is the configuration for the http server
 type HTTPConf struct {
-	Address  string        `yaml:"address"`
-	Port     int           `yaml:"port"`
-	Backends []BackendConf `yaml:"backends"`
+	Address            string            `yaml:"address"`
+	Port               int               `yaml:"port"`
+	CertDir            string            `yaml:"cert_dir"`             // optional, HTTPS only, directory of certificates (name.crt and name.key)
+	CertReloadInterval int               `yaml:"cert_reload_interval"` // optional, HTTPS only, seconds between checks for changed certificate files
+	TLS                TLSConf           `yaml:"tls"`                  // optional, HTTPS only, TLS policy of the listener
+	HTTP2              HTTP2Conf         `yaml:"http2"`                // optional, HTTP/2 settings of the listener
+	ProxyProtocol      ProxyProtocolConf `yaml:"proxy_protocol"`       // optional, PROXY protocol sent by the load balancers
+	ReusePort          bool              `yaml:"reuse_port"`           // optional, set SO_REUSEPORT so that another process can listen on the same addresses
+	Listeners          []ListenerConf    `yaml:"listeners"`            // optional, addresses listened on instead of address and port
+	Backends           []BackendConf     `yaml:"backends"`
+}
+
+// TLSConf is the TLS policy of the HTTPS listener
+type TLSConf struct {
+	MinVersion            string   `yaml:"min_version"`             // optional, minimum TLS version (1.0, 1.1, 1.2, 1.3)
+	MaxVersion            string   `yaml:"max_version"`             // optional, maximum TLS version (1.0, 1.1, 1.2, 1.3)
+	CipherSuites          []string `yaml:"cipher_suites"`           // optional, names of the TLS 1.0-1.2 cipher suites allowed, in order of preference
+	Curves                []string `yaml:"curves"`                  // optional, key exchanges allowed (X25519MLKEM768, X25519, P-256, P-384, P-521)
+	SessionTicketRotation int      `yaml:"session_ticket_rotation"` // optional, seconds between rotations of the session ticket key
+	DisableSessionTickets bool     `yaml:"disable_session_tickets"` // optional, don't resume sessions with tickets
+	OCSPStapling          bool     `yaml:"ocsp_stapling"`           // optional, staple the OCSP response of the certificates
+}
+
+// HTTP2Conf is the HTTP/2 configuration of a listener
+type HTTP2Conf struct {
+	Disable                       bool `yaml:"disable"`                           // optional, HTTPS only, only serve HTTP/1.1
+	H2C                           bool `yaml:"h2c"`                               // optional, HTTP only, serve HTTP/2 without TLS to clients with prior knowledge
+	MaxConcurrentStreams          int  `yaml:"max_concurrent_streams"`            // optional, streams a client can open on a connection
+	MaxReadFrameSize              int  `yaml:"max_read_frame_size"`               // optional, bytes, largest frame accepted (16384 to 16777215)
+	MaxHeaderTableSize            int  `yaml:"max_header_table_size"`             // optional, bytes, table used to decode the compressed headers
+	MaxReceiveBufferPerConnection int  `yaml:"max_receive_buffer_per_connection"` // optional, bytes, flow control window of a connection
+	MaxReceiveBufferPerStream     int  `yaml:"max_receive_buffer_per_stream"`     // optional, bytes, flow control window of a stream
+	PingIntervalMS                int  `yaml:"ping_interval_ms"`                  // optional, idle time before a ping checks the connection
+	PingTimeoutMS                 int  `yaml:"ping_timeout_ms"`                   // optional, time allowed to answer a ping
+}
+
+// ListenerConf is an address a server listens on
+type ListenerConf struct {
+	Name          string             `yaml:"name"`
+	Address       string             `yaml:"address"`
+	Port          int                `yaml:"port"`
+	ProxyProtocol *ProxyProtocolConf `yaml:"proxy_protocol"` // optional, overrides the PROXY protocol settings of the server
+}
+
+// ProxyProtocolConf is how the PROXY protocol is accepted by a listener
+type ProxyProtocolConf struct {
+	TrustedCIDRs    []string `yaml:"trusted_cidrs"`     // load balancers which must send the header, it's disabled when empty
+	HeaderTimeoutMS int      `yaml:"header_timeout_ms"` // optional, time allowed to send the header
 }
 
 // BackendConf is the configuration for a website we cache for
 type BackendConf struct {
-	Name                 string `yaml:"name"`
-	Domain               string `yaml:"domain"`
-	IP                   string `yaml:"ip"`
-	Port                 int    `yaml:"port"`
-	IfModifiedValidation int    `yaml:"ifmodified_validation"`
-	CertFile             string `yaml:"cert"`
-	KeyFile              string `yaml:"key"`
+	Name                 string           `yaml:"name"`
+	Domain               string           `yaml:"domain"`
+	Aliases              []string         `yaml:"aliases"`
+	Default              bool             `yaml:"default"`
+	IP                   string           `yaml:"ip"`
+	Hostname             string           `yaml:"hostname"`
+	DNS                  DNSConf          `yaml:"dns"`
+	Origin               string           `yaml:"origin"`      // optional, unix:///path.sock, file:///path/to/dir or s3://bucket/prefix instead of ip/hostname
+	FileOrigin           FileOriginConf   `yaml:"file_origin"` // optional, how files are served by file:// origins
+	S3                   S3Conf           `yaml:"s3"`          // optional, how s3:// origins are reached
+	Port                 int              `yaml:"port"`
+	IfModifiedValidation int              `yaml:"ifmodified_validation"`
+	CertFile             string           `yaml:"cert"`
+	KeyFile              string           `yaml:"key"`
+	ACME                 ACMEConf         `yaml:"acme"`        // optional, obtain the certificate from an ACME server instead of cert/key
+	Listeners            []string         `yaml:"listeners"`   // optional, names of the listeners serving the backend, all by default
+	HSTS                 HSTSConf         `yaml:"hsts"`        // optional, HTTPS only, Strict-Transport-Security header sent to the clients
+	ClientAuth           string           `yaml:"client_auth"` // optional, HTTPS only, request, require or verify a client certificate
+	ClientCA             string           `yaml:"client_ca"`   // optional, CA bundle verifying the client certificates
+	Retry                RetryConf        `yaml:"retry"`
+	Transport            TransportConf    `yaml:"transport"`
+	OriginTLS            OriginTLSConf    `yaml:"origin_tls"`
+	OriginHost           string           `yaml:"origin_host"`
+	PathRewrite          PathRewriteConf  `yaml:"path_rewrite"`
+	RequestHeaders       []HeaderRuleConf `yaml:"request_headers"`  // optional, rules applied to the origin request
+	ResponseHeaders      []HeaderRuleConf `yaml:"response_headers"` // optional, rules applied to the client response
+	SliceSize            int              `yaml:"slice_size"`       // optional, bytes, cache objects in slices of this size fetched with range requests
+	Upgrade              UpgradeConf      `yaml:"upgrade"`          // optional, limits of upgraded connections like WebSockets
+	Mirror               MirrorConf       `yaml:"mirror"`           // optional, shadow origin receiving a copy of the origin requests
+	Canary               CanaryConf       `yaml:"canary"`           // optional, another version of the origin receiving a share of the clients
+	RedirectHTTPS        bool             `yaml:"redirect_https"`   // optional, redirect HTTP requests to HTTPS
+	CanonicalHost        string           `yaml:"canonical_host"`   // optional, redirect requests for any other host to this one
+	Rules                []RuleConf       `yaml:"rules"`            // optional, rewrites and redirects evaluated before the cache
+	Routes               []RouteConf      `yaml:"routes"`
+}
+
+// RouteConf sends the requests matching a path to a different origin. Any origin setting which
+// isn't specified is inherited from the backend
+type RouteConf struct {
+	Name                 string           `yaml:"name"`
+	Match                string           `yaml:"match"` // prefix, exact or regex
+	Path                 string           `yaml:"path"`
+	IP                   string           `yaml:"ip"`
+	Hostname             string           `yaml:"hostname"`
+	Origin               string           `yaml:"origin"`
+	Port                 int              `yaml:"port"`
+	IfModifiedValidation int              `yaml:"ifmodified_validation"`
+	NoCache              bool             `yaml:"no_cache"` // optional, never cache responses for this route
+	TTL                  int              `yaml:"ttl"`      // optional, overrides the max-age sent by the origin
+	SliceSize            int              `yaml:"slice_size"`
+	OriginHost           string           `yaml:"origin_host"`
+	Retry                *RetryConf       `yaml:"retry"`
+	Transport            *TransportConf   `yaml:"transport"`
+	OriginTLS            *OriginTLSConf   `yaml:"origin_tls"`
+	PathRewrite          *PathRewriteConf `yaml:"path_rewrite"`
+	RequestHeaders       []HeaderRuleConf `yaml:"request_headers"`
+	ResponseHeaders      []HeaderRuleConf `yaml:"response_headers"`
+}
+
+// RetryConf is the configuration for retrying failed requests to a backend
+type RetryConf struct {
+	Attempts         int      `yaml:"attempts"`           // optional, how many times a request is retried
+	BackoffMS        int      `yaml:"backoff_ms"`         // optional, base delay before the first retry
+	MaxBackoffMS     int      `yaml:"max_backoff_ms"`     // optional, upper bound of the delay between retries
+	RetryOn          []string `yaml:"retry_on"`           // optional, errors to retry on (connect, timeout, reset)
+	StatusCodes      []int    `yaml:"status_codes"`       // optional, status codes to retry on
+	BudgetPercent    int      `yaml:"budget_percent"`     // optional, maximum retries as a percentage of requests
+	BudgetMinRetries int      `yaml:"budget_min_retries"` // optional, retries per second always allowed
+}
+
+// DNSConf is the configuration used to resolve origins specified by hostname
+type DNSConf struct {
+	MinRefresh int    `yaml:"min_refresh"` // optional, minimum seconds between resolutions, regardless of the TTL
+	MaxRefresh int    `yaml:"max_refresh"` // optional, maximum seconds between resolutions, regardless of the TTL
+	SRV        bool   `yaml:"srv"`         // optional, the hostname is a SRV name providing hosts and ports
+	Nameserver string `yaml:"nameserver"`  // optional, nameserver to query instead of the ones in /etc/resolv.conf
+}
+
+// FileOriginConf is the configuration of origins serving the files of a local directory
+type FileOriginConf struct {
+	Index        []string `yaml:"index"`         // optional, files served when a directory is requested
+	CacheControl string   `yaml:"cache_control"` // optional, Cache-Control header sent with the files
+}
+
+// S3Conf is the configuration of origins serving the objects of a bucket of S3-compatible object storage
+type S3Conf struct {
+	Endpoint        string `yaml:"endpoint"`          // optional, URL of the object storage, defaults to AWS
+	Region          string `yaml:"region"`            // optional, region used to sign the requests
+	PathStyle       bool   `yaml:"path_style"`        // optional, put the bucket in the path rather than in the hostname
+	AccessKeyID     string `yaml:"access_key_id"`     // optional, taken from AWS_ACCESS_KEY_ID if not set
+	SecretAccessKey string `yaml:"secret_access_key"` // optional, taken from AWS_SECRET_ACCESS_KEY if not set
+	SessionToken    string `yaml:"session_token"`     // optional, taken from AWS_SESSION_TOKEN if not set
+}
+
+// RuleConf rewrites the path of the requests matching a pattern, or redirects them. Rewrites and
+// redirects can use the capture groups of the pattern, like $1
+type RuleConf struct {
+	Match    string `yaml:"match"`    // regular expression matched against the path
+	Rewrite  string `yaml:"rewrite"`  // optional, the new path
+	Redirect string `yaml:"redirect"` // optional, the URL or path to redirect to
+	Status   int    `yaml:"status"`   // optional, the status of the redirect
+}
+
+// UpgradeConf is the configuration of the connections upgraded to a different protocol, like WebSockets
+type UpgradeConf struct {
+	MaxConnections int `yaml:"max_connections"` // optional, maximum number of connections open at the same time
+	IdleTimeoutMS  int `yaml:"idle_timeout_ms"` // optional, connections are closed when nothing is sent for this long
+}
+
+// MirrorConf is the configuration of a shadow origin receiving a copy of a percentage of the origin
+// requests, whose responses are discarded
+type MirrorConf struct {
+	URL       string  `yaml:"url"`        // scheme, host and port of the shadow origin
+	Percent   float64 `yaml:"percent"`    // percentage of the origin requests mirrored
+	QueueSize int     `yaml:"queue_size"` // optional, requests waiting to be mirrored, further ones are dropped
+	Workers   int     `yaml:"workers"`    // optional, requests mirrored at the same time
+	TimeoutMS int     `yaml:"timeout_ms"` // optional, timeout of the mirrored requests
+}
+
+// ACMEConf is the configuration used to obtain the certificate of a HTTPS backend from an ACME
+// server, like Let's Encrypt, instead of loading it from cert and key
+type ACMEConf struct {
+	Directory   string `yaml:"directory"`    // URL of the directory of the ACME server
+	Email       string `yaml:"email"`        // optional, contact address of the account
+	Challenge   string `yaml:"challenge"`    // optional, http-01 or tls-alpn-01
+	Storage     string `yaml:"storage"`      // optional, directory where the account key and the certificates are stored
+	CAFile      string `yaml:"ca_file"`      // optional, CA verifying the ACME server, for test servers like Pebble
+	RenewBefore int    `yaml:"renew_before"` // optional, days before the expiry when the certificate is renewed
+}
+
+// HSTSConf is the Strict-Transport-Security policy of a HTTPS backend
+type HSTSConf struct {
+	MaxAge            int  `yaml:"max_age"`            // seconds the browsers only use HTTPS, 0 disables HSTS
+	IncludeSubdomains bool `yaml:"include_subdomains"` // optional, apply the policy to the subdomains too
+	Preload           bool `yaml:"preload"`            // optional, allow the domain to be included in the browsers' preload lists
+}
+
+// CanaryConf is the configuration of a canary origin, running another version of the origin, which
+// receives a share of the clients. Its responses are cached separately
+type CanaryConf struct {
+	Version      string `yaml:"version"` // name of the version, used to cache its responses separately
+	IP           string `yaml:"ip"`      // the canary origin, exactly one of ip, hostname and origin is required
+	Hostname     string `yaml:"hostname"`
+	Origin       string `yaml:"origin"`
+	Port         int    `yaml:"port"`          // optional, the port of the backend is used otherwise
+	OriginHost   string `yaml:"origin_host"`   // optional, the Host header sent to the canary
+	Weight       int    `yaml:"weight"`        // optional, percentage of the clients sent to the canary
+	Header       string `yaml:"header"`        // optional, requests with this header set to the version go to the canary, any other value to the origin
+	Cookie       string `yaml:"cookie"`        // optional, like header but for a cookie
+	StickyCookie string `yaml:"sticky_cookie"` // optional, cookie identifying the clients, the client IP is used otherwise
+}
+
+// HeaderRuleConf sets, appends to or removes a header. Values can contain variables like ${client_ip}
+type HeaderRuleConf struct {
+	Action string `yaml:"action"` // set, append or remove
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"` // optional for remove
+}
+
+// TransportConf is the configuration of the connections made to a backend's origin
+type TransportConf struct {
+	ConnectTimeoutMS        int    `yaml:"connect_timeout_ms"`         // optional, time allowed to establish a connection
+	TLSHandshakeTimeoutMS   int    `yaml:"tls_handshake_timeout_ms"`   // optional, time allowed for the TLS handshake
+	ResponseHeaderTimeoutMS int    `yaml:"response_header_timeout_ms"` // optional, time allowed to receive the response headers
+	TimeoutMS               int    `yaml:"timeout_ms"`                 // optional, time allowed for the whole request
+	IdleConnTimeoutMS       int    `yaml:"idle_conn_timeout_ms"`       // optional, how long an idle connection is kept open
+	MaxIdleConns            int    `yaml:"max_idle_conns"`             // optional, maximum number of idle connections
+	MaxIdleConnsPerHost     int    `yaml:"max_idle_conns_per_host"`    // optional, maximum number of idle connections per origin
+	MaxConnsPerHost         int    `yaml:"max_conns_per_host"`         // optional, maximum number of connections per origin
+	KeepAliveMS             int    `yaml:"keepalive_ms"`               // optional, TCP keepalive period, negative disables it
+	DisableKeepAlives       bool   `yaml:"disable_keepalives"`         // optional, use a new connection for every request
+	HTTP2                   string `yaml:"http2"`                      // optional, auto, off or h2c
+	PassRedirects           bool   `yaml:"pass_redirects"`             // optional, send the redirects of the origin to the clients instead of following them
+	Proxy                   string `yaml:"proxy"`                      // optional, URL of the proxy to the origin, none to connect directly
+}
+
+// OriginTLSConf is the TLS configuration used when connecting to a HTTPS backend's origin
+type OriginTLSConf struct {
+	CAFile             string `yaml:"ca"`                   // optional, PEM bundle of CAs trusted to sign the origin certificate
+	ServerName         string `yaml:"server_name"`          // optional, SNI and name verified in the origin certificate
+	CertFile           string `yaml:"cert"`                 // optional, client certificate for mutual TLS
+	KeyFile            string `yaml:"key"`                  // optional, client key for mutual TLS
+	MinVersion         string `yaml:"min_version"`          // optional, minimum TLS version (1.0, 1.1, 1.2, 1.3)
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // optional, don't verify the origin certificate
+}
+
+// PathRewriteConf describes how the request path is rewritten before it's sent to the origin
+type PathRewriteConf struct {
+	StripPrefix string `yaml:"strip_prefix"` // optional, prefix removed from the path
+	AddPrefix   string `yaml:"add_prefix"`   // optional, prefix added to the path
+	Pattern     string `yaml:"pattern"`      // optional, regular expression matched against the path
+	Replacement string `yaml:"replacement"`  // optional, replacement for the pattern, supports $1 style captures
 }
 
 // DefaultHTTPConf returns a HTTP configuration with some defaults
@@ -79,6 +314,47 @@ func (c Conf) IsValid() (bool, string) {
 		return false, reason
 	}
 
+	// the HTTP and HTTPS listeners can't share an address
+	addrs := make(map[string]bool)
+	for _, hc := range []HTTPConf{c.HTTP, c.HTTPS} {
+		ls, err := newListeners(hc, "")
+		if err != nil {
+			return false, err.Error()
+		}
+		for _, l := range ls {
+			if addrs[l.addr] {
+				return false, fmt.Sprintf("address %s is used by more than one listener", l.addr)
+			}
+			addrs[l.addr] = true
+		}
+	}
+
+	// certificates are only used by HTTPS backends
+	if c.HTTP.CertDir != "" {
+		return false, "cert_dir can only be used by the HTTPS server"
+	}
+	if !reflect.DeepEqual(c.HTTP.TLS, TLSConf{}) {
+		return false, "tls can only be used by the HTTPS server"
+	}
+	// without TLS HTTP/2 is only served with h2c
+	if c.HTTP.HTTP2.Disable {
+		return false, "http2.disable can only be used by the HTTPS server, the HTTP server only serves HTTP/2 with h2c"
+	}
+	if c.HTTPS.HTTP2.H2C {
+		return false, "http2.h2c can only be used by the HTTP server"
+	}
+	for _, b := range c.HTTP.Backends {
+		if b.ACME != (ACMEConf{}) {
+			return false, fmt.Sprintf("HTTP backend %s can't use ACME", b.Name)
+		}
+		if b.HSTS != (HSTSConf{}) {
+			return false, fmt.Sprintf("HTTP backend %s can't use HSTS", b.Name)
+		}
+		if b.ClientAuth != "" {
+			return false, fmt.Sprintf("HTTP backend %s can't authenticate the clients with certificates", b.Name)
+		}
+	}
+
 	return true, ""
 }
 
@@ -95,22 +371,605 @@ func (hc HTTPConf) IsValid() (bool, string) {
 		return false, "invalid HTTP/HTTPS port"
 	}
 
+	if hc.CertReloadInterval < 0 {
+		return false, "invalid certificate reload interval"
+	}
+
+	valid, reason := hc.TLS.IsValid()
+	if !valid {
+		return false, fmt.Sprintf("invalid TLS configuration: %s", reason)
+	}
+
+	valid, reason = hc.HTTP2.IsValid()
+	if !valid {
+		return false, fmt.Sprintf("invalid HTTP/2 configuration: %s", reason)
+	}
+
+	valid, reason = hc.ProxyProtocol.IsValid()
+	if !valid {
+		return false, fmt.Sprintf("invalid PROXY protocol configuration: %s", reason)
+	}
+
+	listeners := make(map[string]bool)
+	for _, lc := range hc.Listeners {
+		valid, reason = lc.IsValid()
+		if !valid {
+			return false, reason
+		}
+		if listeners[lc.Name] {
+			return false, fmt.Sprintf("listener %s is defined more than once", lc.Name)
+		}
+		listeners[lc.Name] = true
+	}
+
+	// backends pinned to different listeners can serve the same domain
+	domains := make(map[string]bool)
+	defaults := make(map[string]bool)
 	for _, b := range hc.Backends {
 		bval, reason := b.IsValid()
 		valid = valid && bval
 		if !valid {
 			return false, reason
 		}
+
+		for _, l := range b.Listeners {
+			if !stringInSlice(l, listenerNames(hc)) {
+				return false, fmt.Sprintf("backend %s is pinned to the unknown listener %s", b.Name, l)
+			}
+		}
+
+		for _, l := range backendListeners(hc, b) {
+			for _, d := range append([]string{b.Domain}, b.Aliases...) {
+				d = normalizeHost(d)
+				if domains[l+"/"+d] {
+					return false, fmt.Sprintf("domain %s is handled by more than one backend", d)
+				}
+				domains[l+"/"+d] = true
+			}
+
+			if b.Default {
+				if defaults[l] {
+					return false, "only one default backend is allowed"
+				}
+				defaults[l] = true
+			}
+		}
 	}
 
 	return true, ""
 }
 
+// IsValid checks the validity of a listener config
+func (lc ListenerConf) IsValid() (bool, string) {
+	if lc.Name == "" {
+		return false, "listeners must have a name"
+	}
+	if net.ParseIP(lc.Address) == nil {
+		return false, fmt.Sprintf("invalid address for listener %s", lc.Name)
+	}
+	if lc.Port <= 0 || lc.Port > 65535 {
+		return false, fmt.Sprintf("invalid port for listener %s", lc.Name)
+	}
+
+	if lc.ProxyProtocol != nil {
+		valid, reason := lc.ProxyProtocol.IsValid()
+		if !valid {
+			return false, fmt.Sprintf("invalid PROXY protocol configuration for listener %s: %s", lc.Name, reason)
+		}
+	}
+	return true, ""
+}
+
 // IsValid checks the validity of a backend config
 func (bc BackendConf) IsValid() (bool, string) {
-	valid := bc.Name != "" && bc.Domain != "" && net.ParseIP(bc.IP) != nil
+	valid := bc.Name != "" && bc.Domain != ""
 	if !valid {
 		return false, "invalid HTTP/HTTPS backend"
 	}
+
+	// the origin is specified either by IP, by hostname or by a unix socket/directory URL
+	origins := 0
+	for _, o := range []string{bc.IP, bc.Hostname, bc.Origin} {
+		if o != "" {
+			origins++
+		}
+	}
+	valid = origins == 1
+	valid = valid && (bc.IP == "" || net.ParseIP(bc.IP) != nil)
+	valid = valid && (bc.Hostname == "" || isValidHostname(bc.Hostname))
+	if !valid {
+		return false, fmt.Sprintf("invalid origin for backend %s: exactly one of ip, hostname or origin is required", bc.Name)
+	}
+
+	if bc.Origin != "" {
+		_, _, err := parseOrigin(bc.Origin)
+		if err != nil {
+			return false, fmt.Sprintf("invalid origin for backend %s: %s", bc.Name, err)
+		}
+	}
+
+	valid, reason := bc.S3.IsValid()
+	if !valid {
+		return false, reason
+	}
+
+	for _, idx := range bc.FileOrigin.Index {
+		if idx == "" || strings.Contains(idx, "/") {
+			return false, fmt.Sprintf("invalid index file '%s' for backend %s", idx, bc.Name)
+		}
+	}
+
+	valid, reason = bc.DNS.IsValid()
+	if !valid {
+		return false, reason
+	}
+
+	for _, d := range append([]string{bc.Domain}, bc.Aliases...) {
+		if !isValidDomain(d) {
+			return false, fmt.Sprintf("invalid domain %s for backend %s", d, bc.Name)
+		}
+	}
+
+	valid, reason = bc.Retry.IsValid()
+	if !valid {
+		return false, reason
+	}
+
+	valid, reason = bc.Transport.IsValid()
+	if !valid {
+		return false, reason
+	}
+
+	valid, reason = bc.OriginTLS.IsValid()
+	if !valid {
+		return false, reason
+	}
+
+	valid, reason = bc.PathRewrite.IsValid()
+	if !valid {
+		return false, reason
+	}
+
+	if bc.SliceSize < 0 {
+		return false, fmt.Sprintf("invalid slice size for backend %s", bc.Name)
+	}
+
+	if bc.Upgrade.MaxConnections < 0 || bc.Upgrade.IdleTimeoutMS < 0 {
+		return false, fmt.Sprintf("invalid upgrade configuration for backend %s", bc.Name)
+	}
+
+	if bc.ACME != (ACMEConf{}) {
+		valid, reason = bc.ACME.IsValid()
+		if !valid {
+			return false, fmt.Sprintf("invalid ACME configuration for backend %s: %s", bc.Name, reason)
+		}
+		if bc.CertFile != "" || bc.KeyFile != "" {
+			return false, fmt.Sprintf("backend %s can use either cert and key or ACME", bc.Name)
+		}
+		for _, d := range append([]string{bc.Domain}, bc.Aliases...) {
+			if isWildcardDomain(d) {
+				return false, fmt.Sprintf("wildcard domain %s of backend %s can't use ACME", d, bc.Name)
+			}
+		}
+	}
+
+	valid, reason = bc.HSTS.IsValid()
+	if !valid {
+		return false, fmt.Sprintf("invalid HSTS configuration for backend %s: %s", bc.Name, reason)
+	}
+
+	if bc.ClientAuth != "" && !stringInSlice(bc.ClientAuth, validClientAuthModes) {
+		return false, fmt.Sprintf("invalid client_auth %s for backend %s, it must be one of %s", bc.ClientAuth, bc.Name, strings.Join(validClientAuthModes, ", "))
+	}
+	if bc.ClientAuth == clientAuthVerify && bc.ClientCA == "" {
+		return false, fmt.Sprintf("backend %s needs client_ca to verify the client certificates", bc.Name)
+	}
+	if bc.ClientCA != "" && (bc.ClientAuth == "" || bc.ClientAuth == clientAuthRequire) {
+		return false, fmt.Sprintf("client_ca of backend %s is only used when client_auth is request or verify", bc.Name)
+	}
+
+	valid, reason = bc.Mirror.IsValid()
+	if !valid {
+		return false, fmt.Sprintf("invalid mirror for backend %s: %s", bc.Name, reason)
+	}
+
+	if bc.Canary.Version != "" {
+		valid, reason = bc.Canary.IsValid()
+		if !valid {
+			return false, fmt.Sprintf("invalid canary for backend %s: %s", bc.Name, reason)
+		}
+
+		valid, reason = bc.Canary.backendConf(bc).IsValid()
+		if !valid {
+			return false, fmt.Sprintf("invalid canary for backend %s: %s", bc.Name, reason)
+		}
+	} else if bc.Canary != (CanaryConf{}) {
+		return false, fmt.Sprintf("invalid canary for backend %s: the version is required", bc.Name)
+	}
+
+	if bc.CanonicalHost != "" && (!isValidHostname(bc.CanonicalHost) || net.ParseIP(bc.CanonicalHost) != nil) {
+		return false, fmt.Sprintf("invalid canonical host %s for backend %s", bc.CanonicalHost, bc.Name)
+	}
+
+	for _, r := range bc.Rules {
+		valid, reason = r.IsValid()
+		if !valid {
+			return false, fmt.Sprintf("invalid rule for backend %s: %s", bc.Name, reason)
+		}
+	}
+
+	for _, rules := range [][]HeaderRuleConf{bc.RequestHeaders, bc.ResponseHeaders} {
+		for _, hr := range rules {
+			valid, reason = hr.IsValid()
+			if !valid {
+				return false, fmt.Sprintf("invalid header rule for backend %s: %s", bc.Name, reason)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, r := range bc.Routes {
+		if names[r.Name] {
+			return false, fmt.Sprintf("route %s is defined more than once in backend %s", r.Name, bc.Name)
+		}
+		names[r.Name] = true
+
+		valid, reason = r.IsValid()
+		if !valid {
+			return false, reason
+		}
+
+		// the route inherits the backend configuration, check the result is valid too
+		valid, reason = r.backendConf(bc).IsValid()
+		if !valid {
+			return false, reason
+		}
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a route config
+func (rc RouteConf) IsValid() (bool, string) {
+	if rc.Name == "" || rc.Name == defaultRouteName {
+		return false, fmt.Sprintf("invalid route name '%s'", rc.Name)
+	}
+
+	if !stringInSlice(rc.Match, validRouteMatches) {
+		return false, fmt.Sprintf("invalid match type for route %s", rc.Name)
+	}
+
+	if rc.Match == "regex" {
+		_, err := regexp.Compile(rc.Path)
+		if err != nil {
+			return false, fmt.Sprintf("invalid path regex for route %s: %s", rc.Name, err)
+		}
+	} else if !strings.HasPrefix(rc.Path, "/") {
+		return false, fmt.Sprintf("invalid path for route %s", rc.Name)
+	}
+
+	if rc.IP != "" && net.ParseIP(rc.IP) == nil {
+		return false, fmt.Sprintf("invalid IP for route %s", rc.Name)
+	}
+
+	if (rc.IP != "" && rc.Hostname != "") || (rc.Origin != "" && (rc.IP != "" || rc.Hostname != "")) {
+		return false, fmt.Sprintf("route %s can specify only one of ip, hostname and origin", rc.Name)
+	}
+
+	if rc.Port < 0 || rc.TTL < 0 {
+		return false, fmt.Sprintf("invalid route %s", rc.Name)
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a path rewrite config
+func (pc PathRewriteConf) IsValid() (bool, string) {
+	if pc.StripPrefix != "" && !strings.HasPrefix(pc.StripPrefix, "/") {
+		return false, "invalid path rewrite: strip_prefix must start with /"
+	}
+
+	if pc.AddPrefix != "" && !strings.HasPrefix(pc.AddPrefix, "/") {
+		return false, "invalid path rewrite: add_prefix must start with /"
+	}
+
+	if pc.Pattern == "" && pc.Replacement != "" {
+		return false, "invalid path rewrite: replacement requires a pattern"
+	}
+
+	_, err := newPathRewriter(pc)
+	if err != nil {
+		return false, fmt.Sprintf("invalid path rewrite: %s", err)
+	}
 	return true, ""
 }
+
+// IsValid checks the validity of an origin TLS config
+func (oc OriginTLSConf) IsValid() (bool, string) {
+	if (oc.CertFile == "") != (oc.KeyFile == "") {
+		return false, "invalid origin TLS configuration: both cert and key are required for mutual TLS"
+	}
+
+	if oc.InsecureSkipVerify && (oc.CAFile != "" || oc.ServerName != "") {
+		return false, "invalid origin TLS configuration: ca and server_name have no effect when insecure_skip_verify is set"
+	}
+
+	_, err := newOriginTLSConfig(oc)
+	if err != nil {
+		return false, fmt.Sprintf("invalid origin TLS configuration: %s", err)
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a DNS config
+func (dc DNSConf) IsValid() (bool, string) {
+	if dc.MinRefresh < 0 || dc.MaxRefresh < 0 {
+		return false, "invalid DNS configuration: refresh intervals can't be negative"
+	}
+
+	if dc.MaxRefresh > 0 && dc.MaxRefresh < dc.MinRefresh {
+		return false, "invalid DNS configuration: max_refresh is lower than min_refresh"
+	}
+
+	if dc.Nameserver != "" {
+		host, _, err := net.SplitHostPort(dc.Nameserver)
+		if err != nil || net.ParseIP(host) == nil {
+			return false, "invalid DNS configuration: nameserver must be in the form ip:port"
+		}
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of an S3 config
+func (sc S3Conf) IsValid() (bool, string) {
+	if sc.Endpoint != "" {
+		u, err := url.Parse(sc.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false, fmt.Sprintf("invalid S3 endpoint %s", sc.Endpoint)
+		}
+	}
+
+	if (sc.AccessKeyID == "") != (sc.SecretAccessKey == "") {
+		return false, "invalid S3 configuration: both access_key_id and secret_access_key are required"
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a rewrite or redirect rule
+func (rc RuleConf) IsValid() (bool, string) {
+	_, err := regexp.Compile(rc.Match)
+	if rc.Match == "" || err != nil {
+		return false, fmt.Sprintf("invalid pattern '%s'", rc.Match)
+	}
+
+	if (rc.Rewrite == "") == (rc.Redirect == "") {
+		return false, fmt.Sprintf("rule %s requires either rewrite or redirect", rc.Match)
+	}
+
+	if rc.Rewrite != "" && !strings.HasPrefix(rc.Rewrite, "/") {
+		return false, fmt.Sprintf("rule %s must rewrite to a path starting with /", rc.Match)
+	}
+
+	if rc.Rewrite != "" && rc.Status != 0 {
+		return false, fmt.Sprintf("rule %s rewrites the path, it can't have a status", rc.Match)
+	}
+
+	valid := rc.Status == 0
+	for _, s := range validRedirectStatuses {
+		valid = valid || rc.Status == s
+	}
+	if !valid {
+		return false, fmt.Sprintf("invalid redirect status %d for rule %s", rc.Status, rc.Match)
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a mirror config
+func (mc MirrorConf) IsValid() (bool, string) {
+	if mc.URL == "" {
+		return true, ""
+	}
+
+	u, err := url.Parse(mc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return false, "the url must be made of scheme, host and optional port"
+	}
+
+	if mc.Percent < 0 || mc.Percent > 100 {
+		return false, "the percentage must be between 0 and 100"
+	}
+
+	if mc.QueueSize < 0 || mc.Workers < 0 || mc.TimeoutMS < 0 {
+		return false, "queue_size, workers and timeout_ms can't be negative"
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of an ACME config
+func (ac ACMEConf) IsValid() (bool, string) {
+	u, err := url.Parse(ac.Directory)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return false, "the directory must be the URL of the ACME server"
+	}
+
+	if ac.Challenge != "" && !stringInSlice(ac.Challenge, validACMEChallenges) {
+		return false, fmt.Sprintf("invalid challenge %s", ac.Challenge)
+	}
+
+	if ac.RenewBefore < 0 {
+		return false, "renew_before can't be negative"
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a TLS policy
+func (tc TLSConf) IsValid() (bool, string) {
+	if tc.SessionTicketRotation < 0 {
+		return false, "session_ticket_rotation can't be negative"
+	}
+	if tc.DisableSessionTickets && tc.SessionTicketRotation > 0 {
+		return false, "session_ticket_rotation has no effect when session tickets are disabled"
+	}
+
+	_, err := newServerTLSConfig(tc)
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a HSTS config
+func (hc HSTSConf) IsValid() (bool, string) {
+	if hc.MaxAge < 0 {
+		return false, "max_age can't be negative"
+	}
+	if (hc.IncludeSubdomains || hc.Preload) && hc.MaxAge == 0 {
+		return false, "max_age is required"
+	}
+	// requirements of the browsers' preload lists
+	if hc.Preload && (hc.MaxAge < hstsPreloadMinMaxAge || !hc.IncludeSubdomains) {
+		return false, fmt.Sprintf("preload requires include_subdomains and a max_age of at least %d", hstsPreloadMinMaxAge)
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a canary config
+func (cc CanaryConf) IsValid() (bool, string) {
+	if !canaryVersionRegexp.MatchString(cc.Version) {
+		return false, fmt.Sprintf("invalid version '%s'", cc.Version)
+	}
+
+	origins := 0
+	for _, o := range []string{cc.IP, cc.Hostname, cc.Origin} {
+		if o != "" {
+			origins++
+		}
+	}
+	if origins != 1 {
+		return false, "exactly one of ip, hostname or origin is required"
+	}
+
+	if cc.Weight < 0 || cc.Weight > 100 || cc.Port < 0 {
+		return false, "the weight must be between 0 and 100"
+	}
+
+	for _, name := range []string{cc.Header, cc.Cookie, cc.StickyCookie} {
+		if name != "" && !headerNameRegexp.MatchString(name) {
+			return false, fmt.Sprintf("invalid header or cookie name '%s'", name)
+		}
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a header rule
+func (hc HeaderRuleConf) IsValid() (bool, string) {
+	if !stringInSlice(hc.Action, validHeaderActions) {
+		return false, fmt.Sprintf("invalid action '%s'", hc.Action)
+	}
+
+	if !headerNameRegexp.MatchString(hc.Name) {
+		return false, fmt.Sprintf("invalid header name '%s'", hc.Name)
+	}
+
+	// the Host header is set with origin_host
+	if strings.EqualFold(hc.Name, "Host") {
+		return false, "use origin_host to change the Host header"
+	}
+
+	if hc.Action == headerRemove && hc.Value != "" {
+		return false, fmt.Sprintf("header %s is removed, it can't have a value", hc.Name)
+	}
+
+	if !isValidHeaderValue(hc.Value) {
+		return false, fmt.Sprintf("invalid value for header %s, valid variables are %s", hc.Name, strings.Join(headerVariables, ", "))
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a transport config
+func (tc TransportConf) IsValid() (bool, string) {
+	if tc.ConnectTimeoutMS < 0 || tc.TLSHandshakeTimeoutMS < 0 || tc.ResponseHeaderTimeoutMS < 0 || tc.TimeoutMS < 0 || tc.IdleConnTimeoutMS < 0 {
+		return false, "invalid transport configuration: timeouts can't be negative"
+	}
+
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		return false, "invalid transport configuration: connection limits can't be negative"
+	}
+
+	if tc.HTTP2 != "" && !stringInSlice(tc.HTTP2, validOriginHTTP2) {
+		return false, fmt.Sprintf("invalid transport configuration: http2 must be one of %s", strings.Join(validOriginHTTP2, ", "))
+	}
+
+	if tc.Proxy != "" && tc.Proxy != proxyNone {
+		u, err := url.Parse(tc.Proxy)
+		if err != nil || u.Host == "" || !stringInSlice(u.Scheme, validProxySchemes) {
+			return false, fmt.Sprintf("invalid transport configuration: proxy must be %s or a URL with scheme %s", proxyNone, strings.Join(validProxySchemes, ", "))
+		}
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a HTTP/2 config
+func (hc HTTP2Conf) IsValid() (bool, string) {
+	for _, v := range []int{hc.MaxConcurrentStreams, hc.MaxHeaderTableSize, hc.MaxReceiveBufferPerConnection, hc.MaxReceiveBufferPerStream, hc.PingIntervalMS, hc.PingTimeoutMS} {
+		if v < 0 {
+			return false, "settings can't be negative"
+		}
+	}
+
+	if hc.MaxReadFrameSize != 0 && (hc.MaxReadFrameSize < minHTTP2FrameSize || hc.MaxReadFrameSize > maxHTTP2FrameSize) {
+		return false, fmt.Sprintf("max_read_frame_size must be between %d and %d", minHTTP2FrameSize, maxHTTP2FrameSize)
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a PROXY protocol config
+func (pc ProxyProtocolConf) IsValid() (bool, string) {
+	for _, c := range pc.TrustedCIDRs {
+		_, _, err := net.ParseCIDR(c)
+		if err != nil {
+			return false, fmt.Sprintf("invalid trusted CIDR %s", c)
+		}
+	}
+
+	if pc.HeaderTimeoutMS < 0 {
+		return false, "header_timeout_ms can't be negative"
+	}
+	return true, ""
+}
+
+// IsValid checks the validity of a retry config
+func (rc RetryConf) IsValid() (bool, string) {
+	if rc.Attempts < 0 || rc.BackoffMS < 0 || rc.MaxBackoffMS < 0 || rc.BudgetMinRetries < 0 {
+		return false, "invalid retry configuration"
+	}
+
+	if rc.MaxBackoffMS > 0 && rc.MaxBackoffMS < rc.BackoffMS {
+		return false, "invalid retry configuration: max_backoff_ms is lower than backoff_ms"
+	}
+
+	if rc.BudgetPercent < 0 || rc.BudgetPercent > 100 {
+		return false, "invalid retry configuration: budget_percent must be between 0 and 100"
+	}
+
+	for _, r := range rc.RetryOn {
+		if !stringInSlice(r, validRetryOn) {
+			return false, fmt.Sprintf("invalid retry configuration: unknown error kind %s", r)
+		}
+	}
+
+	for _, sc := range rc.StatusCodes {
+		if sc < 100 || sc > 599 {
+			return false, fmt.Sprintf("invalid retry configuration: invalid status code %d", sc)
+		}
+	}
+	return true, ""
+}
+
+// stringInSlice checks if a string is contained in a slice
+func stringInSlice(s string, ss []string) bool {
+	for _, v := range ss {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -30,6 +30,81 @@ ip: 264.0.0.1
 port: 80
 `
 
+	hostnameBackend := `name: example
+domain: www.example.com
+hostname: origin.example.com
+dns:
+  min_refresh: 5
+  max_refresh: 60
+`
+
+	ipAndHostnameBackend := `name: example
+domain: www.example.com
+ip: 10.0.0.1
+hostname: origin.example.com
+`
+
+	noOriginBackend := `name: example
+domain: www.example.com
+`
+
+	invalidDNSBackend := `name: example
+domain: www.example.com
+hostname: origin.example.com
+dns:
+  min_refresh: 60
+  max_refresh: 5
+`
+
+	socketBackend := `name: example
+domain: www.example.com
+origin: unix:///run/app.sock
+`
+
+	relativeDirBackend := `name: example
+domain: www.example.com
+origin: file://var/www
+`
+
+	ipAndOriginBackend := `name: example
+domain: www.example.com
+ip: 10.0.0.1
+origin: file:///var/www
+`
+
+	s3Backend := `name: example
+domain: www.example.com
+origin: s3://assets/static
+s3:
+  endpoint: http://minio.internal:9000
+  path_style: true
+`
+
+	s3MissingSecretBackend := `name: example
+domain: www.example.com
+origin: s3://assets
+s3:
+  access_key_id: particles
+`
+
+	canaryBackend := `name: example
+domain: www.example.com
+ip: 10.0.0.1
+canary:
+  version: v2
+  ip: 10.0.0.2
+  weight: 5
+  cookie: version
+`
+
+	canaryWithoutVersionBackend := `name: example
+domain: www.example.com
+ip: 10.0.0.1
+canary:
+  ip: 10.0.0.2
+  weight: 5
+`
+
 	tt := []struct {
 		in     string
 		result bool
@@ -39,6 +114,17 @@ port: 80
 		{emptyNameBackend, false, "backend configuration should be invalid because of an empty name"},
 		{emptyDomainBackend, false, "backend configuration should be invalid because of an empty domain"},
 		{invalidIPBackend, false, "backend configuration should be invalid because of an invalid IP"},
+		{hostnameBackend, true, "backend configuration with a hostname should be valid"},
+		{ipAndHostnameBackend, false, "backend configuration should be invalid because both ip and hostname are set"},
+		{noOriginBackend, false, "backend configuration should be invalid because neither ip nor hostname are set"},
+		{invalidDNSBackend, false, "backend configuration should be invalid because max_refresh is lower than min_refresh"},
+		{socketBackend, true, "backend configuration with a unix socket origin should be valid"},
+		{relativeDirBackend, false, "backend configuration should be invalid because the origin path isn't absolute"},
+		{ipAndOriginBackend, false, "backend configuration should be invalid because both ip and origin are set"},
+		{s3Backend, true, "backend configuration with a bucket origin should be valid"},
+		{s3MissingSecretBackend, false, "backend configuration should be invalid because the secret key is missing"},
+		{canaryBackend, true, "backend configuration with a canary should be valid"},
+		{canaryWithoutVersionBackend, false, "backend configuration should be invalid because the canary has no version"},
 	}
 
 	for _, tc := range tt {
@@ -54,3 +140,81 @@ port: 80
 		}
 	}
 }
+
+func TestRetryIsValid(t *testing.T) {
+	tt := []struct {
+		rc     RetryConf
+		result bool
+		errMsg string
+	}{
+		{RetryConf{}, true, "an empty retry configuration should be valid"},
+		{RetryConf{Attempts: 3, BackoffMS: 50, MaxBackoffMS: 500, RetryOn: []string{"connect"}, StatusCodes: []int{503}}, true, "retry configuration should be valid"},
+		{RetryConf{Attempts: -1}, false, "retry configuration should be invalid because of negative attempts"},
+		{RetryConf{Attempts: 3, BackoffMS: 500, MaxBackoffMS: 50}, false, "retry configuration should be invalid because the max backoff is lower than the backoff"},
+		{RetryConf{Attempts: 3, RetryOn: []string{"always"}}, false, "retry configuration should be invalid because of an unknown error kind"},
+		{RetryConf{Attempts: 3, StatusCodes: []int{1000}}, false, "retry configuration should be invalid because of an invalid status code"},
+		{RetryConf{Attempts: 3, BudgetPercent: 150}, false, "retry configuration should be invalid because of a budget over 100%"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.rc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
+
+func TestHTTPConfIsValid(t *testing.T) {
+	tt := []struct {
+		backends []BackendConf
+		result   bool
+		errMsg   string
+	}{
+		{[]BackendConf{
+			{Name: "example", Domain: "www.example.com", Aliases: []string{"example.com"}, IP: "10.0.0.1"},
+			{Name: "wildcard", Domain: "*.example.com", IP: "10.0.0.2", Default: true},
+		}, true, "HTTP configuration with aliases, wildcards and a default backend should be valid"},
+		{[]BackendConf{
+			{Name: "example", Domain: "www.example.com", IP: "10.0.0.1"},
+			{Name: "other", Domain: "example.com", Aliases: []string{"www.example.com"}, IP: "10.0.0.2"},
+		}, false, "HTTP configuration should be invalid because a domain is handled by two backends"},
+		{[]BackendConf{
+			{Name: "example", Domain: "www.example.com", IP: "10.0.0.1", Default: true},
+			{Name: "other", Domain: "www.other.com", IP: "10.0.0.2", Default: true},
+		}, false, "HTTP configuration should be invalid because of two default backends"},
+		{[]BackendConf{
+			{Name: "example", Domain: "www.*.example.com", IP: "10.0.0.1"},
+		}, false, "HTTP configuration should be invalid because the wildcard isn't the leftmost label"},
+	}
+
+	for _, tc := range tt {
+		hc := DefaultHTTPConf()
+		hc.Backends = tc.backends
+		valid, _ := hc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
+
+func TestMirrorIsValid(t *testing.T) {
+	tt := []struct {
+		mc     MirrorConf
+		result bool
+		errMsg string
+	}{
+		{MirrorConf{}, true, "an empty mirror configuration should be valid"},
+		{MirrorConf{URL: "http://10.0.0.2:8080", Percent: 5, QueueSize: 100, Workers: 2}, true, "mirror configuration should be valid"},
+		{MirrorConf{URL: "10.0.0.2:8080", Percent: 5}, false, "mirror configuration should be invalid because the url has no scheme"},
+		{MirrorConf{URL: "http://10.0.0.2/shadow", Percent: 5}, false, "mirror configuration should be invalid because the url has a path"},
+		{MirrorConf{URL: "http://10.0.0.2", Percent: 150}, false, "mirror configuration should be invalid because of a percentage over 100"},
+		{MirrorConf{URL: "http://10.0.0.2", Percent: 5, Workers: -1}, false, "mirror configuration should be invalid because of negative workers"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.mc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package cdn
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsClassINET = 1
+
+	dnsTimeout       = 5 * time.Second
+	dnsMaxUDPPayload = 512
+	resolvConf       = "/etc/resolv.conf"
+	hostsFile        = "/etc/hosts"
+)
+
+var (
+	errDNSNoRecords   = errors.New("no records found")
+	errDNSMalformed   = errors.New("malformed DNS message")
+	errDNSIDMismatch  = errors.New("DNS response doesn't match the query")
+	errDNSNameTooLong = errors.New("DNS name too long")
+
+	// options of resolv.conf that don't change the answers of the stub resolver
+	dnsStubOptions = map[string]bool{"timeout": true, "attempts": true, "edns0": true, "trust-ad": true}
+)
+
+// resolver looks up the addresses of an origin, returning how long the answer can be cached for
+type resolver interface {
+	lookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+	lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+}
+
+// dnsResolver is a minimal stub resolver. The resolver of the standard library doesn't expose the
+// TTL of the records, which we need to know when the addresses of an origin should be refreshed.
+// With the system configuration, the names the stub can't resolve like the other programs on the
+// machine would, because of the hosts file, the search domains or the options, are resolved by the
+// resolver of the standard library, and kept for the minimum refresh
+type dnsResolver struct {
+	nameservers []string
+	timeout     time.Duration
+
+	system    bool
+	hostsFile string
+	ndots     int
+	search    bool
+	options   bool // options the stub doesn't support are set
+}
+
+// newDNSResolver returns a resolver querying the given nameserver, or the ones in /etc/resolv.conf
+func newDNSResolver(nameserver string) *dnsResolver {
+	if nameserver != "" {
+		return &dnsResolver{nameservers: []string{nameserver}, timeout: dnsTimeout}
+	}
+	return newSystemDNSResolver(resolvConf, hostsFile)
+}
+
+// newSystemDNSResolver returns a resolver configured like the system one
+func newSystemDNSResolver(resolvConf, hostsFile string) *dnsResolver {
+	r := &dnsResolver{
+		nameservers: make([]string, 0),
+		timeout:     dnsTimeout,
+		system:      true,
+		hostsFile:   hostsFile,
+		ndots:       1,
+	}
+
+	f, err := os.Open(resolvConf)
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				if net.ParseIP(fields[1]) != nil {
+					r.nameservers = append(r.nameservers, net.JoinHostPort(fields[1], "53"))
+				}
+			case "search", "domain":
+				r.search = true
+			case "options":
+				for _, o := range fields[1:] {
+					if strings.HasPrefix(o, "ndots:") {
+						n, err := strconv.Atoi(strings.TrimPrefix(o, "ndots:"))
+						if err == nil {
+							r.ndots = n
+						}
+						continue
+					}
+					if !dnsStubOptions[strings.SplitN(o, ":", 2)[0]] {
+						r.options = true
+					}
+				}
+			}
+		}
+	}
+
+	if len(r.nameservers) == 0 {
+		r.nameservers = append(r.nameservers, "127.0.0.1:53")
+	}
+	return r
+}
+
+// useSystem tells whether a name has to be resolved by the resolver of the standard library
+func (r *dnsResolver) useSystem(name string) bool {
+	if !r.system {
+		return false
+	}
+	if r.options {
+		return true
+	}
+	// the search domains are tried first for the names with fewer dots than ndots
+	if !strings.HasSuffix(name, ".") && strings.Count(name, ".") < r.ndots {
+		return true
+	}
+	return inHostsFile(r.hostsFile, name)
+}
+
+// searchable tells whether a name not found should be looked up in the search domains
+func (r *dnsResolver) searchable(name string, err error) bool {
+	return r.system && r.search && err == errDNSNoRecords && !strings.HasSuffix(name, ".")
+}
+
+// inHostsFile checks whether a name is in the hosts file
+func inHostsFile(path, name string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	name = strings.TrimSuffix(name, ".")
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		for i := 1; i < len(fields); i++ {
+			if strings.EqualFold(strings.TrimSuffix(fields[i], "."), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// systemLookupIP resolves a host with the resolver of the standard library, which doesn't return the TTL
+func systemLookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, 0, nil
+}
+
+// lookupIP returns the IPv4 and IPv6 addresses of a host
+func (r *dnsResolver) lookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	if r.useSystem(host) {
+		return systemLookupIP(ctx, host)
+	}
+
+	ips := make([]net.IP, 0)
+	var ttl time.Duration
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, a := range answers {
+			if a.rtype != qtype {
+				continue
+			}
+			ips = append(ips, net.IP(a.data))
+			ttl = minTTL(ttl, a.ttl)
+		}
+	}
+
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = errDNSNoRecords
+		}
+		if r.searchable(host, lastErr) {
+			return systemLookupIP(ctx, host)
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+// lookupSRV returns the SRV records for a name, sorted by priority and randomized by weight
+func (r *dnsResolver) lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	if r.useSystem(name) {
+		return systemLookupSRV(ctx, name)
+	}
+
+	answers, err := r.query(ctx, name, dnsTypeSRV)
+	if r.searchable(name, err) {
+		return systemLookupSRV(ctx, name)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	srvs := make([]*net.SRV, 0)
+	var ttl time.Duration
+	for _, a := range answers {
+		if a.rtype != dnsTypeSRV {
+			continue
+		}
+		srvs = append(srvs, a.srv)
+		ttl = minTTL(ttl, a.ttl)
+	}
+
+	if len(srvs) == 0 {
+		return nil, 0, errDNSNoRecords
+	}
+	sortSRV(srvs)
+	return srvs, ttl, nil
+}
+
+// systemLookupSRV resolves a SRV name with the resolver of the standard library, which doesn't
+// return the TTL
+func systemLookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return srvs, 0, nil
+}
+
+// query sends a query to the nameservers in turn until one answers
+func (r *dnsResolver) query(ctx context.Context, name string, qtype uint16) ([]dnsRR, error) {
+	var lastErr error
+	for _, ns := range r.nameservers {
+		answers, err := r.exchange(ctx, ns, name, qtype)
+		if err == nil {
+			return answers, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// exchange sends a query to a nameserver over UDP, falling back to TCP if the answer is truncated
+func (r *dnsResolver) exchange(ctx context.Context, ns, name string, qtype uint16) ([]dnsRR, error) {
+	id := uint16(rand.Intn(1 << 16))
+	q, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	resp, err := r.roundTrip(ctx, "udp", ns, q)
+	if err != nil {
+		return nil, err
+	}
+
+	answers, truncated, err := parseDNSResponse(id, resp)
+	if truncated {
+		resp, err = r.roundTrip(ctx, "tcp", ns, q)
+		if err != nil {
+			return nil, err
+		}
+		answers, _, err = parseDNSResponse(id, resp)
+	}
+	return answers, err
+}
+
+// roundTrip writes a message to the nameserver and reads the response
+func (r *dnsResolver) roundTrip(ctx context.Context, network, ns string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, ns)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		_, err = conn.Write(q)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, dnsMaxUDPPayload)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+
+	// over TCP messages are prefixed by their length
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]byte, 2)
+	_, err = io.ReadFull(conn, l)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l))
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// dnsRR is a resource record found in the answer section of a response
+type dnsRR struct {
+	rtype uint16
+	ttl   time.Duration
+	data  []byte
+	srv   *net.SRV
+}
+
+// buildDNSQuery encodes a recursive query for a name
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(b[4:], 1)      // one question
+
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errDNSNameTooLong
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %s", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-4:], qtype)
+	binary.BigEndian.PutUint16(b[len(b)-2:], dnsClassINET)
+	return b, nil
+}
+
+// parseDNSResponse decodes the answer section of a response
+func parseDNSResponse(id uint16, msg []byte) ([]dnsRR, bool, error) {
+	if len(msg) < 12 {
+		return nil, false, errDNSMalformed
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, false, errDNSIDMismatch
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x0200 != 0 {
+		return nil, true, nil
+	}
+	switch flags & 0x000f {
+	case 0:
+	case 3:
+		return nil, false, errDNSNoRecords
+	default:
+		return nil, false, fmt.Errorf("DNS query failed with rcode %d", flags&0x000f)
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, n, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, false, err
+		}
+		off = n + 4
+	}
+
+	answers := make([]dnsRR, 0, ancount)
+	for i := 0; i < ancount; i++ {
+		_, n, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, false, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, false, errDNSMalformed
+		}
+
+		rr := dnsRR{
+			rtype: binary.BigEndian.Uint16(msg[off:]),
+			ttl:   time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second,
+		}
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, false, errDNSMalformed
+		}
+		rdata := msg[off : off+rdlength]
+
+		switch rr.rtype {
+		case dnsTypeA:
+			if rdlength != net.IPv4len {
+				return nil, false, errDNSMalformed
+			}
+			rr.data = append([]byte(nil), rdata...)
+		case dnsTypeAAAA:
+			if rdlength != net.IPv6len {
+				return nil, false, errDNSMalformed
+			}
+			rr.data = append([]byte(nil), rdata...)
+		case dnsTypeSRV:
+			if rdlength < 7 {
+				return nil, false, errDNSMalformed
+			}
+			target, _, err := readDNSName(msg, off+6)
+			if err != nil {
+				return nil, false, err
+			}
+			rr.srv = &net.SRV{
+				Priority: binary.BigEndian.Uint16(rdata[0:]),
+				Weight:   binary.BigEndian.Uint16(rdata[2:]),
+				Port:     binary.BigEndian.Uint16(rdata[4:]),
+				Target:   target,
+			}
+		}
+
+		answers = append(answers, rr)
+		off += rdlength
+	}
+	return answers, false, nil
+}
+
+// readDNSName decodes a possibly compressed name, returning the offset right after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	labels := make([]string, 0)
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// sortSRV orders the records by priority, shuffling the ones with the same priority by weight
+func sortSRV(srvs []*net.SRV) {
+	// a random key proportional to the weight makes heavier records more likely to come first
+	keys := make(map[*net.SRV]int, len(srvs))
+	for _, s := range srvs {
+		keys[s] = rand.Intn(int(s.Weight) + 1)
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return keys[srvs[i]] > keys[srvs[j]]
+	})
+}
+
+// minTTL returns the lowest TTL, where zero means the TTL hasn't been set yet
+func minTTL(current, ttl time.Duration) time.Duration {
+	if current == 0 || ttl < current {
+		return ttl
+	}
+	return current
+}
@@ -0,0 +1,187 @@
+package cdn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultDNSMinRefresh = 5   // seconds
+	defaultDNSMaxRefresh = 300 // seconds
+)
+
+var (
+	errNoOriginAddresses = errors.New("no addresses found for origin")
+)
+
+// dnsOrigin keeps track of the addresses of an origin specified by hostname. Addresses are
+// refreshed when their TTL expires, and the last known ones are used if the DNS fails
+type dnsOrigin struct {
+	domain     string
+	hostname   string
+	port       int
+	srv        bool
+	minRefresh time.Duration
+	maxRefresh time.Duration
+	resolver   resolver
+	refreshes  singleflight.Group
+
+	mu      sync.Mutex
+	addrs   []string
+	expires time.Time
+	next    int
+}
+
+// newDNSOrigin returns an origin whose addresses are looked up via DNS. When srv is set the
+// hostname is a SRV name and the ports are taken from the records
+func newDNSOrigin(domain, hostname string, port int, dc DNSConf, r resolver) *dnsOrigin {
+	minRefresh := defaultDNSMinRefresh
+	if dc.MinRefresh > 0 {
+		minRefresh = dc.MinRefresh
+	}
+
+	maxRefresh := defaultDNSMaxRefresh
+	if dc.MaxRefresh > 0 {
+		maxRefresh = dc.MaxRefresh
+	}
+
+	return &dnsOrigin{
+		domain:     domain,
+		hostname:   hostname,
+		port:       port,
+		srv:        dc.SRV,
+		minRefresh: time.Duration(minRefresh) * time.Second,
+		maxRefresh: time.Duration(maxRefresh) * time.Second,
+		resolver:   r,
+	}
+}
+
+// addresses returns the host:port addresses of the origin, resolving them again if they've expired
+func (o *dnsOrigin) addresses(ctx context.Context) ([]string, error) {
+	o.mu.Lock()
+	if len(o.addrs) > 0 && time.Now().Before(o.expires) {
+		addrs := o.rotate()
+		o.mu.Unlock()
+		return addrs, nil
+	}
+	o.mu.Unlock()
+
+	// the requests arriving while the addresses are resolved wait for the same resolution
+	_, err, _ := o.refreshes.Do(o.hostname, func() (interface{}, error) {
+		return nil, o.refresh(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.rotate(), nil
+}
+
+// refresh resolves the addresses of the origin, keeping the last known ones if the DNS fails
+func (o *dnsOrigin) refresh(ctx context.Context) error {
+	addrs, ttl, err := o.resolve(ctx)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		if len(o.addrs) == 0 {
+			dnsResolutionsMetric.WithLabelValues(o.domain, "error").Inc()
+			return err
+		}
+
+		// keep using the last known addresses, retrying the resolution after the minimum refresh
+		logrus.Warnf("unable to resolve %s, using last known addresses: %s", o.hostname, err)
+		dnsResolutionsMetric.WithLabelValues(o.domain, "stale").Inc()
+		o.expires = time.Now().Add(o.minRefresh)
+		return nil
+	}
+
+	if ttl < o.minRefresh {
+		ttl = o.minRefresh
+	}
+	if ttl > o.maxRefresh {
+		ttl = o.maxRefresh
+	}
+
+	logrus.Debugf("resolved %s to %v (ttl %s)", o.hostname, addrs, ttl)
+	dnsResolutionsMetric.WithLabelValues(o.domain, "success").Inc()
+	o.addrs = addrs
+	o.expires = time.Now().Add(ttl)
+	return nil
+}
+
+// rotate returns the addresses starting from a different one every time to spread the load.
+// SRV records are already ordered by priority so they're returned as they are.
+// Must be called with the lock held
+func (o *dnsOrigin) rotate() []string {
+	if o.srv {
+		return append([]string(nil), o.addrs...)
+	}
+	o.next = (o.next + 1) % len(o.addrs)
+	return append(append([]string(nil), o.addrs[o.next:]...), o.addrs[:o.next]...)
+}
+
+// resolve looks up the addresses of the origin
+func (o *dnsOrigin) resolve(ctx context.Context) ([]string, time.Duration, error) {
+	if !o.srv {
+		ips, ttl, err := o.resolver.lookupIP(ctx, o.hostname)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(o.port)))
+		}
+		return addrs, ttl, nil
+	}
+
+	srvs, ttl, err := o.resolver.lookupSRV(ctx, o.hostname)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addrs := make([]string, 0, len(srvs))
+	for _, s := range srvs {
+		ips, ipTTL, err := o.resolver.lookupIP(ctx, s.Target)
+		if err != nil {
+			logrus.Debugf("unable to resolve SRV target %s: %s", s.Target, err)
+			continue
+		}
+		ttl = minTTL(ttl, ipTTL)
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(s.Port))))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, 0, errNoOriginAddresses
+	}
+	return addrs, ttl, nil
+}
+
+// dial connects to the first address of the origin accepting the connection
+func (o *dnsOrigin) dial(ctx context.Context, dialer *net.Dialer, network string) (net.Conn, error) {
+	addrs, err := o.addresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,239 @@
+package cdn
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testResolver is a resolver answering from static records
+type testResolver struct {
+	mu   sync.Mutex
+	ips  map[string][]net.IP
+	srvs map[string][]*net.SRV
+	ttl  time.Duration
+	err  error
+
+	lookups int
+	blocked chan struct{} // when set, the lookups wait for it to be closed
+}
+
+func (r *testResolver) lookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	r.lookups++
+	blocked := r.blocked
+	r.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, 0, errDNSNoRecords
+	}
+	return ips, r.ttl, nil
+}
+
+func (r *testResolver) lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return nil, 0, errDNSNoRecords
+	}
+	return srvs, r.ttl, nil
+}
+
+func (r *testResolver) set(ips map[string][]net.IP, err error) {
+	r.mu.Lock()
+	r.ips = ips
+	r.err = err
+	r.mu.Unlock()
+}
+
+func TestDNSOriginRefresh(t *testing.T) {
+	r := &testResolver{ttl: time.Hour}
+	r.set(map[string][]net.IP{"origin.example.com": {net.ParseIP("10.0.0.1")}}, nil)
+
+	o := newDNSOrigin("www.example.com", "origin.example.com", 8080, DNSConf{MinRefresh: 1, MaxRefresh: 1}, r)
+	addrs, err := o.addresses(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.0.0.1:8080" {
+		t.Fatalf("expected [10.0.0.1:8080], received %v", addrs)
+	}
+
+	// addresses are cached until the TTL, capped by max_refresh, expires
+	r.set(map[string][]net.IP{"origin.example.com": {net.ParseIP("10.0.0.2")}}, nil)
+	addrs, _ = o.addresses(context.Background())
+	if addrs[0] != "10.0.0.1:8080" {
+		t.Errorf("addresses shouldn't be refreshed before the TTL expires, received %v", addrs)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	addrs, _ = o.addresses(context.Background())
+	if addrs[0] != "10.0.0.2:8080" {
+		t.Errorf("addresses should be refreshed after max_refresh, received %v", addrs)
+	}
+
+	// the last known addresses are used when the DNS fails
+	r.set(nil, errors.New("SERVFAIL"))
+	time.Sleep(1100 * time.Millisecond)
+	addrs, err = o.addresses(context.Background())
+	if err != nil || addrs[0] != "10.0.0.2:8080" {
+		t.Errorf("the last known addresses should be used when the DNS fails, received %v (%v)", addrs, err)
+	}
+
+	// without any known address the error is returned
+	o = newDNSOrigin("www.example.com", "origin.example.com", 8080, DNSConf{}, r)
+	_, err = o.addresses(context.Background())
+	if err == nil {
+		t.Error("an origin that was never resolved should return an error when the DNS fails")
+	}
+}
+
+func TestDNSOriginConcurrentRefresh(t *testing.T) {
+	r := &testResolver{ttl: time.Hour, blocked: make(chan struct{})}
+	r.set(map[string][]net.IP{"origin.example.com": {net.ParseIP("10.0.0.1")}}, nil)
+	o := newDNSOrigin("www.example.com", "origin.example.com", 8080, DNSConf{}, r)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := o.addresses(context.Background())
+			if err != nil || len(addrs) != 1 {
+				t.Errorf("expected [10.0.0.1:8080], received %v (%v)", addrs, err)
+			}
+		}()
+	}
+
+	// the lock isn't held while resolving
+	time.Sleep(100 * time.Millisecond)
+	o.mu.Lock()
+	o.mu.Unlock()
+
+	close(r.blocked)
+	wg.Wait()
+	if r.lookups != 1 {
+		t.Errorf("concurrent requests should share the same resolution, %d lookups done", r.lookups)
+	}
+}
+
+func TestDNSOriginSRV(t *testing.T) {
+	r := &testResolver{
+		ttl: time.Minute,
+		srvs: map[string][]*net.SRV{"_http._tcp.origin.example.com": {
+			{Target: "a.origin.example.com.", Port: 8081, Priority: 10},
+			{Target: "b.origin.example.com.", Port: 8082, Priority: 20},
+		}},
+	}
+	r.set(map[string][]net.IP{
+		"a.origin.example.com.": {net.ParseIP("10.0.0.1")},
+		"b.origin.example.com.": {net.ParseIP("10.0.0.2")},
+	}, nil)
+
+	o := newDNSOrigin("www.example.com", "_http._tcp.origin.example.com", 80, DNSConf{SRV: true}, r)
+	for i := 0; i < 2; i++ {
+		addrs, err := o.addresses(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 || addrs[0] != "10.0.0.1:8081" || addrs[1] != "10.0.0.2:8082" {
+			t.Errorf("expected the SRV targets in order of priority, received %v", addrs)
+		}
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a nameserver answering A queries with 10.1.2.3 and a TTL of 42 seconds
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q := b[:n]
+			resp := append([]byte(nil), q...)
+			resp[2], resp[3] = 0x81, 0x80
+			if q[n-3] == dnsTypeA {
+				resp[7] = 1
+				resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, dnsClassINET, 0, 0, 0, 42, 0, 4, 10, 1, 2, 3)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	r := newDNSResolver(conn.LocalAddr().String())
+	ips, ttl, err := r.lookupIP(context.Background(), "origin.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.1.2.3")) || ttl != 42*time.Second {
+		t.Errorf("expected [10.1.2.3] with TTL 42s, received %v with TTL %s", ips, ttl)
+	}
+}
+
+func TestDNSResolverSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "particles-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+
+	tt := []struct {
+		resolvConf string
+		hosts      string
+		host       string
+		stub       bool
+		errMsg     string
+	}{
+		{"nameserver 127.0.0.1\n", "", "origin.example.com", true, "fully qualified names should be resolved by the stub"},
+		{"nameserver 127.0.0.1\n", "127.0.0.1 localhost\n", "localhost", false, "names with fewer dots than ndots should be resolved by the system"},
+		{"nameserver 127.0.0.1\noptions ndots:5\n", "", "origin.example.com", false, "ndots should be honored"},
+		{"nameserver 127.0.0.1\noptions edns0\n", "10.0.0.1 origin.example.com\n", "origin.example.com", false, "names in the hosts file should be resolved by the system"},
+		{"nameserver 127.0.0.1\noptions rotate\n", "", "origin.example.com", false, "unsupported options should make the system resolve all names"},
+	}
+
+	for _, tc := range tt {
+		conf := filepath.Join(dir, "resolv.conf")
+		ioutil.WriteFile(conf, []byte(tc.resolvConf), 0644)
+		ioutil.WriteFile(hosts, []byte(tc.hosts), 0644)
+
+		r := newSystemDNSResolver(conf, hosts)
+		if r.useSystem(tc.host) == tc.stub {
+			t.Error(tc.errMsg)
+		}
+	}
+
+	// the system resolver doesn't return the TTL
+	r := newSystemDNSResolver(filepath.Join(dir, "resolv.conf"), hosts)
+	ips, ttl, err := r.lookupIP(context.Background(), "localhost")
+	if err != nil || len(ips) == 0 || !ips[0].IsLoopback() || ttl != 0 {
+		t.Errorf("expected the loopback address without TTL, received %v with TTL %s (%v)", ips, ttl, err)
+	}
+}
@@ -0,0 +1,215 @@
+package cdn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	unixOrigin = "unix"
+	fileOrigin = "file"
+
+	defaultFileCacheControl = "public, max-age=300"
+)
+
+var (
+	defaultIndexFiles = []string{"index.html"}
+
+	errInvalidOriginURL = errors.New("origin must be unix:///path/to/socket, file:///path/to/dir or s3://bucket/prefix")
+)
+
+// parseOrigin returns the type and the path of an origin expressed as URL. The path of a bucket
+// is made of its name followed by the optional key prefix
+func parseOrigin(origin string) (string, string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", "", errInvalidOriginURL
+	}
+
+	if u.Scheme == s3Origin {
+		if u.Host == "" {
+			return "", "", errInvalidOriginURL
+		}
+		return u.Scheme, u.Host + u.Path, nil
+	}
+
+	if (u.Scheme != unixOrigin && u.Scheme != fileOrigin) || u.Host != "" || !path.IsAbs(u.Path) {
+		return "", "", errInvalidOriginURL
+	}
+	return u.Scheme, path.Clean(u.Path), nil
+}
+
+// fileTransport serves the files of a local directory as if they were coming from an origin, so
+// that they go through the same caching and validation as any other response
+type fileTransport struct {
+	root         http.Dir
+	index        []string
+	cacheControl string
+}
+
+// newFileTransport returns a transport serving the files in dir
+func newFileTransport(dir string, fc FileOriginConf) (*fileTransport, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	index := defaultIndexFiles
+	if len(fc.Index) > 0 {
+		index = fc.Index
+	}
+
+	cacheControl := defaultFileCacheControl
+	if fc.CacheControl != "" {
+		cacheControl = fc.CacheControl
+	}
+
+	return &fileTransport{root: http.Dir(dir), index: index, cacheControl: cacheControl}, nil
+}
+
+// RoundTrip serves the file requested
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	rb := &responseBuffer{header: http.Header{}}
+	t.serve(rb, req)
+	return rb.response(req), nil
+}
+
+// serve writes the file, or the index file of the directory, requested. Directories are never listed
+func (t *fileTransport) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + req.URL.Path)
+	f, fi, err := t.open(name)
+	if err != nil {
+		fileError(w, err)
+		return
+	}
+	defer func() {
+		f.Close()
+	}()
+
+	if fi.IsDir() {
+		// relative links in the index file only work if the directory ends with a slash
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			w.Header().Set("Location", path.Base(name)+"/")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
+		idx, idxInfo, err := t.openIndex(name)
+		if err != nil {
+			fileError(w, err)
+			return
+		}
+		f.Close()
+		f, fi = idx, idxInfo
+	}
+
+	w.Header().Set("ETag", fileETag(fi))
+	w.Header().Set("Cache-Control", t.cacheControl)
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+}
+
+// open opens a file under the root directory
+func (t *fileTransport) open(name string) (http.File, os.FileInfo, error) {
+	f, err := t.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// openIndex opens the first index file found in a directory
+func (t *fileTransport) openIndex(dir string) (http.File, os.FileInfo, error) {
+	for _, idx := range t.index {
+		f, fi, err := t.open(path.Join(dir, idx))
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			f.Close()
+			continue
+		}
+		return f, fi, nil
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// fileETag returns a validator based on the modification time and size of a file
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// fileError converts an error opening a file to a response
+func fileError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		code = http.StatusNotFound
+	case os.IsPermission(err):
+		code = http.StatusForbidden
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// responseBuffer is a ResponseWriter keeping the response in memory
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) WriteHeader(code int) {
+	if rb.code == 0 {
+		rb.code = code
+	}
+}
+
+func (rb *responseBuffer) Write(b []byte) (int, error) {
+	rb.WriteHeader(http.StatusOK)
+	return rb.body.Write(b)
+}
+
+// response returns the buffered response as if it was received from an origin
+func (rb *responseBuffer) response(req *http.Request) *http.Response {
+	rb.WriteHeader(http.StatusOK)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rb.code, http.StatusText(rb.code)),
+		StatusCode:    rb.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rb.header,
+		Body:          ioutil.NopCloser(bytes.NewReader(rb.body.Bytes())),
+		ContentLength: int64(rb.body.Len()),
+		Request:       req,
+	}
+}
@@ -0,0 +1,140 @@
+package cdn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "particles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	os.MkdirAll(filepath.Join(dir, "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte("body {}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<html></html>"), 0644)
+
+	ft, err := newFileTransport(dir, FileOriginConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		method      string
+		path        string
+		code        int
+		contentType string
+		location    string
+		errMsg      string
+	}{
+		{"GET", "/style.css", http.StatusOK, "text/css; charset=utf-8", "", "files should be served with their content type"},
+		{"GET", "/docs/", http.StatusOK, "text/html; charset=utf-8", "", "directories should be served with their index file"},
+		{"GET", "/docs", http.StatusMovedPermanently, "", "docs/", "directories without a trailing slash should be redirected"},
+		{"GET", "/empty/", http.StatusNotFound, "", "", "directories without an index file shouldn't be listed"},
+		{"GET", "/missing.css", http.StatusNotFound, "", "", "missing files should return 404"},
+		{"GET", "/../../etc/passwd", http.StatusNotFound, "", "", "files outside the directory shouldn't be served"},
+		{"POST", "/style.css", http.StatusMethodNotAllowed, "", "", "only GET and HEAD should be allowed"},
+	}
+
+	for _, tc := range tt {
+		req, _ := http.NewRequest(tc.method, "http://www.example.com"+tc.path, nil)
+		resp, err := ft.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: expected %d, received %d", tc.errMsg, tc.code, resp.StatusCode)
+		}
+		if tc.contentType != "" && resp.Header.Get("Content-Type") != tc.contentType {
+			t.Errorf("%s: expected content type %s, received %s", tc.errMsg, tc.contentType, resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Location") != tc.location {
+			t.Errorf("%s: expected location '%s', received '%s'", tc.errMsg, tc.location, resp.Header.Get("Location"))
+		}
+	}
+
+	// conditional requests are answered with 304 when the file hasn't changed
+	req, _ := http.NewRequest("GET", "http://www.example.com/style.css", nil)
+	resp, _ := ft.RoundTrip(req)
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Fatal("files should be served with ETag and Last-Modified")
+	}
+
+	req.Header.Set("If-None-Match", etag)
+	resp, _ = ft.RoundTrip(req)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, received %d", resp.StatusCode)
+	}
+}
+
+func TestLocalOrigins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "particles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "logo.png"), []byte("png"), 0644)
+
+	socket := filepath.Join(dir, "origin.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "text/css")
+			fmt.Fprintf(w, "unix%s", r.URL.Path)
+		})},
+	}
+	s.Start()
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{
+		{Name: "unix", Domain: "unix.example.com", Origin: "unix://" + socket},
+		{Name: "file", Domain: "file.example.com", Origin: "file://" + dir},
+	}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		url  string
+		body string
+	}{
+		{"http://unix.example.com/style.css", "unix/style.css"},
+		{"http://file.example.com/logo.png", "png"},
+	}
+
+	for _, tc := range tt {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		if rr.Body.String() != tc.body {
+			t.Errorf("expected '%s' for %s, received '%s'", tc.body, tc.url, rr.Body.String())
+		}
+	}
+
+	// files are cached like any other response
+	time.Sleep(100 * time.Millisecond)
+	_, found, err := cdn.cache.Lookup("http://file.example.com/logo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("files served by a file origin should be cached")
+	}
+}
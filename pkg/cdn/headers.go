@@ -0,0 +1,180 @@
+package cdn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	headerSet    = "set"
+	headerAppend = "append"
+	headerRemove = "remove"
+
+	cacheStatusHit         = "HIT"
+	cacheStatusMiss        = "MISS"
+	cacheStatusRevalidated = "REVALIDATED"
+	cacheStatusBypass      = "BYPASS"
+)
+
+var (
+	validHeaderActions = []string{headerSet, headerAppend, headerRemove}
+	headerVariables    = []string{"client_ip", "request_id", "host", "scheme", "method", "path", "cache_status", "client_cert_subject", "client_cert_fingerprint"}
+
+	headerVariableRegexp = regexp.MustCompile(`\$\{([a-z_]+)\}`)
+	headerNameRegexp     = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+)
+
+// headerVars are the values that can be used in header rules, they're computed once per request
+type headerVars struct {
+	clientIP    string
+	requestID   string
+	host        string
+	scheme      string
+	method      string
+	path        string
+	cacheStatus string
+	// only set when the client certificate was verified by the backend
+	clientCertSubject     string
+	clientCertFingerprint string
+}
+
+// newHeaderVars returns the variables of a client request
+func newHeaderVars(req *http.Request) *headerVars {
+	v := &headerVars{host: req.Host, scheme: "http", method: req.Method, path: req.URL.Path, cacheStatus: cacheStatusMiss}
+	if req.TLS != nil {
+		v.scheme = "https"
+	}
+
+	v.clientIP = req.RemoteAddr
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err == nil {
+		v.clientIP = host
+	}
+	return v
+}
+
+// get returns the value of a variable. The request ID is only generated when used
+func (v *headerVars) get(name string) string {
+	switch name {
+	case "client_ip":
+		return v.clientIP
+	case "request_id":
+		if v.requestID == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			v.requestID = hex.EncodeToString(b)
+		}
+		return v.requestID
+	case "host":
+		return v.host
+	case "scheme":
+		return v.scheme
+	case "method":
+		return v.method
+	case "path":
+		return v.path
+	case "cache_status":
+		return v.cacheStatus
+	case "client_cert_subject":
+		return v.clientCertSubject
+	case "client_cert_fingerprint":
+		return v.clientCertFingerprint
+	}
+	return ""
+}
+
+// expand replaces the variables in a value
+func (v *headerVars) expand(value string) string {
+	return headerVariableRegexp.ReplaceAllStringFunc(value, func(m string) string {
+		return v.get(headerVariableRegexp.FindStringSubmatch(m)[1])
+	})
+}
+
+// headerRule sets, appends to or removes a header
+type headerRule struct {
+	action string
+	name   string
+	value  string
+}
+
+// headerRules are applied in order to the headers of a request or a response
+type headerRules []headerRule
+
+// newHeaderRules returns the rules in the configuration
+func newHeaderRules(hc []HeaderRuleConf) headerRules {
+	hr := make(headerRules, 0, len(hc))
+	for _, h := range hc {
+		hr = append(hr, headerRule{action: h.Action, name: http.CanonicalHeaderKey(h.Name), value: h.Value})
+	}
+	return hr
+}
+
+// apply modifies the headers according to the rules. Appending to an existing header adds the
+// value to the same line separated by a comma, as expected for headers like X-Forwarded-For
+func (hr headerRules) apply(h http.Header, v *headerVars) {
+	for _, r := range hr {
+		switch r.action {
+		case headerSet:
+			h.Set(r.name, v.expand(r.value))
+		case headerAppend:
+			value := v.expand(r.value)
+			if existing := h.Values(r.name); len(existing) > 0 {
+				value = strings.Join(existing, ", ") + ", " + value
+			}
+			h.Set(r.name, value)
+		case headerRemove:
+			h.Del(r.name)
+		}
+	}
+}
+
+// writer returns a ResponseWriter applying the rules, or the original one if there are none
+func (hr headerRules) writer(w http.ResponseWriter, v *headerVars) http.ResponseWriter {
+	if len(hr) == 0 {
+		return w
+	}
+	return &headerRulesWriter{ResponseWriter: w, rules: hr, vars: v}
+}
+
+// headerRulesWriter applies the response header rules right before the response is sent, so that
+// they apply to every response, including errors
+type headerRulesWriter struct {
+	http.ResponseWriter
+	rules       headerRules
+	vars        *headerVars
+	wroteHeader bool
+}
+
+func (hw *headerRulesWriter) WriteHeader(code int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.rules.apply(hw.ResponseWriter.Header(), hw.vars)
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerRulesWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original ResponseWriter, used by http.ResponseController
+func (hw *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// isValidHeaderValue checks that a value only uses known variables
+func isValidHeaderValue(value string) bool {
+	for _, m := range headerVariableRegexp.FindAllStringSubmatch(value, -1) {
+		if !stringInSlice(m[1], headerVariables) {
+			return false
+		}
+	}
+	return !strings.ContainsAny(value, "\r\n")
+}
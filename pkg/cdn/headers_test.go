@@ -0,0 +1,116 @@
+package cdn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderRules(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://www.example.com/index.html", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	vars := newHeaderVars(req)
+
+	hr := newHeaderRules([]HeaderRuleConf{
+		{Action: "append", Name: "x-forwarded-for", Value: "${client_ip}"},
+		{Action: "set", Name: "X-Forwarded-Proto", Value: "${scheme}"},
+		{Action: "set", Name: "Forwarded", Value: "for=${client_ip};host=${host};proto=${scheme}"},
+		{Action: "remove", Name: "X-Powered-By"},
+	})
+
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "192.168.0.1")
+	h.Set("X-Powered-By", "PHP")
+	hr.apply(h, vars)
+
+	tt := []struct {
+		name     string
+		expected string
+	}{
+		{"X-Forwarded-For", "192.168.0.1, 10.0.0.1"},
+		{"X-Forwarded-Proto", "http"},
+		{"Forwarded", "for=10.0.0.1;host=www.example.com;proto=http"},
+		{"X-Powered-By", ""},
+	}
+
+	for _, tc := range tt {
+		if h.Get(tc.name) != tc.expected {
+			t.Errorf("expected %s to be '%s', received '%s'", tc.name, tc.expected, h.Get(tc.name))
+		}
+	}
+
+	// the request ID is the same wherever it's used within a request
+	if vars.expand("${request_id}") == "" || vars.expand("${request_id}") != vars.expand("${request_id}") {
+		t.Error("the request ID should be generated once per request")
+	}
+}
+
+func TestHeaderRulesHandler(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Server", "apache")
+		w.Write([]byte(r.Header.Get("X-Real-IP")))
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:   "example",
+		Domain: "www.example.com",
+		IP:     "127.0.0.1",
+		Port:   listenerPort(t, s),
+		RequestHeaders: []HeaderRuleConf{
+			{Action: "set", Name: "X-Real-IP", Value: "${client_ip}"},
+		},
+		ResponseHeaders: []HeaderRuleConf{
+			{Action: "remove", Name: "Server"},
+			{Action: "set", Name: "X-Cache-Status", Value: "${cache_status}"},
+		},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []string{cacheStatusMiss, cacheStatusHit} {
+		req, _ := http.NewRequest("GET", "http://www.example.com/logo.png", nil)
+		req.RemoteAddr = "10.0.0.1:51234"
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+
+		if rr.Body.String() != "10.0.0.1" {
+			t.Errorf("expected the origin to receive the client IP, received '%s'", rr.Body.String())
+		}
+		if rr.Header().Get("Server") != "" {
+			t.Error("the Server header should be removed from the response")
+		}
+		if rr.Header().Get("X-Cache-Status") != status {
+			t.Errorf("expected cache status %s, received '%s'", status, rr.Header().Get("X-Cache-Status"))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestHeaderRuleIsValid(t *testing.T) {
+	tt := []struct {
+		hc     HeaderRuleConf
+		result bool
+		errMsg string
+	}{
+		{HeaderRuleConf{Action: "set", Name: "X-Request-Id", Value: "${request_id}"}, true, "header rule should be valid"},
+		{HeaderRuleConf{Action: "replace", Name: "X-Request-Id"}, false, "header rule should be invalid because of an unknown action"},
+		{HeaderRuleConf{Action: "set", Name: "X Request", Value: "1"}, false, "header rule should be invalid because of an invalid name"},
+		{HeaderRuleConf{Action: "set", Name: "host", Value: "example.com"}, false, "header rule shouldn't be allowed to set the Host"},
+		{HeaderRuleConf{Action: "remove", Name: "Server", Value: "nginx"}, false, "header rule removing a header shouldn't have a value"},
+		{HeaderRuleConf{Action: "set", Name: "X-User", Value: "${user}"}, false, "header rule should be invalid because of an unknown variable"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.hc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cdn
+
+import (
+	"net"
+	"strings"
+)
+
+// hostTable finds the endpoint serving a host. Exact domains and aliases take precedence over
+// wildcard domains, and the default endpoint, if any, is used when nothing else matches
+type hostTable struct {
+	exact     map[string]endpoint
+	wildcards map[string]endpoint
+	fallback  *endpoint
+}
+
+// newHostTable returns an empty host table
+func newHostTable() *hostTable {
+	return &hostTable{exact: make(map[string]endpoint), wildcards: make(map[string]endpoint)}
+}
+
+// hostTables are the host tables of the listeners, by protocol and listener name. A backend is in
+// the tables of the listeners it's pinned to, or of all the listeners of its server
+type hostTables struct {
+	listeners map[string]map[string]*hostTable
+	canaries  map[string][]*canary
+}
+
+// newHostTables returns empty host tables
+func newHostTables() *hostTables {
+	return &hostTables{listeners: map[string]map[string]*hostTable{"http": {}, "https": {}}, canaries: make(map[string][]*canary)}
+}
+
+// table returns the host table of a listener, creating it if needed
+func (hts *hostTables) table(proto, listener string) *hostTable {
+	ht, ok := hts.listeners[proto][listener]
+	if !ok {
+		ht = newHostTable()
+		hts.listeners[proto][listener] = ht
+	}
+	return ht
+}
+
+// closeIdleConnections closes the idle connections to the origins of all the endpoints
+func (hts *hostTables) closeIdleConnections() {
+	for _, tables := range hts.listeners {
+		for _, ht := range tables {
+			for _, e := range ht.exact {
+				e.closeIdleConnections()
+			}
+			for _, e := range ht.wildcards {
+				e.closeIdleConnections()
+			}
+			if ht.fallback != nil {
+				ht.fallback.closeIdleConnections()
+			}
+		}
+	}
+}
+
+// lookup returns the endpoint serving a host on a listener
+func (hts *hostTables) lookup(proto, listener, host string) (endpoint, bool) {
+	ht, ok := hts.listeners[proto][listener]
+	if !ok {
+		return endpoint{}, false
+	}
+	return ht.lookup(host)
+}
+
+// match returns the endpoint configured for a host on any listener of a protocol, ignoring the
+// default endpoints
+func (hts *hostTables) match(proto, host string) (endpoint, bool) {
+	for _, ht := range hts.listeners[proto] {
+		if e, ok := ht.match(host); ok {
+			return e, true
+		}
+	}
+	return endpoint{}, false
+}
+
+// add registers an endpoint for a domain, which can be a wildcard domain such as *.example.com
+func (ht *hostTable) add(domain string, e endpoint) {
+	domain = normalizeHost(domain)
+	if isWildcardDomain(domain) {
+		ht.wildcards[strings.TrimPrefix(domain, "*")] = e
+		return
+	}
+	ht.exact[domain] = e
+}
+
+// setDefault sets the endpoint used for hosts which aren't configured
+func (ht *hostTable) setDefault(e endpoint) {
+	ht.fallback = &e
+}
+
+// addCanary registers the canary of a domain, which has one canary for HTTP and one for HTTPS when
+// served on both
+func (hts *hostTables) addCanary(domain string, c *canary) {
+	domain = normalizeHost(domain)
+	hts.canaries[domain] = append(hts.canaries[domain], c)
+}
+
+// lookup returns the endpoint serving a host. A wildcard only matches a single label, like in certificates
+func (ht *hostTable) lookup(host string) (endpoint, bool) {
+	if e, ok := ht.match(host); ok {
+		return e, true
+	}
+
+	if ht.fallback != nil {
+		return *ht.fallback, true
+	}
+	return endpoint{}, false
+}
+
+// match returns the endpoint configured for a host, ignoring the default endpoint
+func (ht *hostTable) match(host string) (endpoint, bool) {
+	host = normalizeHost(host)
+	if e, ok := ht.exact[host]; ok {
+		return e, true
+	}
+
+	if i := strings.Index(host, "."); i > 0 {
+		if e, ok := ht.wildcards[host[i:]]; ok {
+			return e, true
+		}
+	}
+	return endpoint{}, false
+}
+
+// normalizeHost lowercases a host and removes the trailing dot of fully qualified names
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// isWildcardDomain checks if the domain is in the form *.example.com
+func isWildcardDomain(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+// isValidDomain checks a domain is either a name or a wildcard on the leftmost label
+func isValidDomain(domain string) bool {
+	name := strings.TrimPrefix(domain, "*.")
+	if name == "" || strings.Contains(name, "*") || strings.ContainsAny(name, " /:") {
+		return false
+	}
+	return !strings.HasPrefix(name, ".") && !strings.Contains(name, "..")
+}
+
+// isValidHostname checks a hostname can be resolved via DNS
+func isValidHostname(hostname string) bool {
+	hostname = strings.TrimSuffix(hostname, ".")
+	if hostname == "" || len(hostname) > 253 || net.ParseIP(hostname) != nil {
+		return false
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) == 0 || len(label) > 63 || strings.ContainsAny(label, " /:*") {
+			return false
+		}
+	}
+	return true
+}
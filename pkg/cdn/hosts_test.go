@@ -0,0 +1,118 @@
+package cdn
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHostTableLookup(t *testing.T) {
+	ht := newHostTable()
+	ht.add("www.example.com", endpoint{Domain: "www.example.com"})
+	ht.add("example.com", endpoint{Domain: "www.example.com"})
+	ht.add("*.example.com", endpoint{Domain: "*.example.com"})
+	ht.add("*.static.example.org", endpoint{Domain: "*.static.example.org"})
+
+	tt := []struct {
+		host   string
+		found  bool
+		domain string
+	}{
+		{"www.example.com", true, "www.example.com"},
+		{"WWW.Example.com.", true, "www.example.com"},
+		{"example.com", true, "www.example.com"},
+		{"img.example.com", true, "*.example.com"},
+		{"a.img.example.com", false, ""},
+		{"cdn.static.example.org", true, "*.static.example.org"},
+		{"static.example.org", false, ""},
+		{"www.unknown.com", false, ""},
+	}
+
+	for _, tc := range tt {
+		e, found := ht.lookup(tc.host)
+		if found != tc.found || e.Domain != tc.domain {
+			t.Errorf("looking up %s, expected (%t, %s), received (%t, %s)", tc.host, tc.found, tc.domain, found, e.Domain)
+		}
+	}
+
+	ht.setDefault(endpoint{Domain: "default"})
+	e, found := ht.lookup("www.unknown.com")
+	if !found || e.Domain != "default" {
+		t.Errorf("an unknown host should be served by the default backend, received (%t, %s)", found, e.Domain)
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1"}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		url  string
+		sni  string
+		code int
+	}{
+		{"http://www.unknown.com/", "", http.StatusNotFound},
+		{"https://www.unknown.com/", "www.unknown.com", http.StatusMisdirectedRequest},
+		{"https://www.example.com/", "www.other.com", http.StatusMisdirectedRequest},
+	}
+
+	for _, tc := range tt {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.sni != "" {
+			req.TLS = &tls.ConnectionState{ServerName: tc.sni}
+		}
+
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("requesting %s with SNI '%s', expected %d, received %d", tc.url, tc.sni, tc.code, rr.Code)
+		}
+	}
+}
+
+func TestCacheKeyHosts(t *testing.T) {
+	// the origin answers with the host requested
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		host, _, _ := net.SplitHostPort(r.Host)
+		w.Write([]byte(host))
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{Name: "example", Domain: "*.example.com", IP: "127.0.0.1", Port: listenerPort(t, s)}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests received by the server only have the path and query in their URL
+	for i := 0; i < 2; i++ {
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			req := httptest.NewRequest("GET", "/logo.png?v=1", nil)
+			req.Host = host
+			rr := httptest.NewRecorder()
+			cdn.httpHandler(rr, req)
+			if rr.Body.String() != host {
+				t.Errorf("the objects of %s should not be served to the other hosts, received '%s'", host, rr.Body.String())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	key := cacheKey(httptest.NewRequest("GET", "/logo.png?v=1", nil), "A.Example.com")
+	if _, found, _ := cdn.cache.Lookup(key); !found || key != "http://a.example.com/logo.png?v=1" {
+		t.Errorf("the objects should be cached with their public URL, received %s", key)
+	}
+}
@@ -0,0 +1,90 @@
+package cdn
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// HTTP/2 to the origins
+	originHTTP2Auto = "auto" // negotiated via ALPN with HTTPS origins
+	originHTTP2Off  = "off"  // always HTTP/1.1
+	originHTTP2H2C  = "h2c"  // always HTTP/2, without TLS for HTTP origins
+
+	minHTTP2FrameSize = 16384
+	maxHTTP2FrameSize = 16777215
+)
+
+var (
+	validOriginHTTP2 = []string{originHTTP2Auto, originHTTP2Off, originHTTP2H2C}
+)
+
+// newHTTP2Config returns the HTTP/2 settings of a listener, the zero values use the defaults of the
+// standard library
+func newHTTP2Config(hc HTTP2Conf) *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          hc.MaxConcurrentStreams,
+		MaxReadFrameSize:              hc.MaxReadFrameSize,
+		MaxDecoderHeaderTableSize:     hc.MaxHeaderTableSize,
+		MaxReceiveBufferPerConnection: hc.MaxReceiveBufferPerConnection,
+		MaxReceiveBufferPerStream:     hc.MaxReceiveBufferPerStream,
+		SendPingTimeout:               time.Duration(hc.PingIntervalMS) * time.Millisecond,
+		PingTimeout:                   time.Duration(hc.PingTimeoutMS) * time.Millisecond,
+	}
+}
+
+// serverProtocols returns the protocols served by a listener. HTTPS listeners negotiate HTTP/2 via
+// ALPN unless disabled, HTTP listeners only serve HTTP/2 to clients with prior knowledge when h2c
+// is enabled
+func serverProtocols(hc HTTP2Conf, secure bool) *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	if secure {
+		p.SetHTTP2(!hc.Disable)
+	} else {
+		p.SetUnencryptedHTTP2(hc.H2C)
+	}
+	return p
+}
+
+// nextProtos returns the protocols offered via ALPN by the HTTPS listener
+func nextProtos(hc HTTP2Conf) []string {
+	if hc.Disable {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// originProtocols returns the protocols used towards the origin of a backend
+func originProtocols(mode string) *http.Protocols {
+	p := &http.Protocols{}
+	switch mode {
+	case originHTTP2Off:
+		p.SetHTTP1(true)
+	case originHTTP2H2C:
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+	}
+	return p
+}
+
+// protocolTransport counts the responses of the origin by protocol
+type protocolTransport struct {
+	domain string
+	next   http.RoundTripper
+}
+
+func (pt *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := pt.next.RoundTrip(req)
+	if err == nil {
+		originProtocolMetric.WithLabelValues(pt.domain, resp.Proto).Inc()
+	}
+	return resp, err
+}
+
+func (pt *protocolTransport) CloseIdleConnections() {
+	closeIdleConnections(pt.next)
+}
@@ -0,0 +1,152 @@
+package cdn
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTP2(t *testing.T) {
+	// the origins answer with the protocol used by the CDN, over TLS or cleartext with h2c
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	tlsOrigin := httptest.NewUnstartedServer(handler)
+	tlsOrigin.EnableHTTP2 = true
+	tlsOrigin.StartTLS()
+	defer tlsOrigin.Close()
+
+	origin := httptest.NewUnstartedServer(handler)
+	origin.Config.Protocols = &http.Protocols{}
+	origin.Config.Protocols.SetHTTP1(true)
+	origin.Config.Protocols.SetUnencryptedHTTP2(true)
+	origin.Start()
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "particles-http2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "example.crt"), filepath.Join(dir, "example.key")
+	writeCertificate(t, testCertificate(t, time.Now().Add(time.Hour), "www.example.com"), certFile, keyFile)
+
+	tt := []struct {
+		secure      bool
+		h2          HTTP2Conf
+		originHTTP2 string
+		clientH2C   bool
+		proto       string
+		originProto string
+		errMsg      string
+	}{
+		{true, HTTP2Conf{}, "", false, "HTTP/2.0", "HTTP/2.0", "HTTP/2 should be negotiated with the client and the origin"},
+		{true, HTTP2Conf{Disable: true}, "off", false, "HTTP/1.1", "HTTP/1.1", "HTTP/1.1 should be used when HTTP/2 is disabled"},
+		{true, HTTP2Conf{MaxConcurrentStreams: 10, MaxReadFrameSize: 32768}, "", false, "HTTP/2.0", "HTTP/2.0", "HTTP/2 should be served with custom settings"},
+		{false, HTTP2Conf{H2C: true}, "h2c", true, "HTTP/2.0", "HTTP/2.0", "h2c should be used with the client and the origin"},
+		{false, HTTP2Conf{H2C: true}, "", false, "HTTP/1.1", "HTTP/1.1", "HTTP/1.1 should still be served with h2c"},
+		{false, HTTP2Conf{}, "", true, "", "", "h2c should not be served by default"},
+	}
+
+	for _, tc := range tt {
+		c := DefaultConf()
+		b := BackendConf{Name: "example", Domain: "www.example.com", IP: "127.0.0.1", Port: listenerPort(t, origin), Transport: TransportConf{HTTP2: tc.originHTTP2}}
+		hc := &c.HTTP
+		if tc.secure {
+			hc = &c.HTTPS
+			b.CertFile, b.KeyFile = certFile, keyFile
+			b.Port = listenerPort(t, tlsOrigin)
+			b.OriginTLS = OriginTLSConf{InsecureSkipVerify: true}
+		}
+		hc.HTTP2 = tc.h2
+		hc.Backends = []BackendConf{b}
+		valid, reason := c.IsValid()
+		if !valid {
+			t.Fatal(reason)
+		}
+		cdn, err := NewCDN(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cdn.httpMux.HandleFunc("/", cdn.httpHandler)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheme := "http"
+		if tc.secure {
+			scheme = "https"
+			go cdn.httpsServer.ServeTLS(ln, "", "")
+		} else {
+			go cdn.httpServer.Serve(ln)
+		}
+
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial(network, ln.Addr().String())
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+			Protocols:         &http.Protocols{},
+		}
+		tr.Protocols.SetHTTP1(!tc.clientH2C)
+		tr.Protocols.SetHTTP2(true)
+		tr.Protocols.SetUnencryptedHTTP2(tc.clientH2C)
+
+		resp, err := (&http.Client{Transport: tr}).Get(scheme + "://www.example.com/")
+		if err != nil {
+			if tc.proto != "" {
+				t.Errorf("%s: %s", tc.errMsg, err)
+			}
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.Proto != tc.proto || string(body) != tc.originProto {
+				t.Errorf("%s: received %s from the CDN and %s from the origin", tc.errMsg, resp.Proto, string(body))
+			}
+		}
+
+		tr.CloseIdleConnections()
+		cdn.Shutdown()
+		ln.Close()
+	}
+}
+
+func TestHTTP2IsValid(t *testing.T) {
+	tt := []struct {
+		hc     HTTP2Conf
+		result bool
+		errMsg string
+	}{
+		{HTTP2Conf{}, true, "an empty HTTP/2 configuration should be valid"},
+		{HTTP2Conf{MaxConcurrentStreams: 100, MaxReadFrameSize: 1 << 20, PingIntervalMS: 15000}, true, "HTTP/2 configuration should be valid"},
+		{HTTP2Conf{MaxReadFrameSize: 1024}, false, "HTTP/2 configuration should be invalid because the frame size is too small"},
+		{HTTP2Conf{MaxConcurrentStreams: -1}, false, "HTTP/2 configuration should be invalid because of negative streams"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.hc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+
+	c := DefaultConf()
+	c.HTTPS.HTTP2.H2C = true
+	if valid, _ := c.IsValid(); valid {
+		t.Error("h2c should be rejected on the HTTPS listener")
+	}
+	c = DefaultConf()
+	c.HTTP.HTTP2.Disable = true
+	if valid, _ := c.IsValid(); valid {
+		t.Error("disabling HTTP/2 should be rejected on the HTTP listener")
+	}
+}
@@ -0,0 +1,123 @@
+package cdn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+
+	"github.com/amartorelli/particles/pkg/util"
+)
+
+const (
+	defaultListenerName = "default"
+)
+
+// listener is an address the HTTP or HTTPS server listens on. The server of a protocol serves all
+// its listeners, and the backends served depend on the listener accepting the connection
+type listener struct {
+	name      string
+	proto     string
+	addr      string
+	reusePort bool
+	proxy     *proxyProtocol
+}
+
+// listenerContextKey stores the listener of a connection in the context of its requests
+type listenerContextKey struct{}
+
+// newListeners returns the listeners of a server. The address and port of the server are used when
+// no listener is configured
+func newListeners(hc HTTPConf, proto string) ([]*listener, error) {
+	lcs := hc.Listeners
+	if len(lcs) == 0 {
+		lcs = []ListenerConf{{Name: defaultListenerName, Address: hc.Address, Port: hc.Port}}
+	}
+
+	ls := make([]*listener, 0, len(lcs))
+	for _, lc := range lcs {
+		pc := hc.ProxyProtocol
+		if lc.ProxyProtocol != nil {
+			pc = *lc.ProxyProtocol
+		}
+		pp, err := newProxyProtocol(pc)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, &listener{name: lc.Name, proto: proto, addr: net.JoinHostPort(lc.Address, strconv.Itoa(lc.Port)), reusePort: hc.ReusePort, proxy: pp})
+	}
+	return ls, nil
+}
+
+// listenerNames returns the names of the listeners of a server
+func listenerNames(hc HTTPConf) []string {
+	if len(hc.Listeners) == 0 {
+		return []string{defaultListenerName}
+	}
+
+	names := make([]string, 0, len(hc.Listeners))
+	for _, lc := range hc.Listeners {
+		names = append(names, lc.Name)
+	}
+	return names
+}
+
+// backendListeners returns the names of the listeners serving a backend, all the listeners of the
+// server unless it's pinned to some of them
+func backendListeners(hc HTTPConf, bc BackendConf) []string {
+	if len(bc.Listeners) > 0 {
+		return bc.Listeners
+	}
+	return listenerNames(hc)
+}
+
+// listen opens the listener, accepting the PROXY protocol if configured. The socket passed by the
+// previous process or by systemd is used if any, it's named after the protocol and the listener,
+// like http-default
+func (l *listener) listen() (net.Listener, error) {
+	ln, err := util.Listen(l.proto+"-"+l.name, l.addr, l.reusePort)
+	if err != nil {
+		return nil, err
+	}
+	return &boundListener{Listener: l.proxy.listener(ln), l: l}, nil
+}
+
+// boundListener marks the connections with the listener accepting them
+type boundListener struct {
+	net.Listener
+	l *listener
+}
+
+func (bl *boundListener) Accept() (net.Conn, error) {
+	conn, err := bl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &boundConn{Conn: conn, l: bl.l}, nil
+}
+
+// boundConn is a connection accepted by a listener
+type boundConn struct {
+	net.Conn
+	l *listener
+}
+
+// connListener returns the listener which accepted a connection, nil if it wasn't accepted by one
+// of the listeners, like in tests
+func connListener(conn net.Conn) *listener {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if bc, ok := conn.(*boundConn); ok {
+		return bc.l
+	}
+	return nil
+}
+
+// withListener stores the listener of a connection in its context, it's used as ConnContext by the servers
+func withListener(ctx context.Context, conn net.Conn) context.Context {
+	if l := connListener(conn); l != nil {
+		return context.WithValue(ctx, listenerContextKey{}, l)
+	}
+	return ctx
+}
@@ -0,0 +1,168 @@
+package cdn
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListeners(t *testing.T) {
+	// the origins answer with the backend sending the request, in a cacheable response
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte(r.Header.Get("X-Backend")))
+	})
+	origin := httptest.NewServer(handler)
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(handler)
+	defer tlsOrigin.Close()
+
+	dir, err := ioutil.TempDir("", "particles-listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "example.crt"), filepath.Join(dir, "example.key")
+	writeCertificate(t, testCertificate(t, time.Now().Add(time.Hour), "www.example.com"), certFile, keyFile)
+
+	backend := func(name, domain string, listeners ...string) BackendConf {
+		return BackendConf{Name: name, Domain: domain, IP: "127.0.0.1", Port: listenerPort(t, origin), Listeners: listeners,
+			RequestHeaders: []HeaderRuleConf{{Action: headerSet, Name: "X-Backend", Value: name}}}
+	}
+	c := DefaultConf()
+	c.HTTP.Listeners = []ListenerConf{{Name: "public", Address: "0.0.0.0", Port: 80}, {Name: "internal", Address: "::1", Port: 8080}}
+	c.HTTP.Backends = []BackendConf{
+		backend("www", "www.example.com"),
+		backend("admin", "admin.example.com", "internal"),
+		backend("status-public", "status.example.com", "public"),
+		backend("status-internal", "status.example.com", "internal"),
+	}
+	secure := backend("secure", "www.example.com")
+	secure.Port, secure.CertFile, secure.KeyFile = listenerPort(t, tlsOrigin), certFile, keyFile
+	secure.OriginTLS = OriginTLSConf{InsecureSkipVerify: true}
+	c.HTTPS.Backends = []BackendConf{secure}
+	valid, reason := c.IsValid()
+	if !valid {
+		t.Fatal(reason)
+	}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		listener string
+		url      string
+		backend  string
+		errMsg   string
+	}{
+		{"public", "http://www.example.com/", "www", "a backend should be served on all the listeners by default"},
+		{"internal", "http://www.example.com/", "www", "a backend should be served on all the listeners by default"},
+		{"internal", "http://admin.example.com/", "admin", "a pinned backend should be served on its listener"},
+		{"public", "http://admin.example.com/", "", "a pinned backend should not be served on the other listeners"},
+		{"public", "http://status.example.com/", "status-public", "a domain should be served by the backend pinned to the listener"},
+		{"internal", "http://status.example.com/", "status-internal", "a domain should be served by the backend pinned to the listener"},
+		{"default", "https://www.example.com/", "secure", "the HTTPS backend should not be replaced by the HTTP one"},
+	}
+
+	// the second time the responses are served from the cache, which mustn't be shared between
+	// the HTTP and HTTPS backends or the backends pinned to different listeners
+	for i := 0; i < 2; i++ {
+		for _, tc := range tt {
+			req := httptest.NewRequest("GET", tc.url, nil)
+			if req.URL.Scheme == "https" {
+				req.TLS = &tls.ConnectionState{ServerName: req.Host}
+			}
+			for _, l := range cdn.listeners {
+				if l.name == tc.listener {
+					req = req.WithContext(context.WithValue(req.Context(), listenerContextKey{}, l))
+				}
+			}
+
+			rr := httptest.NewRecorder()
+			cdn.httpHandler(rr, req)
+			backend := ""
+			if rr.Code == http.StatusOK {
+				backend = rr.Body.String()
+			}
+			if backend != tc.backend {
+				t.Errorf("%s: %s on %s received %d from '%s' (pass %d)", tc.errMsg, tc.url, tc.listener, rr.Code, backend, i+1)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the connections are tagged with the listener accepting them
+	l := cdn.listeners[1]
+	l.addr = "127.0.0.1:0"
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cdn.httpMux.HandleFunc("/", cdn.httpHandler)
+	go cdn.httpServer.Serve(ln)
+	defer cdn.Shutdown()
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	req.Host = "admin.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "admin" {
+		t.Errorf("the backend pinned to the listener should be served, received %d from '%s'", resp.StatusCode, string(body))
+	}
+}
+
+func TestListenersIsValid(t *testing.T) {
+	public := ListenerConf{Name: "public", Address: "0.0.0.0", Port: 8080}
+	internal := ListenerConf{Name: "internal", Address: "::", Port: 8081}
+	www := BackendConf{Name: "www", Domain: "www.example.com", IP: "127.0.0.1"}
+	pinned := func(b BackendConf, name string, listeners ...string) BackendConf {
+		b.Name, b.Listeners = name, listeners
+		return b
+	}
+
+	tt := []struct {
+		listeners []ListenerConf
+		backends  []BackendConf
+		result    bool
+		errMsg    string
+	}{
+		{[]ListenerConf{public, internal}, []BackendConf{www}, true, "listeners should be valid"},
+		{[]ListenerConf{public, public}, []BackendConf{www}, false, "listener names should be unique"},
+		{[]ListenerConf{{Name: "public", Address: "localhost", Port: 8080}}, []BackendConf{www}, false, "listener addresses should be IPs"},
+		{[]ListenerConf{{Address: "0.0.0.0", Port: 8080}}, []BackendConf{www}, false, "listeners should have a name"},
+		{[]ListenerConf{public, internal}, []BackendConf{pinned(www, "www", "private")}, false, "backends should be pinned to existing listeners"},
+		{nil, []BackendConf{pinned(www, "www", defaultListenerName)}, true, "backends should be pinned to the default listener"},
+		{[]ListenerConf{public, internal}, []BackendConf{www, pinned(www, "other", "internal")}, false, "a domain should be served by one backend per listener"},
+		{[]ListenerConf{public, internal}, []BackendConf{pinned(www, "www", "public"), pinned(www, "other", "internal")}, true, "a domain should be served by backends pinned to different listeners"},
+	}
+
+	for _, tc := range tt {
+		c := DefaultConf()
+		c.HTTP.Listeners = tc.listeners
+		c.HTTP.Backends = tc.backends
+		valid, _ := c.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+
+	c := DefaultConf()
+	c.HTTP.Listeners = []ListenerConf{public}
+	c.HTTPS.Listeners = []ListenerConf{{Name: "public", Address: "0.0.0.0", Port: 8080}}
+	if valid, _ := c.IsValid(); valid {
+		t.Error("HTTP and HTTPS listeners should not share an address")
+	}
+}
@@ -9,12 +9,12 @@ var (
 	requestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "particles_requests_total",
 		Help: "Requests received by the CDN",
-	}, []string{"domain", "code", "status"})
+	}, []string{"domain", "route", "code", "status"})
 
 	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "particles_requests_seconds",
 		Help: "Requests duration received by the CDN",
-	}, []string{"domain"})
+	}, []string{"domain", "route"})
 
 	cacheMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "particles_requests_cache_total",
@@ -35,4 +35,100 @@ var (
 		Name: "particles_validation_errors_total",
 		Help: "Number of cache validations needed",
 	}, []string{"domain"})
+
+	retriesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_origin_retries_total",
+		Help: "Number of requests retried towards the origin",
+	}, []string{"domain", "reason"})
+
+	retryBudgetExhaustedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_origin_retry_budget_exhausted_total",
+		Help: "Number of retries not attempted because the retry budget was exhausted",
+	}, []string{"domain"})
+
+	dnsResolutionsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_origin_dns_resolutions_total",
+		Help: "Resolutions of origins specified by hostname",
+	}, []string{"domain", "status"})
+
+	upgradesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_upgrades_total",
+		Help: "Connection upgrades, like WebSockets, requested by clients",
+	}, []string{"domain", "status"})
+
+	upgradedConnectionsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "particles_upgraded_connections",
+		Help: "Upgraded connections currently open",
+	}, []string{"domain"})
+
+	upgradedBytesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_upgraded_bytes_total",
+		Help: "Bytes sent through upgraded connections",
+	}, []string{"domain", "direction"})
+
+	idleTimeoutsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_upgraded_idle_timeouts_total",
+		Help: "Upgraded connections closed because they were idle",
+	}, []string{"domain"})
+
+	mirrorRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_mirror_requests_total",
+		Help: "Requests mirrored to a shadow origin, by outcome compared to the origin",
+	}, []string{"domain", "result"})
+
+	mirrorLatencyMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "particles_mirror_latency_difference_seconds",
+		Help:    "Latency of the shadow origin minus the latency of the origin for mirrored requests",
+		Buckets: []float64{-1, -0.5, -0.25, -0.1, -0.05, -0.01, 0, 0.01, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"domain"})
+
+	canaryRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_canary_requests_total",
+		Help: "Requests of backends with a canary, by version of the origin they're sent to",
+	}, []string{"domain", "version"})
+
+	canaryWeightMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "particles_canary_weight",
+		Help: "Percentage of the clients sent to the canary origin",
+	}, []string{"domain", "version"})
+
+	acmeCertificatesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_acme_certificates_total",
+		Help: "Certificates requested to the ACME server",
+	}, []string{"domain", "status"})
+
+	certExpiryMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "particles_certificate_expiry_timestamp_seconds",
+		Help: "Expiry of the certificates served on the HTTPS listener, as a Unix timestamp",
+	}, []string{"file"})
+
+	certReloadsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_certificate_reloads_total",
+		Help: "Reloads of the certificates served on the HTTPS listener",
+	}, []string{"status"})
+
+	ocspMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_ocsp_responses_total",
+		Help: "OCSP responses fetched to be stapled, by status",
+	}, []string{"status"})
+
+	ticketRotationsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "particles_session_ticket_rotations_total",
+		Help: "Rotations of the session ticket key of the HTTPS listener",
+	})
+
+	requestProtocolMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_requests_protocol_total",
+		Help: "Requests received by the CDN, by HTTP version",
+	}, []string{"domain", "protocol"})
+
+	originProtocolMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_origin_responses_protocol_total",
+		Help: "Responses received from the origins, by HTTP version",
+	}, []string{"domain", "protocol"})
+
+	proxyProtocolMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "particles_proxy_protocol_headers_total",
+		Help: "PROXY protocol headers received from the load balancers, by version",
+	}, []string{"version"})
 )
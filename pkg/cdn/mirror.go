@@ -0,0 +1,175 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMirrorQueueSize = 1000
+	defaultMirrorWorkers   = 10
+	defaultMirrorTimeout   = 5000 // milliseconds
+	mirrorMaxDiscardedBody = 10 << 20
+)
+
+// mirrorRequest is a request waiting to be sent to the shadow origin, with the outcome of the same
+// request sent to the origin
+type mirrorRequest struct {
+	req     *http.Request
+	status  int
+	latency time.Duration
+}
+
+// mirror sends a copy of a percentage of the origin requests of a backend to a shadow origin,
+// discarding the responses. Requests are queued and sent by a bounded number of workers, which are
+// started when needed and stop when the queue is empty, so that the client is never kept waiting
+type mirror struct {
+	domain  string
+	target  *url.URL
+	percent float64
+	timeout time.Duration
+	client  *http.Client
+	queue   chan mirrorRequest
+	workers int64
+	running *int64
+}
+
+// newMirror returns the mirror of a backend, nil if mirroring isn't configured
+func newMirror(domain string, mc MirrorConf, tlsCfg *tls.Config) (*mirror, error) {
+	if mc.URL == "" || mc.Percent <= 0 {
+		return nil, nil
+	}
+
+	u, err := url.Parse(mc.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := defaultMirrorQueueSize
+	if mc.QueueSize > 0 {
+		queueSize = mc.QueueSize
+	}
+
+	workers := defaultMirrorWorkers
+	if mc.Workers > 0 {
+		workers = mc.Workers
+	}
+
+	timeout := defaultMirrorTimeout
+	if mc.TimeoutMS > 0 {
+		timeout = mc.TimeoutMS
+	}
+
+	return &mirror{
+		domain:  domain,
+		target:  u,
+		percent: mc.Percent,
+		timeout: time.Duration(timeout) * time.Millisecond,
+		client: &http.Client{
+			Transport: newTransport(endpoint{}, TransportConf{MaxIdleConnsPerHost: workers}, tlsCfg),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue:   make(chan mirrorRequest, queueSize),
+		workers: int64(workers),
+		running: new(int64),
+	}, nil
+}
+
+// send queues a copy of an origin request, along with the status and latency of its response. The
+// request is dropped when the queue is full
+func (m *mirror) send(r *http.Request, body []byte, status int, latency time.Duration) {
+	if m == nil || rand.Float64()*100 >= m.percent {
+		return
+	}
+
+	u := *r.URL
+	u.Scheme = m.target.Scheme
+	u.Host = m.target.Host
+	mr, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		logrus.Debugf("error creating mirror request: %s", err)
+		mirrorRequestsMetric.WithLabelValues(m.domain, "error").Inc()
+		return
+	}
+	mr.Header = r.Header.Clone()
+	// the shadow origin receives the same Host as the origin
+	mr.Host = r.Host
+	if mr.Host == "" {
+		mr.Host = r.URL.Host
+	}
+
+	select {
+	case m.queue <- mirrorRequest{req: mr, status: status, latency: latency}:
+	default:
+		mirrorRequestsMetric.WithLabelValues(m.domain, "dropped").Inc()
+		return
+	}
+
+	if m.startWorker() {
+		go m.work()
+	}
+}
+
+// startWorker reserves a worker, returning false when all of them are running already
+func (m *mirror) startWorker() bool {
+	if atomic.AddInt64(m.running, 1) > m.workers {
+		atomic.AddInt64(m.running, -1)
+		return false
+	}
+	return true
+}
+
+// work sends the queued requests until the queue is empty
+func (m *mirror) work() {
+	for {
+		select {
+		case mr := <-m.queue:
+			m.do(mr)
+		default:
+			atomic.AddInt64(m.running, -1)
+			// a request could have been queued while stopping, with every worker busy
+			if len(m.queue) == 0 || !m.startWorker() {
+				return
+			}
+		}
+	}
+}
+
+// do sends a request to the shadow origin and compares its response with the origin's one
+func (m *mirror) do(mr mirrorRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := m.client.Do(mr.req.WithContext(ctx))
+	if err != nil {
+		logrus.Debugf("error mirroring request %s: %s", mr.req.URL, err)
+		mirrorRequestsMetric.WithLabelValues(m.domain, "error").Inc()
+		return
+	}
+	// like for the origin, the latency is measured until the headers are received
+	latency := time.Since(start)
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, mirrorMaxDiscardedBody))
+	resp.Body.Close()
+
+	mirrorLatencyMetric.WithLabelValues(m.domain).Observe((latency - mr.latency).Seconds())
+	if resp.StatusCode != mr.status {
+		logrus.Warnf("mirrored request %s %s: origin responded %d in %s, shadow origin %d in %s", mr.req.Method, mr.req.URL.RequestURI(), mr.status, mr.latency, resp.StatusCode, latency)
+		mirrorRequestsMetric.WithLabelValues(m.domain, "mismatch").Inc()
+		return
+	}
+	logrus.Debugf("mirrored request %s %s: origin responded in %s, shadow origin in %s", mr.req.Method, mr.req.URL.RequestURI(), mr.latency, latency)
+	mirrorRequestsMetric.WithLabelValues(m.domain, "match").Inc()
+}
@@ -0,0 +1,67 @@
+package cdn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	type mirrored struct {
+		host string
+		path string
+		body string
+	}
+	received := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- mirrored{host: r.Host, path: r.URL.Path, body: string(b)}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:   "example",
+		Domain: "www.example.com",
+		IP:     "127.0.0.1",
+		Port:   listenerPort(t, origin),
+		Mirror: MirrorConf{URL: shadow.URL, Percent: 100},
+		Routes: []RouteConf{{Name: "api", Match: "prefix", Path: "/api/", NoCache: true}},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://www.example.com/api/orders", strings.NewReader("order"))
+	rr := httptest.NewRecorder()
+	cdn.httpHandler(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "origin" {
+		t.Errorf("the client should receive the response of the origin, received %d %s", rr.Code, rr.Body.String())
+	}
+
+	select {
+	case m := <-received:
+		if !strings.HasPrefix(m.host, "www.example.com") || m.path != "/api/orders" || m.body != "order" {
+			t.Errorf("unexpected mirrored request: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the request wasn't mirrored")
+	}
+
+	// requests aren't mirrored when the percentage is 0
+	m, err := newMirror("www.example.com", MirrorConf{URL: shadow.URL}, nil)
+	if err != nil || m != nil {
+		t.Error("mirroring should be disabled when the percentage is 0")
+	}
+}
@@ -0,0 +1,224 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspCheckInterval   = 60   // seconds between the checks for staples to refresh
+	ocspRetryInterval   = 300  // seconds before retrying a failed fetch
+	ocspDefaultValidity = 3600 // seconds, refresh interval of the responses without next update
+	ocspTimeout         = 10   // seconds
+	ocspMaxResponseSize = 1 << 20
+)
+
+var (
+	errOCSPRevoked = errors.New("the certificate has been revoked")
+)
+
+// ocspStaple is an OCSP response stapled to the handshakes
+type ocspStaple struct {
+	raw        []byte
+	nextUpdate time.Time
+	refreshAt  time.Time
+}
+
+// ocspStapler fetches periodically the OCSP responses of the certificates from their responders, so
+// that the clients don't need to check the revocation themselves
+type ocspStapler struct {
+	client   *http.Client
+	certs    func() []*certEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu      sync.RWMutex
+	staples map[*tls.Certificate]*ocspStaple
+}
+
+// newOCSPStapler returns the stapler of the certificates returned by certs, nil if stapling is disabled
+func newOCSPStapler(tc TLSConf, certs func() []*certEntry) *ocspStapler {
+	if !tc.OCSPStapling {
+		return nil
+	}
+	return &ocspStapler{
+		client:  &http.Client{Timeout: ocspTimeout * time.Second},
+		certs:   certs,
+		stop:    make(chan struct{}),
+		staples: make(map[*tls.Certificate]*ocspStaple),
+	}
+}
+
+// staple returns the certificate with its OCSP response, if there's a valid one
+func (s *ocspStapler) staple(cert *tls.Certificate) *tls.Certificate {
+	if s == nil || cert == nil {
+		return cert
+	}
+
+	s.mu.RLock()
+	st, ok := s.staples[cert]
+	s.mu.RUnlock()
+	if !ok || (!st.nextUpdate.IsZero() && time.Now().After(st.nextUpdate)) {
+		return cert
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = st.raw
+	return &stapled
+}
+
+// start refreshes the staples until stopped
+func (s *ocspStapler) start() {
+	if s == nil {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(ocspCheckInterval * time.Second)
+		defer t.Stop()
+		for {
+			s.refresh()
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// shutdown stops refreshing the staples
+func (s *ocspStapler) shutdown() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// refresh fetches the responses of the certificates without a staple or with one halfway through its
+// validity, and forgets the certificates not served anymore
+func (s *ocspStapler) refresh() {
+	now := time.Now()
+	current := make(map[*tls.Certificate]bool)
+	for _, e := range s.certs() {
+		current[e.cert] = true
+		if len(e.cert.Leaf.OCSPServer) == 0 || len(e.cert.Certificate) < 2 {
+			continue
+		}
+
+		s.mu.RLock()
+		st, ok := s.staples[e.cert]
+		s.mu.RUnlock()
+		if ok && now.Before(st.refreshAt) {
+			continue
+		}
+
+		fetched, err := s.fetch(e.cert)
+		if err != nil {
+			logrus.Errorf("error fetching the OCSP response for %s: %s", e.name, err)
+			status := "error"
+			if err == errOCSPRevoked {
+				status = "revoked"
+			}
+			ocspMetric.WithLabelValues(status).Inc()
+
+			// the previous response is stapled until it expires
+			if !ok {
+				st = &ocspStaple{}
+			}
+			fetched = &ocspStaple{raw: st.raw, nextUpdate: st.nextUpdate, refreshAt: now.Add(ocspRetryInterval * time.Second)}
+			if err == errOCSPRevoked {
+				fetched.raw = nil
+			}
+		} else {
+			ocspMetric.WithLabelValues("success").Inc()
+		}
+
+		s.mu.Lock()
+		s.staples[e.cert] = fetched
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	for c := range s.staples {
+		if !current[c] {
+			delete(s.staples, c)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// fetch asks the responder the status of a certificate and verifies the response
+func (s *ocspStapler) fetch(cert *tls.Certificate) (*ocspStaple, error) {
+	leaf := cert.Leaf
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, leaf.OCSPServer[0])
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is checked against the issuer, or against a responder certificate signed by it
+	r, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if r.Certificate != nil && !r.Certificate.Equal(issuer) && !hasExtKeyUsage(r.Certificate, x509.ExtKeyUsageOCSPSigning) {
+		return nil, fmt.Errorf("the OCSP responder isn't authorized by the issuer")
+	}
+	switch r.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return nil, errOCSPRevoked
+	default:
+		return nil, fmt.Errorf("the status of the certificate is unknown to the responder")
+	}
+	if time.Now().Before(r.ThisUpdate.Add(-time.Hour)) || (!r.NextUpdate.IsZero() && time.Now().After(r.NextUpdate)) {
+		return nil, fmt.Errorf("the OCSP response isn't current")
+	}
+
+	st := &ocspStaple{raw: raw, nextUpdate: r.NextUpdate}
+	if r.NextUpdate.IsZero() {
+		st.refreshAt = time.Now().Add(ocspDefaultValidity * time.Second)
+	} else {
+		st.refreshAt = r.ThisUpdate.Add(r.NextUpdate.Sub(r.ThisUpdate) / 2)
+	}
+	return st, nil
+}
+
+// hasExtKeyUsage checks whether a certificate can be used for a purpose
+func hasExtKeyUsage(c *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range c.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
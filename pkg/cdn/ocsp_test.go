@@ -0,0 +1,179 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// fakeOCSPResponder answers with the status set for the certificates, signed by the CA
+type fakeOCSPResponder struct {
+	*httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu      sync.Mutex
+	status  string // good, revoked or down
+	tamper  bool
+	fetches int
+}
+
+func newFakeOCSPResponder(t *testing.T) *fakeOCSPResponder {
+	r := &fakeOCSPResponder{status: "good"}
+	r.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake OCSP CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &r.caKey.PublicKey, r.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.caCert, _ = x509.ParseCertificate(der)
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+func (r *fakeOCSPResponder) handle(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetches++
+	if r.status == "down" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	or, err := ocsp.ParseRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: or.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if r.status == "revoked" {
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = now.Add(-time.Minute)
+	}
+	raw, _ := ocsp.CreateResponse(r.caCert, r.caCert, tmpl, r.caKey)
+	if r.tamper {
+		// the signature is the last element of the response
+		raw[len(raw)-1]++
+	}
+	w.Write(raw)
+}
+
+// issue returns a certificate signed by the CA, pointing to the responder
+func (r *fakeOCSPResponder) issue(t *testing.T) *tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{r.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, r.caCert, &key.PublicKey, r.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der, r.caCert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+func (r *fakeOCSPResponder) set(status string, tamper bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+	r.tamper = tamper
+}
+
+func TestOCSPStapling(t *testing.T) {
+	r := newFakeOCSPResponder(t)
+	defer r.Close()
+
+	cert := r.issue(t)
+	entries := []*certEntry{{name: "example", cert: cert}}
+	s := newOCSPStapler(TLSConf{OCSPStapling: true}, func() []*certEntry { return entries })
+
+	tt := []struct {
+		status  string
+		tamper  bool
+		stapled bool
+		errMsg  string
+	}{
+		{"good", true, false, "a response with an invalid signature should not be stapled"},
+		{"good", false, true, "a good response should be stapled"},
+		{"down", false, true, "the previous response should be stapled while the responder is down"},
+		{"revoked", false, false, "a revoked certificate should not be stapled"},
+	}
+
+	var staple []byte
+	for _, tc := range tt {
+		r.set(tc.status, tc.tamper)
+		// every refresh contacts the responder
+		for c := range s.staples {
+			s.staples[c].refreshAt = time.Time{}
+		}
+		s.refresh()
+
+		stapled := s.staple(cert).OCSPStaple
+		if (len(stapled) > 0) != tc.stapled {
+			t.Error(tc.errMsg)
+		}
+		if tc.status == "good" && tc.stapled {
+			staple = stapled
+		}
+		if tc.status == "down" && !bytes.Equal(stapled, staple) {
+			t.Error("the previous response should be kept")
+		}
+	}
+
+	// responses are only fetched again halfway through their validity
+	r.set("good", false)
+	for c := range s.staples {
+		s.staples[c].refreshAt = time.Time{}
+	}
+	s.refresh()
+	fetches := r.fetches
+	s.refresh()
+	if r.fetches != fetches {
+		t.Error("a current response should not be fetched again")
+	}
+
+	// certificates not served anymore are forgotten
+	entries = nil
+	s.refresh()
+	if len(s.staples) != 0 {
+		t.Error("the staples of the removed certificates should be dropped")
+	}
+
+	if newOCSPStapler(TLSConf{}, nil).staple(cert) != cert {
+		t.Error("certificates should not be changed when stapling is disabled")
+	}
+}
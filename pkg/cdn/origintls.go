@@ -0,0 +1,73 @@
+package cdn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	errInvalidCABundle = errors.New("no valid certificates found in the CA bundle")
+)
+
+// newOriginTLSConfig returns the TLS configuration used to connect to a backend's origin.
+// A nil configuration is returned when the defaults should be used
+func newOriginTLSConfig(oc OriginTLSConf) (*tls.Config, error) {
+	if oc == (OriginTLSConf{}) {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         oc.ServerName,
+		InsecureSkipVerify: oc.InsecureSkipVerify,
+	}
+
+	if oc.MinVersion != "" {
+		v, ok := tlsVersions[oc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %s", oc.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if oc.CAFile != "" {
+		pool, err := loadCAPool(oc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if oc.CertFile != "" || oc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(oc.CertFile, oc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// loadCAPool reads a PEM bundle of CA certificates
+func loadCAPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errInvalidCABundle
+	}
+	return pool, nil
+}
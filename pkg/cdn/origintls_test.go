@@ -0,0 +1,110 @@
+package cdn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOriginTLS(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client-Cert", "present")
+		}
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "particles-origin-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the test server certificate is self signed and valid for example.com
+	caFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, s.TLS.Certificates[0], caFile, keyFile)
+
+	tt := []struct {
+		oc         OriginTLSConf
+		success    bool
+		clientCert bool
+		errMsg     string
+	}{
+		{OriginTLSConf{}, false, false, "an origin signed by an unknown CA should be rejected"},
+		{OriginTLSConf{CAFile: caFile}, false, false, "an origin whose certificate doesn't match the domain should be rejected"},
+		{OriginTLSConf{CAFile: caFile, ServerName: "example.com"}, true, false, "an origin signed by the configured CA should be accepted"},
+		{OriginTLSConf{InsecureSkipVerify: true}, true, false, "the origin certificate should not be verified with insecure_skip_verify"},
+		{OriginTLSConf{CAFile: caFile, ServerName: "example.com", CertFile: caFile, KeyFile: keyFile}, true, true, "the client certificate should be sent to the origin"},
+	}
+
+	for _, tc := range tt {
+		e, err := newEndpoint(BackendConf{IP: "127.0.0.1", Port: listenerPort(t, s), OriginTLS: tc.oc}, "https", 443)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := e.client.Get("https://www.secure-example.com/")
+		if (err == nil) != tc.success {
+			t.Errorf("%s: %v", tc.errMsg, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if (resp.Header.Get("X-Client-Cert") != "") != tc.clientCert {
+			t.Error(tc.errMsg)
+		}
+	}
+}
+
+func TestOriginTLSIsValid(t *testing.T) {
+	tt := []struct {
+		oc     OriginTLSConf
+		result bool
+		errMsg string
+	}{
+		{OriginTLSConf{}, true, "an empty origin TLS configuration should be valid"},
+		{OriginTLSConf{ServerName: "origin.internal", MinVersion: "1.2"}, true, "origin TLS configuration should be valid"},
+		{OriginTLSConf{MinVersion: "2.0"}, false, "origin TLS configuration should be invalid because of an unknown TLS version"},
+		{OriginTLSConf{CAFile: "/nonexistent/ca.pem"}, false, "origin TLS configuration should be invalid because the CA bundle doesn't exist"},
+		{OriginTLSConf{CertFile: "/tmp/cert.pem"}, false, "origin TLS configuration should be invalid because the key is missing"},
+		{OriginTLSConf{ServerName: "origin.internal", InsecureSkipVerify: true}, false, "origin TLS configuration should be invalid because verification settings conflict"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.oc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
+
+// writeCertificate stores a certificate and its key as PEM files
+func writeCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	err := ioutil.WriteFile(certFile, certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,61 @@
+package cdn
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pathRewriter rewrites the path of a request before it's sent to the origin
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newPathRewriter returns a path rewriter, or nil if the configuration doesn't rewrite anything
+func newPathRewriter(pc PathRewriteConf) (*pathRewriter, error) {
+	if pc == (PathRewriteConf{}) {
+		return nil, nil
+	}
+
+	pr := &pathRewriter{
+		stripPrefix: strings.TrimSuffix(pc.StripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(pc.AddPrefix, "/"),
+		replacement: pc.Replacement,
+	}
+
+	if pc.Pattern != "" {
+		re, err := regexp.Compile(pc.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		pr.pattern = re
+	}
+	return pr, nil
+}
+
+// rewrite returns the path to request to the origin. The prefix is stripped first, then the
+// regular expression is applied and finally the new prefix is added
+func (pr *pathRewriter) rewrite(path string) string {
+	if pr == nil {
+		return path
+	}
+
+	if pr.stripPrefix != "" && (path == pr.stripPrefix || strings.HasPrefix(path, pr.stripPrefix+"/")) {
+		path = strings.TrimPrefix(path, pr.stripPrefix)
+	}
+
+	if pr.pattern != nil {
+		path = pr.pattern.ReplaceAllString(path, pr.replacement)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if pr.addPrefix != "" {
+		path = pr.addPrefix + path
+	}
+	return path
+}
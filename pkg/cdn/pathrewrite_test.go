@@ -0,0 +1,33 @@
+package cdn
+
+import "testing"
+
+func TestPathRewrite(t *testing.T) {
+	tt := []struct {
+		pc       PathRewriteConf
+		path     string
+		expected string
+	}{
+		{PathRewriteConf{}, "/style.css", "/style.css"},
+		{PathRewriteConf{AddPrefix: "/static/v2"}, "/style.css", "/static/v2/style.css"},
+		{PathRewriteConf{AddPrefix: "/static/v2/"}, "/", "/static/v2/"},
+		{PathRewriteConf{StripPrefix: "/assets"}, "/assets/style.css", "/style.css"},
+		{PathRewriteConf{StripPrefix: "/assets"}, "/assets", "/"},
+		{PathRewriteConf{StripPrefix: "/assets"}, "/assetsfoo/style.css", "/assetsfoo/style.css"},
+		{PathRewriteConf{StripPrefix: "/assets", AddPrefix: "/static/v2"}, "/assets/img/logo.png", "/static/v2/img/logo.png"},
+		{PathRewriteConf{Pattern: "^/v1/(.*)$", Replacement: "/v2/$1"}, "/v1/app.js", "/v2/app.js"},
+		{PathRewriteConf{Pattern: "^/v1/(.*)$", Replacement: "/v2/$1"}, "/v3/app.js", "/v3/app.js"},
+	}
+
+	for _, tc := range tt {
+		pr, err := newPathRewriter(tc.pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := pr.rewrite(tc.path)
+		if p != tc.expected {
+			t.Errorf("rewriting %s with %+v, expected %s, received %s", tc.path, tc.pc, tc.expected, p)
+		}
+	}
+}
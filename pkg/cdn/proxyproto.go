@@ -0,0 +1,274 @@
+package cdn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProxyHeaderTimeout = 5000 // milliseconds
+
+	proxyV1MaxLength = 107 // bytes, including CRLF
+	proxyV2Version   = 0x2
+	proxyV2Local     = 0x0
+	proxyV2Proxy     = 0x1
+	proxyV2TCP4      = 0x11
+	proxyV2TCP6      = 0x21
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeaderMissing = errors.New("missing PROXY protocol header")
+	errProxyHeaderInvalid = errors.New("invalid PROXY protocol header")
+)
+
+// proxyProtocol accepts the PROXY protocol on a listener, from the trusted load balancers only
+type proxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// newProxyProtocol returns the PROXY protocol settings of a listener, nil if it's disabled
+func newProxyProtocol(pc ProxyProtocolConf) (*proxyProtocol, error) {
+	if len(pc.TrustedCIDRs) == 0 {
+		return nil, nil
+	}
+
+	pp := &proxyProtocol{timeout: defaultProxyHeaderTimeout * time.Millisecond}
+	if pc.HeaderTimeoutMS > 0 {
+		pp.timeout = time.Duration(pc.HeaderTimeoutMS) * time.Millisecond
+	}
+	for _, c := range pc.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		pp.trusted = append(pp.trusted, n)
+	}
+	return pp, nil
+}
+
+// listener wraps a listener so that the connections of the trusted sources report the address of
+// the client sent in the PROXY protocol header
+func (pp *proxyProtocol) listener(ln net.Listener) net.Listener {
+	if pp == nil {
+		return ln
+	}
+	return &proxyListener{Listener: ln, pp: pp}
+}
+
+// trusts checks if a connection comes from a trusted load balancer
+func (pp *proxyProtocol) trusts(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range pp.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener is a listener accepting the PROXY protocol
+type proxyListener struct {
+	net.Listener
+	pp *proxyProtocol
+}
+
+// Accept returns the connections of the trusted sources wrapped, the header is read later by the
+// goroutine serving the connection so that slow clients don't block the listener
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil || !pl.pp.trusts(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: pl.pp.timeout}, nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol header, which is required
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	source net.Addr
+	dest   net.Addr
+}
+
+// readHeader reads the header once, before anything else is read. The connection is closed if the
+// header is missing or invalid
+func (pc *proxyConn) readHeader() error {
+	pc.once.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(pc.timeout))
+		var version string
+		pc.source, pc.dest, version, pc.err = parseProxyHeader(pc.r)
+		pc.Conn.SetReadDeadline(time.Time{})
+
+		if pc.err != nil {
+			logrus.Errorf("error reading the PROXY protocol header from %s: %s", pc.Conn.RemoteAddr(), pc.err)
+			proxyProtocolMetric.WithLabelValues("error").Inc()
+			pc.Conn.Close()
+			return
+		}
+		proxyProtocolMetric.WithLabelValues(version).Inc()
+	})
+	return pc.err
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	err := pc.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	return pc.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client, or the one of the load balancer for health checks
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.source != nil {
+		return pc.source
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.readHeader()
+	if pc.dest != nil {
+		return pc.dest
+	}
+	return pc.Conn.LocalAddr()
+}
+
+// parseProxyHeader reads a v1 or v2 header. The addresses are nil when the load balancer doesn't
+// proxy a client, like for its health checks
+func parseProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, "", errProxyHeaderMissing
+	}
+
+	switch b[0] {
+	case proxyV1Signature[0]:
+		src, dst, err := parseProxyV1(r)
+		return src, dst, "v1", err
+	case proxyV2Signature[0]:
+		src, dst, err := parseProxyV2(r)
+		return src, dst, "v2", err
+	}
+	return nil, nil, "", errProxyHeaderMissing
+}
+
+// parseProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 51234 443\r\n"
+func parseProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, errProxyHeaderInvalid
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLength {
+			return nil, nil, errProxyHeaderInvalid
+		}
+	}
+
+	if !bytes.HasPrefix(line, proxyV1Signature) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	fields := strings.Split(string(line[len(proxyV1Signature):len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, errProxyHeaderInvalid
+	}
+
+	src, err := proxyV1Address(fields[1], fields[3], fields[0] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyV1Address(fields[2], fields[4], fields[0] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// proxyV1Address parses an address of a v1 header, which must match the protocol
+func proxyV1Address(ip, port string, v4 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != v4 {
+		return nil, errProxyHeaderInvalid
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errProxyHeaderInvalid
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// parseProxyV2 reads a binary header. Only TCP over IPv4 and IPv6 is proxied, the TLVs are ignored
+func parseProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil || !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	if hdr[12]>>4 != proxyV2Version {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, nil, errProxyHeaderInvalid
+	}
+
+	switch hdr[12] & 0xf {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, errProxyHeaderInvalid
+	}
+
+	size := 0
+	switch hdr[13] {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// other families like UDP or unix sockets keep the address of the load balancer
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errProxyHeaderInvalid
+	}
+
+	src := &net.TCPAddr{IP: net.IP(payload[:size]), Port: int(binary.BigEndian.Uint16(payload[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(payload[size : 2*size]), Port: int(binary.BigEndian.Uint16(payload[2*size+2:]))}
+	return src, dst, nil
+}
@@ -0,0 +1,144 @@
+package cdn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a binary header proxying a TCP connection
+func proxyV2Header(command byte, src, dst *net.TCPAddr) []byte {
+	family := byte(proxyV2TCP4)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family = proxyV2TCP6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	payload := append(append([]byte{}, srcIP...), dstIP...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(src.Port))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(dst.Port))
+	// a TLV, which is ignored
+	payload = append(payload, 0x04, 0x00, 0x01, 0x00)
+
+	hdr := append(append([]byte{}, proxyV2Signature...), proxyV2Version<<4|command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(payload)))
+	return append(hdr, payload...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	client4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 51234}
+	server4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 443}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+	server6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	tt := []struct {
+		header  []byte
+		source  string
+		version string
+		valid   bool
+		errMsg  string
+	}{
+		{[]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\r\n"), "203.0.113.7:51234", "v1", true, "a v1 IPv4 header should be parsed"},
+		{[]byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"), "[2001:db8::7]:51234", "v1", true, "a v1 IPv6 header should be parsed"},
+		{[]byte("PROXY UNKNOWN\r\n"), "", "v1", true, "a v1 header without addresses should keep the load balancer address"},
+		{[]byte("PROXY TCP4 2001:db8::7 192.0.2.1 51234 443\r\n"), "", "v1", false, "a v1 header with addresses not matching the protocol should be invalid"},
+		{[]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 70000\r\n"), "", "v1", false, "a v1 header with an invalid port should be invalid"},
+		{[]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\n"), "", "v1", false, "a v1 header should end with CRLF"},
+		{[]byte("PROXY " + strings.Repeat("A", 200) + "\r\n"), "", "v1", false, "a v1 header should not be longer than 107 bytes"},
+		{proxyV2Header(proxyV2Proxy, client4, server4), "203.0.113.7:51234", "v2", true, "a v2 IPv4 header should be parsed"},
+		{proxyV2Header(proxyV2Proxy, client6, server6), "[2001:db8::7]:51234", "v2", true, "a v2 IPv6 header should be parsed"},
+		{proxyV2Header(proxyV2Local, client4, server4), "", "v2", true, "a v2 LOCAL header should keep the load balancer address"},
+		{proxyV2Header(0x2, client4, server4), "", "v2", false, "a v2 header with an unknown command should be invalid"},
+		{append([]byte("\r\n\r\n\x00\r\nQUIX\n"), proxyV2Header(proxyV2Proxy, client4, server4)[12:]...), "", "v2", false, "a v2 header with a wrong signature should be invalid"},
+		{[]byte("GET / HTTP/1.1\r\n"), "", "", false, "a request without header should be refused"},
+	}
+
+	for _, tc := range tt {
+		src, _, version, err := parseProxyHeader(bufio.NewReader(bytes.NewReader(tc.header)))
+		if (err == nil) != tc.valid || version != tc.version {
+			t.Errorf("%s: %v", tc.errMsg, err)
+			continue
+		}
+		if tc.valid && ((src == nil && tc.source != "") || (src != nil && src.String() != tc.source)) {
+			t.Errorf("%s: received %v", tc.errMsg, src)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	// the origin answers with the client address seen by the CDN
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer origin.Close()
+
+	tt := []struct {
+		trusted string
+		header  string
+		client  string
+		errMsg  string
+	}{
+		{"127.0.0.0/8", "PROXY TCP4 203.0.113.7 127.0.0.1 51234 80\r\n", "203.0.113.7", "the client address should be the one of the header"},
+		{"127.0.0.0/8", string(proxyV2Header(proxyV2Proxy, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80})), "2001:db8::7", "the client address should be the one of the v2 header"},
+		{"127.0.0.0/8", "", "", "trusted sources should send the header"},
+		{"10.0.0.0/8", "", "127.0.0.1", "untrusted sources should be served without header"},
+		{"10.0.0.0/8", "PROXY TCP4 203.0.113.7 127.0.0.1 51234 80\r\n", "", "the header of untrusted sources should not be accepted"},
+	}
+
+	for _, tc := range tt {
+		c := DefaultConf()
+		c.HTTP.ProxyProtocol = ProxyProtocolConf{TrustedCIDRs: []string{tc.trusted}}
+		c.HTTP.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1", Port: listenerPort(t, origin),
+			RequestHeaders: []HeaderRuleConf{{Action: headerAppend, Name: "X-Forwarded-For", Value: "${client_ip}"}}}}
+		valid, reason := c.IsValid()
+		if !valid {
+			t.Fatal(reason)
+		}
+		cdn, err := NewCDN(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cdn.httpMux.HandleFunc("/", cdn.httpHandler)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go cdn.httpServer.Serve(cdn.defaultListener("http").proxy.listener(ln))
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n", tc.header)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		client := ""
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				client = string(body)
+			}
+		}
+		if client != tc.client {
+			t.Errorf("%s: received '%s'", tc.errMsg, client)
+		}
+
+		conn.Close()
+		cdn.Shutdown()
+		ln.Close()
+	}
+
+	valid, _ := ProxyProtocolConf{TrustedCIDRs: []string{"10.0.0.1"}}.IsValid()
+	if valid {
+		t.Error("trusted sources should be CIDRs")
+	}
+}
@@ -0,0 +1,247 @@
+package cdn
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryBackoff       = 100  // milliseconds
+	defaultRetryMaxBackoff    = 2000 // milliseconds
+	defaultRetryBudgetPercent = 20
+	defaultRetryBudgetMin     = 3 // retries per second always allowed
+	retryBudgetWindow         = 10 * time.Second
+)
+
+var (
+	defaultRetryOn          = []string{"connect", "timeout", "reset"}
+	defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	validRetryOn            = []string{"connect", "timeout", "reset"}
+)
+
+// retryPolicy describes if and how requests to a backend are retried
+type retryPolicy struct {
+	attempts    int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	retryOn     map[string]bool
+	statusCodes map[int]bool
+	budget      *retryBudget
+}
+
+// newRetryPolicy builds a retry policy from the configuration, filling in defaults
+func newRetryPolicy(rc RetryConf) *retryPolicy {
+	backoff := defaultRetryBackoff
+	if rc.BackoffMS > 0 {
+		backoff = rc.BackoffMS
+	}
+
+	maxBackoff := defaultRetryMaxBackoff
+	if rc.MaxBackoffMS > 0 {
+		maxBackoff = rc.MaxBackoffMS
+	}
+
+	retryOn := rc.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	ro := make(map[string]bool, len(retryOn))
+	for _, r := range retryOn {
+		ro[r] = true
+	}
+
+	statusCodes := rc.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = defaultRetryStatusCodes
+	}
+	sc := make(map[int]bool, len(statusCodes))
+	for _, s := range statusCodes {
+		sc[s] = true
+	}
+
+	budgetPercent := defaultRetryBudgetPercent
+	if rc.BudgetPercent > 0 {
+		budgetPercent = rc.BudgetPercent
+	}
+
+	budgetMin := defaultRetryBudgetMin
+	if rc.BudgetMinRetries > 0 {
+		budgetMin = rc.BudgetMinRetries
+	}
+
+	return &retryPolicy{
+		attempts:    rc.Attempts,
+		backoff:     time.Duration(backoff) * time.Millisecond,
+		maxBackoff:  time.Duration(maxBackoff) * time.Millisecond,
+		retryOn:     ro,
+		statusCodes: sc,
+		budget:      newRetryBudget(float64(budgetPercent)/100, budgetMin),
+	}
+}
+
+// canRetry checks the request can be safely sent more than once
+func (rp *retryPolicy) canRetry(req *http.Request) bool {
+	if rp.attempts <= 0 {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	// a body can only be sent again if we know how to rewind it
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryReason returns why a request should be retried, or an empty string if it shouldn't be
+func (rp *retryPolicy) retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		reason := classifyError(err)
+		if rp.retryOn[reason] {
+			return reason
+		}
+		return ""
+	}
+
+	if rp.statusCodes[resp.StatusCode] {
+		return "status"
+	}
+	return ""
+}
+
+// delay returns the time to wait before the given retry using exponential backoff with full jitter
+func (rp *retryPolicy) delay(retry int) time.Duration {
+	d := rp.backoff << uint(retry)
+	if d <= 0 || d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// classifyError maps an error returned by the HTTP client to one of the retryable error kinds
+func classifyError(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return "connect"
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return "reset"
+	}
+	return "other"
+}
+
+// retryBudget limits the amount of retries to a percentage of the requests sent to a backend,
+// so that a failing backend doesn't receive a multiple of its normal traffic
+type retryBudget struct {
+	mu          sync.Mutex
+	ratio       float64
+	minRetries  int
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+// newRetryBudget returns a new budget allowing ratio retries per request plus minPerSecond retries
+func newRetryBudget(ratio float64, minPerSecond int) *retryBudget {
+	return &retryBudget{ratio: ratio, minRetries: minPerSecond * int(retryBudgetWindow/time.Second), windowStart: time.Now()}
+}
+
+// rotate starts a new window if the current one has elapsed. Must be called with the lock held
+func (b *retryBudget) rotate() {
+	if time.Since(b.windowStart) > retryBudgetWindow {
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request records a new request
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.rotate()
+	b.requests++
+	b.mu.Unlock()
+}
+
+// allow checks if there's enough budget left for a retry and consumes it
+func (b *retryBudget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate()
+
+	if float64(b.retries) >= float64(b.minRetries)+b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// doRequest sends the request to the backend retrying according to the backend's retry policy
+func doRequest(client *http.Client, domain string, rp *retryPolicy, req *http.Request) (*http.Response, error) {
+	if rp == nil {
+		return client.Do(req)
+	}
+
+	rp.budget.request()
+	retryable := rp.canRetry(req)
+
+	r := req
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(r)
+		// nobody is waiting for the response once the client went away
+		if !retryable || attempt >= rp.attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		reason := rp.retryReason(resp, err)
+		if reason == "" {
+			return resp, err
+		}
+
+		if !rp.budget.allow() {
+			logrus.Debugf("retry budget exhausted for %s", domain)
+			retryBudgetExhaustedMetric.WithLabelValues(domain).Inc()
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		d := rp.delay(attempt)
+		logrus.Debugf("retrying request to %s in %s (%s)", req.URL, d, reason)
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		r = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		retriesMetric.WithLabelValues(domain, reason).Inc()
+	}
+}
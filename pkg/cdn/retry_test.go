@@ -0,0 +1,158 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoRequestRetries(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	tt := []struct {
+		method        string
+		body          []byte
+		attempts      int
+		expectedCode  int
+		expectedCalls int32
+		errMsg        string
+	}{
+		{http.MethodGet, nil, 3, http.StatusOK, 3, "a GET request should be retried until it succeeds"},
+		{http.MethodGet, nil, 1, http.StatusServiceUnavailable, 2, "a GET request shouldn't be retried more than the configured attempts"},
+		{http.MethodGet, nil, 0, http.StatusServiceUnavailable, 1, "a GET request shouldn't be retried if retries are disabled"},
+		{http.MethodPost, []byte("data"), 3, http.StatusServiceUnavailable, 1, "a POST request should never be retried"},
+		{http.MethodPut, []byte("data"), 3, http.StatusOK, 3, "a PUT request with a replayable body should be retried"},
+	}
+
+	for _, tc := range tt {
+		atomic.StoreInt32(&calls, 0)
+		rp := newRetryPolicy(RetryConf{Attempts: tc.attempts, BackoffMS: 1, MaxBackoffMS: 5})
+
+		req, err := http.NewRequest(tc.method, s.URL, bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := doRequest(client, "www.example.com", rp, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.expectedCode || atomic.LoadInt32(&calls) != tc.expectedCalls {
+			t.Errorf("%s: expected %d after %d calls, received %d after %d calls", tc.errMsg, tc.expectedCode, tc.expectedCalls, resp.StatusCode, calls)
+		}
+	}
+}
+
+func TestDoRequestUnreplayableBody(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodPut, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a plain reader can't be rewound, so the request can't be sent twice
+	req.Body = readCloser{strings.NewReader("data")}
+
+	resp, err := doRequest(&http.Client{}, "www.example.com", newRetryPolicy(RetryConf{Attempts: 3, BackoffMS: 1}), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if calls != 1 {
+		t.Errorf("a request with an unreplayable body shouldn't be retried, received %d calls", calls)
+	}
+}
+
+func TestDoRequestClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// the client disconnects while the origin is failing
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := doRequest(&http.Client{}, "www.example.com", newRetryPolicy(RetryConf{Attempts: 3, BackoffMS: 2000, MaxBackoffMS: 2000}), req)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	if atomic.LoadInt32(&calls) != 1 || time.Since(start) > time.Second {
+		t.Errorf("a request shouldn't be retried once the client went away, received %d calls in %s", calls, time.Since(start))
+	}
+
+	// the requests to the origin are tied to the client request
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1", Port: listenerPort(t, s),
+		Retry: RetryConf{Attempts: 3, BackoffMS: 2000, MaxBackoffMS: 2000}}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	atomic.StoreInt32(&calls, 0)
+	start = time.Now()
+	cdn.httpHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://www.example.com/", nil).WithContext(ctx))
+
+	if atomic.LoadInt32(&calls) != 1 || time.Since(start) > time.Second {
+		t.Errorf("the origin shouldn't be retried once the client went away, received %d calls in %s", calls, time.Since(start))
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 0)
+	for i := 0; i < 4; i++ {
+		b.request()
+	}
+
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		if b.allow() {
+			allowed++
+		}
+	}
+
+	if allowed != 2 {
+		t.Errorf("a 50%% budget over 4 requests should allow 2 retries, allowed %d", allowed)
+	}
+}
+
+type readCloser struct {
+	*strings.Reader
+}
+
+func (readCloser) Close() error { return nil }
@@ -0,0 +1,125 @@
+package cdn
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultRouteName is the name of the route used when none of the routes of a backend match
+	defaultRouteName = "default"
+)
+
+var (
+	validRouteMatches = []string{"prefix", "exact", "regex"}
+)
+
+// route sends the requests matching a path to their own origin
+type route struct {
+	match    string
+	path     string
+	pattern  *regexp.Regexp
+	endpoint endpoint
+}
+
+// newRoutes builds the routes of a backend in the order they're configured
+func newRoutes(bc BackendConf, proto string, defaultPort int) ([]route, error) {
+	routes := make([]route, 0, len(bc.Routes))
+	for _, rc := range bc.Routes {
+		r := route{match: rc.Match, path: rc.Path}
+		if rc.Match == "regex" {
+			re, err := regexp.Compile(rc.Path)
+			if err != nil {
+				return nil, err
+			}
+			r.pattern = re
+		}
+
+		e, err := newEndpoint(rc.backendConf(bc), proto, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		e.Route = rc.Name
+		e.NoCache = rc.NoCache
+		e.TTL = rc.TTL
+		r.endpoint = e
+
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// matches checks if the route handles a path
+func (r route) matches(path string) bool {
+	switch r.match {
+	case "exact":
+		return path == r.path
+	case "regex":
+		return r.pattern.MatchString(path)
+	default:
+		return strings.HasPrefix(path, r.path)
+	}
+}
+
+// forPath returns the endpoint handling a path: the first matching route or the backend itself
+func (e endpoint) forPath(path string) endpoint {
+	for _, r := range e.routes {
+		if r.matches(path) {
+			return r.endpoint
+		}
+	}
+	return e
+}
+
+// backendConf returns the configuration of the backend with the overrides of the route applied
+func (rc RouteConf) backendConf(bc BackendConf) BackendConf {
+	bc.Routes = nil
+	// canaries only apply to the requests served by the backend origin
+	bc.Canary = CanaryConf{}
+	if rc.IP != "" {
+		bc.IP = rc.IP
+		bc.Hostname = ""
+		bc.Origin = ""
+	}
+	if rc.Hostname != "" {
+		bc.Hostname = rc.Hostname
+		bc.IP = ""
+		bc.Origin = ""
+	}
+	if rc.Origin != "" {
+		bc.Origin = rc.Origin
+		bc.IP = ""
+		bc.Hostname = ""
+	}
+	if rc.Port > 0 {
+		bc.Port = rc.Port
+	}
+	if rc.SliceSize > 0 {
+		bc.SliceSize = rc.SliceSize
+	}
+	if rc.IfModifiedValidation != 0 {
+		bc.IfModifiedValidation = rc.IfModifiedValidation
+	}
+	if rc.OriginHost != "" {
+		bc.OriginHost = rc.OriginHost
+	}
+	if rc.Retry != nil {
+		bc.Retry = *rc.Retry
+	}
+	if rc.Transport != nil {
+		bc.Transport = *rc.Transport
+	}
+	if rc.OriginTLS != nil {
+		bc.OriginTLS = *rc.OriginTLS
+	}
+	if rc.PathRewrite != nil {
+		bc.PathRewrite = *rc.PathRewrite
+	}
+	if rc.RequestHeaders != nil {
+		bc.RequestHeaders = rc.RequestHeaders
+	}
+	if rc.ResponseHeaders != nil {
+		bc.ResponseHeaders = rc.ResponseHeaders
+	}
+	return bc
+}
@@ -0,0 +1,105 @@
+package cdn
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+	newOrigin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "text/css")
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			fmt.Fprintf(w, "%s%s", name, r.URL.Path)
+		}))
+	}
+	main := newOrigin("main")
+	defer main.Close()
+	api := newOrigin("api")
+	defer api.Close()
+	assets := newOrigin("assets")
+	defer assets.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:   "example",
+		Domain: "www.example.com",
+		IP:     "127.0.0.1",
+		Port:   listenerPort(t, main),
+		Routes: []RouteConf{
+			{Name: "api", Match: "prefix", Path: "/api/", Port: listenerPort(t, api), NoCache: true},
+			{Name: "assets", Match: "regex", Path: `^/assets/.+\.css$`, Port: listenerPort(t, assets), TTL: 3600},
+			{Name: "robots", Match: "exact", Path: "/robots.txt", Port: listenerPort(t, assets)},
+		},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		path   string
+		body   string
+		cached bool
+		ttl    int
+	}{
+		{"/api/users.css", "api/api/users.css", false, 0},
+		{"/assets/style.css", "assets/assets/style.css", true, 3600},
+		{"/assets/logo.png", "main/assets/logo.png", true, 60},
+		{"/robots.txt", "assets/robots.txt", true, 60},
+		{"/robots.txt.bak", "main/robots.txt.bak", true, 60},
+	}
+
+	for _, tc := range tt {
+		url := "http://www.example.com" + tc.path
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		if rr.Body.String() != tc.body {
+			t.Errorf("requesting %s, expected '%s', received '%s'", tc.path, tc.body, rr.Body.String())
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		co, found, err := cdn.cache.Lookup(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tc.cached {
+			t.Errorf("requesting %s, expected cached to be %t", tc.path, tc.cached)
+		}
+		if found && co.TTL() != tc.ttl {
+			t.Errorf("requesting %s, expected TTL %d, received %d", tc.path, tc.ttl, co.TTL())
+		}
+	}
+}
+
+func TestRouteIsValid(t *testing.T) {
+	tt := []struct {
+		rc     RouteConf
+		result bool
+		errMsg string
+	}{
+		{RouteConf{Name: "api", Match: "prefix", Path: "/api/"}, true, "prefix route should be valid"},
+		{RouteConf{Name: "api", Match: "regex", Path: "^/api/v[0-9]+/"}, true, "regex route should be valid"},
+		{RouteConf{Name: "", Match: "prefix", Path: "/api/"}, false, "route should be invalid because of an empty name"},
+		{RouteConf{Name: "default", Match: "prefix", Path: "/api/"}, false, "route should be invalid because the name is reserved"},
+		{RouteConf{Name: "api", Match: "suffix", Path: "/api/"}, false, "route should be invalid because of an unknown match type"},
+		{RouteConf{Name: "api", Match: "regex", Path: "^/api/(["}, false, "route should be invalid because of an invalid regex"},
+		{RouteConf{Name: "api", Match: "exact", Path: "api"}, false, "route should be invalid because the path doesn't start with /"},
+		{RouteConf{Name: "api", Match: "prefix", Path: "/api/", IP: "10.0.0"}, false, "route should be invalid because of an invalid IP"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.rc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
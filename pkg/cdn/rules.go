@@ -0,0 +1,116 @@
+package cdn
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultRedirectStatus = http.StatusFound
+)
+
+var (
+	validRedirectStatuses = []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect}
+)
+
+// edgeRule rewrites or redirects the requests whose path matches a pattern
+type edgeRule struct {
+	pattern  *regexp.Regexp
+	rewrite  string
+	redirect string
+	status   int
+}
+
+// edgeRules are evaluated for every request before the cache is looked up, so that redirects
+// don't need to reach the origin
+type edgeRules struct {
+	redirectHTTPS bool
+	canonicalHost string
+	rules         []edgeRule
+}
+
+// newEdgeRules returns the rules of a backend, nil if there are none
+func newEdgeRules(bc BackendConf) (*edgeRules, error) {
+	if !bc.RedirectHTTPS && bc.CanonicalHost == "" && len(bc.Rules) == 0 {
+		return nil, nil
+	}
+
+	er := &edgeRules{redirectHTTPS: bc.RedirectHTTPS, canonicalHost: bc.CanonicalHost}
+	for _, rc := range bc.Rules {
+		re, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, err
+		}
+
+		status := defaultRedirectStatus
+		if rc.Status > 0 {
+			status = rc.Status
+		}
+		er.rules = append(er.rules, edgeRule{pattern: re, rewrite: rc.Rewrite, redirect: rc.Redirect, status: status})
+	}
+	return er, nil
+}
+
+// apply returns where the request should be redirected to, if it should. Otherwise the path of the
+// request is rewritten by the first matching rule, if any
+func (er *edgeRules) apply(req *http.Request) (string, int, bool) {
+	if er == nil {
+		return "", 0, false
+	}
+
+	// the scheme and the host are redirected at once, to avoid a chain of redirects
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	if er.redirectHTTPS && req.TLS == nil {
+		// the port of the HTTP server doesn't apply to HTTPS
+		scheme = "https"
+		host = hostWithoutPort(host)
+	}
+	if er.canonicalHost != "" && normalizeHost(hostWithoutPort(req.Host)) != normalizeHost(er.canonicalHost) {
+		host = er.canonicalHost
+	}
+	if host != req.Host || (scheme == "https" && req.TLS == nil) {
+		return scheme + "://" + host + req.URL.RequestURI(), permanentRedirectStatus(req.Method), true
+	}
+
+	for _, r := range er.rules {
+		m := r.pattern.FindStringSubmatchIndex(req.URL.Path)
+		if m == nil {
+			continue
+		}
+
+		if r.redirect != "" {
+			location := string(r.pattern.ExpandString(nil, r.redirect, req.URL.Path, m))
+			if req.URL.RawQuery != "" && !strings.Contains(location, "?") {
+				location += "?" + req.URL.RawQuery
+			}
+			return location, r.status, true
+		}
+
+		req.URL.Path = string(r.pattern.ExpandString(nil, r.rewrite, req.URL.Path, m))
+		req.URL.RawPath = ""
+		return "", 0, false
+	}
+	return "", 0, false
+}
+
+// permanentRedirectStatus returns the status of a permanent redirect, making sure the method and the
+// body are kept for requests other than GET and HEAD
+func permanentRedirectStatus(method string) int {
+	if method == http.MethodGet || method == http.MethodHead {
+		return http.StatusMovedPermanently
+	}
+	return http.StatusPermanentRedirect
+}
+
+// hostWithoutPort removes the port, if any, from a host
+func hostWithoutPort(host string) string {
+	if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+		return host[:i]
+	}
+	return host
+}
@@ -0,0 +1,143 @@
+package cdn
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEdgeRules(t *testing.T) {
+	er, err := newEdgeRules(BackendConf{
+		CanonicalHost: "www.example.com",
+		Rules: []RuleConf{
+			{Match: "^/blog/([0-9]+)/(.+)$", Redirect: "/posts/$2?id=$1", Status: 301},
+			{Match: "^/old/(.*)$", Redirect: "https://archive.example.com/$1"},
+			{Match: "^/v1/(.*)$", Rewrite: "/api/v1/$1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		url      string
+		tls      bool
+		location string
+		code     int
+		path     string
+	}{
+		{"http://example.com/index.html?a=1", false, "http://www.example.com/index.html?a=1", http.StatusMovedPermanently, "/index.html"},
+		{"https://www.example.com/blog/42/hello", true, "/posts/hello?id=42", http.StatusMovedPermanently, "/blog/42/hello"},
+		{"http://www.example.com/old/page?a=1", false, "https://archive.example.com/page?a=1", http.StatusFound, "/old/page"},
+		{"http://www.example.com/v1/users", false, "", 0, "/api/v1/users"},
+		{"http://www.example.com/static/logo.png", false, "", 0, "/static/logo.png"},
+	}
+
+	for _, tc := range tt {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		location, code, _ := er.apply(req)
+		if location != tc.location || code != tc.code {
+			t.Errorf("expected %s to be redirected to '%s' (%d), received '%s' (%d)", tc.url, tc.location, tc.code, location, code)
+		}
+		if req.URL.Path != tc.path {
+			t.Errorf("expected the path of %s to be %s, received %s", tc.url, tc.path, req.URL.Path)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	er, _ := newEdgeRules(BackendConf{RedirectHTTPS: true})
+
+	tt := []struct {
+		method   string
+		url      string
+		tls      bool
+		location string
+		code     int
+	}{
+		{"GET", "http://www.example.com:8080/index.html", false, "https://www.example.com/index.html", http.StatusMovedPermanently},
+		{"POST", "http://www.example.com/form", false, "https://www.example.com/form", http.StatusPermanentRedirect},
+		{"GET", "https://www.example.com:8443/index.html", true, "", 0},
+	}
+
+	for _, tc := range tt {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		location, code, _ := er.apply(req)
+		if location != tc.location || code != tc.code {
+			t.Errorf("expected %s %s to be redirected to '%s' (%d), received '%s' (%d)", tc.method, tc.url, tc.location, tc.code, location, code)
+		}
+	}
+}
+
+func TestRulesHandlerAndReload(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:   "example",
+		Domain: "www.example.com",
+		IP:     "127.0.0.1",
+		Port:   listenerPort(t, s),
+		Rules:  []RuleConf{{Match: "^/old$", Redirect: "/new", Status: 308}},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/old", nil)
+	rr := httptest.NewRecorder()
+	cdn.httpHandler(rr, req)
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != "/new" {
+		t.Errorf("expected a redirect to /new, received %d '%s'", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// after reloading the redirect is replaced by a rewrite
+	c.HTTP.Backends[0].Rules = []RuleConf{{Match: "^/old$", Rewrite: "/new"}}
+	err = cdn.Reload(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com/old", nil)
+	rr = httptest.NewRecorder()
+	cdn.httpHandler(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "/new" {
+		t.Errorf("expected the origin to receive the rewritten path, received %d '%s'", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRuleIsValid(t *testing.T) {
+	tt := []struct {
+		rc     RuleConf
+		result bool
+		errMsg string
+	}{
+		{RuleConf{Match: "^/a/(.*)$", Redirect: "/b/$1", Status: 301}, true, "redirect rule should be valid"},
+		{RuleConf{Match: "^/a/(.*)$", Rewrite: "/b/$1"}, true, "rewrite rule should be valid"},
+		{RuleConf{Match: "^/a/(", Rewrite: "/b"}, false, "rule should be invalid because of an invalid pattern"},
+		{RuleConf{Match: "^/a$", Rewrite: "/b", Redirect: "/c"}, false, "rule should be invalid because it both rewrites and redirects"},
+		{RuleConf{Match: "^/a$"}, false, "rule should be invalid because it neither rewrites nor redirects"},
+		{RuleConf{Match: "^/a$", Redirect: "/b", Status: 200}, false, "rule should be invalid because of an invalid status"},
+		{RuleConf{Match: "^/a$", Rewrite: "b"}, false, "rule should be invalid because the rewrite isn't a path"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.rc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	s3Origin = "s3"
+
+	defaultS3Region = "us-east-1"
+
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3Service        = "s3"
+	s3DateFormat     = "20060102"
+	s3DateTimeFormat = "20060102T150405Z"
+	s3MaxErrorBody   = 64 * 1024
+	// the hash of an empty payload, origin requests never have a body
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	// request headers forwarded to the bucket, any other header is dropped so that the signature doesn't
+	// depend on what the client sent
+	s3ForwardedHeaders = []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+	// bucket errors returned to the client as a different status code
+	s3ErrorCodes = map[string]int{
+		"NoSuchKey":    http.StatusNotFound,
+		"NoSuchBucket": http.StatusNotFound,
+	}
+)
+
+// s3Bucket is an origin serving the objects of a bucket of S3-compatible object storage
+type s3Bucket struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time
+}
+
+// newS3Bucket returns the origin for the bucket (and optional key prefix) in path
+func newS3Bucket(path string, sc S3Conf) (*s3Bucket, error) {
+	parts := strings.SplitN(path, "/", 2)
+	b := &s3Bucket{
+		bucket:       parts[0],
+		region:       defaultS3Region,
+		pathStyle:    sc.PathStyle,
+		accessKey:    sc.AccessKeyID,
+		secretKey:    sc.SecretAccessKey,
+		sessionToken: sc.SessionToken,
+		now:          time.Now,
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		b.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	if sc.Region != "" {
+		b.region = sc.Region
+	}
+
+	// credentials are taken from the environment when not configured
+	if b.accessKey == "" && b.secretKey == "" {
+		b.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		b.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		b.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	endpoint := sc.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", b.region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	b.endpoint = u
+	return b, nil
+}
+
+// objectURL returns the URL of the object a request path maps to
+func (b *s3Bucket) objectURL(p string) *url.URL {
+	key := b.prefix + strings.TrimPrefix(p, "/")
+
+	u := &url.URL{Scheme: b.endpoint.Scheme, Host: b.endpoint.Host}
+	if b.pathStyle {
+		u.Path = "/" + b.bucket + "/" + key
+	} else {
+		u.Host = b.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return u
+}
+
+// sign adds the AWS Signature Version 4 headers to a request. Requests are sent unsigned when no
+// credentials are available, which works for public buckets
+func (b *s3Bucket) sign(req *http.Request) {
+	if b.accessKey == "" {
+		return
+	}
+
+	now := b.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3DateTimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+
+	// the host and every header set are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), b.region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3DateTimeFormat), scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, b.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Transport sends requests to a bucket, mapping the request path to the object key
+type s3Transport struct {
+	bucket *s3Bucket
+	next   http.RoundTripper
+}
+
+// CloseIdleConnections closes the idle connections to the bucket
+func (t *s3Transport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+// RoundTrip fetches the object requested
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rb := &responseBuffer{header: http.Header{"Allow": []string{"GET, HEAD"}}}
+		http.Error(rb, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return rb.response(req), nil
+	}
+
+	// a key ending with a slash is a folder, the bucket would be listed
+	u := t.bucket.objectURL(req.URL.Path)
+	if strings.HasSuffix(u.Path, "/") {
+		rb := &responseBuffer{header: http.Header{}}
+		http.Error(rb, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return rb.response(req), nil
+	}
+
+	out := (&http.Request{
+		Method:     req.Method,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}).WithContext(req.Context())
+	for _, h := range s3ForwardedHeaders {
+		if v := req.Header.Get(h); v != "" {
+			out.Header.Set(h, v)
+		}
+	}
+	t.bucket.sign(out)
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		s3Error(resp)
+	}
+	return resp, nil
+}
+
+// s3ErrorResponse is the body of the error responses of a bucket
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3Error replaces the XML body of an error response, mapping the bucket error to a status code
+func s3Error(resp *http.Response) {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, s3MaxErrorBody))
+	resp.Body.Close()
+
+	er := s3ErrorResponse{}
+	if xml.Unmarshal(body, &er) == nil && er.Code != "" {
+		logrus.Debugf("bucket error %s: %s", er.Code, er.Message)
+		if code, ok := s3ErrorCodes[er.Code]; ok {
+			resp.StatusCode = code
+		}
+	}
+
+	text := []byte(http.StatusText(resp.StatusCode) + "\n")
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = int64(len(text))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(text))
+}
+
+// s3EscapePath encodes a path as required by the signature, leaving only unreserved characters and slashes
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.IndexByte("-_.~/", c) >= 0 {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
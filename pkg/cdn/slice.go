@@ -0,0 +1,409 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amartorelli/particles/pkg/cache"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sliceMetaHeader is stored with the headers of a sliced object to describe its slices, it's
+	// never sent to the client
+	sliceMetaHeader = "X-Particles-Slices"
+)
+
+var (
+	errInvalidContentRange = errors.New("invalid Content-Range in the origin response")
+	errObjectChanged       = errors.New("the object changed at the origin while being sliced")
+	errMisalignedSlice     = errors.New("the origin answered with a different range than the slice requested")
+
+	// headers describing a single response of the origin rather than the object
+	sliceResponseHeaders = []string{"Content-Range", "Content-Length", "Accept-Ranges", sliceMetaHeader}
+)
+
+// byteRange is a single range requested by a client. A suffix range is made of the last end bytes,
+// otherwise a negative end means until the end of the object
+type byteRange struct {
+	start  int64
+	end    int64
+	suffix bool
+}
+
+// parseRange parses the Range header of a request. Only single ranges are supported, for any other
+// range the whole object is served
+func parseRange(h string) (byteRange, bool) {
+	if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+		return byteRange{}, false
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(h, "bytes=")), "-", 2)
+	if len(parts) != 2 {
+		return byteRange{}, false
+	}
+
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{end: n, suffix: true}, true
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	end := int64(-1)
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false
+		}
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// resolve returns the first and last byte of the range for an object of the given size, and
+// whether the range can be satisfied
+func (r byteRange) resolve(total int64) (int64, int64, bool) {
+	if r.suffix {
+		if total == 0 {
+			return 0, 0, false
+		}
+		start := total - r.end
+		if start < 0 {
+			start = 0
+		}
+		return start, total - 1, true
+	}
+
+	if r.start >= total {
+		return 0, 0, false
+	}
+	end := r.end
+	if end < 0 || end >= total {
+		end = total - 1
+	}
+	return r.start, end, true
+}
+
+// parseContentRange parses the Content-Range header of a 206 response
+func parseContentRange(h string) (int64, int64, int64, error) {
+	var start, end, total int64
+	_, err := fmt.Sscanf(h, "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil || start > end || end >= total {
+		return 0, 0, 0, errInvalidContentRange
+	}
+	return start, end, total, nil
+}
+
+// sliceMeta describes an object cached in slices. The generation identifies the copy in cache, so
+// that the slices of a purged copy are never used again, even where they can't be purged with it
+type sliceMeta struct {
+	size       int64
+	total      int64
+	version    string
+	generation string
+	headers    map[string]string
+	cii        cacheItemInfo
+	cacheable  bool
+}
+
+// newSliceMeta describes the object a slice, fetched from the origin, belongs to
+func newSliceMeta(resp *http.Response, size int64) (*sliceMeta, error) {
+	_, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+
+	headers := cleanHeadersMap(respHeadersToMap(resp))
+	for _, h := range sliceResponseHeaders {
+		delete(headers, h)
+	}
+	g := make([]byte, 8)
+	rand.Read(g)
+	return &sliceMeta{size: size, total: total, version: sliceVersion(resp.Header, total), generation: hex.EncodeToString(g), headers: headers}, nil
+}
+
+// sliceKey returns the key of the slice i of the object stored at key
+func (m *sliceMeta) sliceKey(key string, i int64) string {
+	return cache.SliceKey(key, m.version+"."+m.generation, i)
+}
+
+// checkSlice checks that a slice fetched from the origin is the slice i of the object, so that a range
+// ignored or clamped by the origin is never cached or served as the slice
+func (m *sliceMeta) checkSlice(resp *http.Response, body []byte, i int64) error {
+	start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if total != m.total || sliceVersion(resp.Header, total) != m.version {
+		return errObjectChanged
+	}
+
+	last := (i+1)*m.size - 1
+	if last >= total {
+		last = total - 1
+	}
+	if start != i*m.size || end != last || end-start+1 != int64(len(body)) {
+		return errMisalignedSlice
+	}
+	return nil
+}
+
+// parseSliceMeta returns the description of an object cached in slices
+func parseSliceMeta(co *cache.ContentObject) (*sliceMeta, bool) {
+	var size, total int64
+	var version, generation string
+	_, err := fmt.Sscanf(co.Headers()[sliceMetaHeader], "%d/%d/%s %s", &size, &total, &version, &generation)
+	if err != nil {
+		return nil, false
+	}
+
+	headers := make(map[string]string, len(co.Headers()))
+	for k, v := range co.Headers() {
+		if k != sliceMetaHeader {
+			headers[k] = v
+		}
+	}
+	cii := cacheItemInfo{ContentType: co.ContentType, MaxAge: co.TTL()}
+	return &sliceMeta{size: size, total: total, version: version, generation: generation, headers: headers, cii: cii, cacheable: true}, true
+}
+
+// contentObject returns the object stored in cache to describe the slices
+func (m *sliceMeta) contentObject() *cache.ContentObject {
+	headers := make(map[string]string, len(m.headers)+1)
+	for k, v := range m.headers {
+		headers[k] = v
+	}
+	headers[sliceMetaHeader] = fmt.Sprintf("%d/%d/%s %s", m.size, m.total, m.version, m.generation)
+	return cache.NewContentObject(nil, m.cii.ContentType, headers, m.cii.MaxAge, time.Now().Unix())
+}
+
+// sliceVersion identifies the version of an object at the origin
+func sliceVersion(h http.Header, total int64) string {
+	s := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d", h.Get("ETag"), h.Get("Last-Modified"), total)))
+	return hex.EncodeToString(s[:8])
+}
+
+// serveSliced serves a GET or HEAD request for an object cached in slices of a fixed size. Only the
+// slices covering the range requested are looked up, and fetched from the origin with a Range
+// request if they're missing, so that large objects are cached as they're requested
+func (c *CDN) serveSliced(w http.ResponseWriter, req *http.Request, e endpoint, fr, key string, vars *headerVars, domain, route string) {
+	size := int64(e.SliceSize)
+	rng, hasRange := parseRange(req.Header.Get("Range"))
+
+	// slices fetched while serving this request
+	fetched := map[int64][]byte{}
+
+	var meta *sliceMeta
+	var found bool
+	if !e.NoCache {
+		co, ok, err := c.cache.Lookup(key)
+		if err != nil {
+			logrus.Debugf("error while looking up %s: %s", key, err)
+		}
+		if ok {
+			meta, found = parseSliceMeta(co)
+		}
+		// slices of a different size can't be reused
+		found = found && meta.size == size
+	}
+
+	if found {
+		vars.cacheStatus = cacheStatusHit
+	} else {
+		// the object is described by the first slice requested
+		first := int64(0)
+		if hasRange && !rng.suffix {
+			first = rng.start / size
+		}
+
+		resp, body, err := c.fetchSlice(req, e, fr, domain, first, vars)
+		if err != nil {
+			logrus.Errorf("error proxying request: %s", err)
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusBadGateway), "error").Inc()
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		// the origin doesn't support ranges, or the range is past the end of the object
+		if resp.StatusCode != http.StatusPartialContent {
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(resp.StatusCode), "success").Inc()
+			respond(w, resp.StatusCode, resp.Header, body)
+			return
+		}
+
+		meta, err = newSliceMeta(resp, size)
+		if err == nil {
+			err = meta.checkSlice(resp, body, first)
+		}
+		if err != nil {
+			logrus.Errorf("error slicing %s: %s", fr, err)
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusBadGateway), "error").Inc()
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		meta.cacheable, meta.cii = c.isCachable(resp.Header)
+		meta.cacheable = meta.cacheable && !e.NoCache
+		if e.TTL > 0 {
+			meta.cii.MaxAge = e.TTL
+		}
+		fetched[first] = body
+
+		if meta.cacheable {
+			c.storeAsync(key, meta.contentObject(), domain)
+			c.storeAsync(meta.sliceKey(key, first), cache.NewContentObject(body, meta.cii.ContentType, nil, meta.cii.MaxAge, time.Now().Unix()), domain)
+		}
+	}
+
+	start, end := int64(0), meta.total-1
+	code := http.StatusOK
+	if hasRange {
+		var ok bool
+		start, end, ok = rng.resolve(meta.total)
+		if !ok {
+			requestsMetric.WithLabelValues(domain, route, strconv.Itoa(http.StatusRequestedRangeNotSatisfiable), "success").Inc()
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.total))
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		code = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, meta.total))
+	}
+
+	for k, v := range meta.headers {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(code)
+	requestsMetric.WithLabelValues(domain, route, strconv.Itoa(code), "success").Inc()
+
+	if req.Method == http.MethodHead || meta.total == 0 {
+		return
+	}
+
+	for i := start / size; i <= end/size; i++ {
+		data, err := c.slice(req, e, fr, key, domain, meta, i, fetched, vars)
+		if err != nil {
+			// the headers have been sent already, the client will notice the response is incomplete
+			logrus.Errorf("error fetching slice %d of %s: %s", i, fr, err)
+			return
+		}
+
+		// the part of the slice within the range
+		from := start - i*size
+		if from < 0 {
+			from = 0
+		}
+		to := end - i*size + 1
+		if to > int64(len(data)) {
+			to = int64(len(data))
+		}
+
+		_, err = w.Write(data[from:to])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// slice returns a slice of an object, from the cache if it's there
+func (c *CDN) slice(req *http.Request, e endpoint, fr, key, domain string, meta *sliceMeta, i int64, fetched map[int64][]byte, vars *headerVars) ([]byte, error) {
+	data, ok := fetched[i]
+	if ok {
+		return data, nil
+	}
+
+	sk := meta.sliceKey(key, i)
+	if meta.cacheable {
+		co, found, _ := c.cache.Lookup(sk)
+		if found {
+			cacheMetric.WithLabelValues(domain, "slice_hit").Inc()
+			return co.Content(), nil
+		}
+	}
+	cacheMetric.WithLabelValues(domain, "slice_miss").Inc()
+
+	resp, body, err := c.fetchSlice(req, e, fr, domain, i, vars)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	err = meta.checkSlice(resp, body, i)
+	if err == errObjectChanged || err == errMisalignedSlice {
+		// start from scratch at the next request
+		c.cache.Purge(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.cacheable {
+		c.storeAsync(sk, cache.NewContentObject(body, meta.cii.ContentType, nil, meta.cii.MaxAge, time.Now().Unix()), domain)
+	}
+	return body, nil
+}
+
+// fetchSlice requests a slice of an object to the origin
+func (c *CDN) fetchSlice(req *http.Request, e endpoint, fr, domain string, i int64, vars *headerVars) (*http.Response, []byte, error) {
+	r, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// conditional and range headers of the client apply to the whole object, not to the slice
+	for k, v := range req.Header {
+		if k == "Range" || strings.HasPrefix(k, "If-") {
+			continue
+		}
+		r.Header.Add(k, v[0])
+	}
+	size := int64(e.SliceSize)
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", i*size, (i+1)*size-1))
+	if e.OriginHost != "" {
+		r.Host = e.OriginHost
+	}
+	e.requestHeaders.apply(r.Header, vars)
+
+	resp, err := doRequest(e.client, domain, e.Retry, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, body, nil
+}
+
+// storeAsync stores an object in cache without waiting for it to be stored
+func (c *CDN) storeAsync(key string, co *cache.ContentObject, domain string) {
+	go func() {
+		err := c.cache.Store(key, co)
+		if err != nil {
+			logrus.Errorf("error storing cache item %s: %s", key, err)
+			cacheMetric.WithLabelValues(domain, "store_error").Inc()
+			return
+		}
+		cacheMetric.WithLabelValues(domain, "stored").Inc()
+	}()
+}
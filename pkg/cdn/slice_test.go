@@ -0,0 +1,306 @@
+package cdn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amartorelli/particles/pkg/cache"
+)
+
+func TestParseRange(t *testing.T) {
+	tt := []struct {
+		header string
+		ok     bool
+		start  int64
+		end    int64
+		valid  bool
+	}{
+		{"bytes=0-99", true, 0, 99, true},
+		{"bytes=100-", true, 100, 999, true},
+		{"bytes=-100", true, 900, 999, true},
+		{"bytes=900-5000", true, 900, 999, true},
+		{"bytes=1000-", true, 0, 0, false},
+		{"bytes=0-1,5-6", false, 0, 0, false},
+		{"bytes=5-1", false, 0, 0, false},
+		{"items=0-1", false, 0, 0, false},
+	}
+
+	for _, tc := range tt {
+		r, ok := parseRange(tc.header)
+		if ok != tc.ok {
+			t.Errorf("unexpected result parsing %s: %t", tc.header, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		start, end, valid := r.resolve(1000)
+		if valid != tc.valid || (valid && (start != tc.start || end != tc.end)) {
+			t.Errorf("expected %s to be %d-%d (%t), received %d-%d (%t)", tc.header, tc.start, tc.end, tc.valid, start, end, valid)
+		}
+	}
+}
+
+func TestSlices(t *testing.T) {
+	content := make([]byte, 2500)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	var requests int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:      "example",
+		Domain:    "www.example.com",
+		IP:        "127.0.0.1",
+		Port:      listenerPort(t, s),
+		SliceSize: 1000,
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		rng      string
+		code     int
+		body     []byte
+		requests int64
+	}{
+		{"bytes=1500-2100", http.StatusPartialContent, content[1500:2101], 2},
+		{"", http.StatusOK, content, 1},
+		{"bytes=-100", http.StatusPartialContent, content[2400:], 0},
+		{"bytes=5000-", http.StatusRequestedRangeNotSatisfiable, nil, 0},
+	}
+
+	for _, tc := range tt {
+		atomic.StoreInt64(&requests, 0)
+		req, _ := http.NewRequest("GET", "http://www.example.com/video.mp4", nil)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("expected %d for range '%s', received %d", tc.code, tc.rng, rr.Code)
+		}
+		if tc.body != nil && !bytes.Equal(rr.Body.Bytes(), tc.body) {
+			t.Errorf("unexpected body for range '%s'", tc.rng)
+		}
+		if r := atomic.LoadInt64(&requests); r != tc.requests {
+			t.Errorf("expected %d requests to the origin for range '%s', received %d", tc.requests, tc.rng, r)
+		}
+		if rr.Header().Get(sliceMetaHeader) != "" {
+			t.Error("the slices description shouldn't be sent to the client")
+		}
+
+		// slices are stored asynchronously
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestSlicesMisaligned(t *testing.T) {
+	content := make([]byte, 2500)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	// the origin answers with a range of its choice
+	var start, end, length int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : start+length])
+	}))
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:      "example",
+		Domain:    "www.example.com",
+		IP:        "127.0.0.1",
+		Port:      listenerPort(t, s),
+		SliceSize: 1000,
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		start  int64
+		end    int64
+		length int64
+		code   int
+		errMsg string
+	}{
+		{0, 999, 1000, http.StatusBadGateway, "a slice at another offset should not be served"},
+		{1000, 1499, 500, http.StatusBadGateway, "a clamped slice should not be served"},
+		{1000, 1999, 500, http.StatusBadGateway, "a slice shorter than its range should not be served"},
+		{1000, 1999, 1000, http.StatusPartialContent, "the slice requested should be served"},
+	}
+
+	for _, tc := range tt {
+		start, end, length = tc.start, tc.end, tc.length
+		req, _ := http.NewRequest("GET", "http://www.example.com/video.mp4", nil)
+		req.Header.Set("Range", "bytes=1500-1600")
+
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%s: received %d", tc.errMsg, rr.Code)
+		}
+
+		// slices are stored asynchronously
+		time.Sleep(100 * time.Millisecond)
+		_, found, _ := cdn.cache.Lookup("http://www.example.com/video.mp4")
+		if found != (tc.code == http.StatusPartialContent) {
+			t.Errorf("%s: the object is cached %t", tc.errMsg, found)
+		}
+	}
+}
+
+// fakeMemcached serves the get, set and delete commands of the memcached text protocol from memory
+func fakeMemcached(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	items := map[string][]byte{}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args := strings.Fields(line)
+			if len(args) < 2 {
+				fmt.Fprint(rw, "ERROR\r\n")
+				rw.Flush()
+				continue
+			}
+
+			mu.Lock()
+			switch args[0] {
+			case "get", "gets":
+				for _, k := range args[1:] {
+					v, ok := items[k]
+					if ok {
+						fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", k, len(v), v)
+					}
+				}
+				fmt.Fprint(rw, "END\r\n")
+			case "set":
+				n, _ := strconv.Atoi(args[4])
+				v := make([]byte, n+2)
+				_, err = io.ReadFull(rw, v)
+				items[args[1]] = v[:n]
+				fmt.Fprint(rw, "STORED\r\n")
+			case "delete":
+				_, ok := items[args[1]]
+				delete(items, args[1])
+				if ok {
+					fmt.Fprint(rw, "DELETED\r\n")
+				} else {
+					fmt.Fprint(rw, "NOT_FOUND\r\n")
+				}
+			default:
+				fmt.Fprint(rw, "ERROR\r\n")
+			}
+			mu.Unlock()
+			if err != nil || rw.Flush() != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln
+}
+
+func TestSlicesPurgeMemcached(t *testing.T) {
+	// the content changes at the origin without changing its validators
+	var content atomic.Value
+	content.Store(bytes.Repeat([]byte("a"), 2500))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content.Load().([]byte)))
+	}))
+	defer s.Close()
+	mc := fakeMemcached(t)
+	defer mc.Close()
+
+	c := DefaultConf()
+	c.Cache = cache.Conf{Type: "memcached", Options: map[string]string{"endpoints": mc.Addr().String()}}
+	c.HTTP.Backends = []BackendConf{{
+		Name:      "example",
+		Domain:    "www.example.com",
+		IP:        "127.0.0.1",
+		Port:      listenerPort(t, s),
+		SliceSize: 1000,
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() []byte {
+		req, _ := http.NewRequest("GET", "http://www.example.com/video.mp4", nil)
+		rr := httptest.NewRecorder()
+		cdn.httpHandler(rr, req)
+		// slices are stored asynchronously
+		time.Sleep(100 * time.Millisecond)
+		return rr.Body.Bytes()
+	}
+
+	get()
+	content.Store(bytes.Repeat([]byte("b"), 2500))
+	if !bytes.Equal(get(), bytes.Repeat([]byte("a"), 2500)) {
+		t.Fatal("the object should be served from memcached")
+	}
+
+	// memcached only purges the exact key, the slices of the purged copy must not be served
+	err = cdn.cache.Purge("http://www.example.com/video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(get(), bytes.Repeat([]byte("b"), 2500)) {
+		t.Error("the slices of a purged object should not be served")
+	}
+}
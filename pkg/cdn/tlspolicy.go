@@ -0,0 +1,179 @@
+package cdn
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hstsPreloadMinMaxAge = 31536000 // seconds, one year
+	ticketKeysKept       = 3        // keys accepted to resume sessions, the first one encrypts the new tickets
+)
+
+var (
+	tlsCurves = map[string]tls.CurveID{
+		"X25519MLKEM768": tls.X25519MLKEM768,
+		"X25519":         tls.X25519,
+		"P-256":          tls.CurveP256,
+		"P-384":          tls.CurveP384,
+		"P-521":          tls.CurveP521,
+	}
+)
+
+// newServerTLSConfig returns the TLS configuration of the HTTPS listener, without the certificates.
+// TLS 1.2 is the minimum version unless configured otherwise, and only the cipher suites without
+// known weaknesses can be enabled
+func newServerTLSConfig(tc TLSConf) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, SessionTicketsDisabled: tc.DisableSessionTickets}
+
+	if tc.MinVersion != "" {
+		v, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %s", tc.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if tc.MaxVersion != "" {
+		v, ok := tlsVersions[tc.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %s", tc.MaxVersion)
+		}
+		cfg.MaxVersion = v
+	}
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < cfg.MinVersion {
+		return nil, fmt.Errorf("max_version is lower than min_version")
+	}
+
+	if len(tc.CipherSuites) > 0 && cfg.MinVersion == tls.VersionTLS13 {
+		return nil, fmt.Errorf("the TLS 1.3 cipher suites can't be configured")
+	}
+	for _, name := range tc.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	for _, name := range tc.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	return cfg, nil
+}
+
+// cipherSuite returns the ID of a TLS 1.0-1.2 cipher suite considered secure
+func cipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+		for _, v := range cs.SupportedVersions {
+			if v != tls.VersionTLS13 {
+				return cs.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("the TLS 1.3 cipher suite %s can't be configured", name)
+	}
+	return 0, fmt.Errorf("unsupported or insecure cipher suite %s", name)
+}
+
+// hstsHeader returns the value of the Strict-Transport-Security header, empty if HSTS is disabled
+func hstsHeader(hc HSTSConf) string {
+	if hc.MaxAge == 0 {
+		return ""
+	}
+
+	v := fmt.Sprintf("max-age=%d", hc.MaxAge)
+	if hc.IncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if hc.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// ticketRotator replaces the key encrypting the session tickets periodically. The previous keys are
+// still accepted for a while, so that the clients can resume their sessions across a rotation. The
+// keys are held by a separate configuration, since the listener uses a copy of its configuration
+type ticketRotator struct {
+	holder   *tls.Config
+	interval time.Duration
+	keys     [][32]byte
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newTicketRotator sets the first key and makes the configuration use the keys of the rotator. It
+// returns nil if the keys are managed by the standard library, which rotates them daily
+func newTicketRotator(cfg *tls.Config, tc TLSConf) *ticketRotator {
+	if tc.SessionTicketRotation == 0 || tc.DisableSessionTickets {
+		return nil
+	}
+
+	tr := &ticketRotator{holder: &tls.Config{}, interval: time.Duration(tc.SessionTicketRotation) * time.Second, stop: make(chan struct{})}
+	tr.rotate()
+	cfg.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		return tr.holder.EncryptTicket(cs, ss)
+	}
+	cfg.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		return tr.holder.DecryptTicket(identity, cs)
+	}
+	return tr
+}
+
+// start rotates the key until stopped
+func (tr *ticketRotator) start() {
+	if tr == nil {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(tr.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-tr.stop:
+				return
+			case <-t.C:
+				tr.rotate()
+			}
+		}
+	}()
+}
+
+// rotate generates a new key used for the new tickets. The previous key is kept if a new one can't
+// be generated
+func (tr *ticketRotator) rotate() {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	if err != nil {
+		logrus.Errorf("error rotating the session ticket key: %s", err)
+		return
+	}
+
+	tr.keys = append([][32]byte{key}, tr.keys...)
+	if len(tr.keys) > ticketKeysKept {
+		tr.keys = tr.keys[:ticketKeysKept]
+	}
+	tr.holder.SetSessionTicketKeys(tr.keys)
+	ticketRotationsMetric.Inc()
+}
+
+// shutdown stops rotating the keys
+func (tr *ticketRotator) shutdown() {
+	if tr == nil {
+		return
+	}
+	tr.stopOnce.Do(func() { close(tr.stop) })
+}
@@ -0,0 +1,122 @@
+package cdn
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSConfIsValid(t *testing.T) {
+	tt := []struct {
+		tc     TLSConf
+		result bool
+		errMsg string
+	}{
+		{TLSConf{}, true, "an empty TLS configuration should be valid"},
+		{TLSConf{MinVersion: "1.2", MaxVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, Curves: []string{"X25519", "P-256"}}, true, "TLS configuration should be valid"},
+		{TLSConf{MinVersion: "1.4"}, false, "TLS configuration should be invalid because of an unknown version"},
+		{TLSConf{MinVersion: "1.3", MaxVersion: "1.2"}, false, "TLS configuration should be invalid because the maximum version is lower than the minimum"},
+		{TLSConf{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, false, "TLS configuration should be invalid because of an insecure cipher suite"},
+		{TLSConf{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, false, "TLS configuration should be invalid because TLS 1.3 cipher suites can't be configured"},
+		{TLSConf{Curves: []string{"P-224"}}, false, "TLS configuration should be invalid because of an unsupported curve"},
+		{TLSConf{SessionTicketRotation: -1}, false, "TLS configuration should be invalid because of a negative rotation"},
+		{TLSConf{SessionTicketRotation: 3600, DisableSessionTickets: true}, false, "TLS configuration should be invalid because tickets are disabled"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.tc.IsValid()
+		if tc.result != valid {
+			t.Error(tc.errMsg)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	tt := []struct {
+		hc     HSTSConf
+		result bool
+		header string
+		errMsg string
+	}{
+		{HSTSConf{}, true, "", "HSTS should be disabled by default"},
+		{HSTSConf{MaxAge: 3600}, true, "max-age=3600", "HSTS should only have max-age"},
+		{HSTSConf{MaxAge: 63072000, IncludeSubdomains: true, Preload: true}, true, "max-age=63072000; includeSubDomains; preload", "HSTS should allow preloading"},
+		{HSTSConf{IncludeSubdomains: true}, false, "", "HSTS should be invalid without max-age"},
+		{HSTSConf{MaxAge: 3600, IncludeSubdomains: true, Preload: true}, false, "", "HSTS preload should require a max-age of one year"},
+		{HSTSConf{MaxAge: 63072000, Preload: true}, false, "", "HSTS preload should require include_subdomains"},
+	}
+
+	for _, tc := range tt {
+		valid, _ := tc.hc.IsValid()
+		if tc.result != valid || (valid && hstsHeader(tc.hc) != tc.header) {
+			t.Error(tc.errMsg)
+		}
+	}
+
+	// the header is only sent by HTTPS backends
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	for _, proto := range []string{"http", "https"} {
+		e, err := newEndpoint(BackendConf{Domain: "www.example.com", IP: "127.0.0.1", Port: listenerPort(t, origin), HSTS: HSTSConf{MaxAge: 3600}}, proto, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		w := e.responseHeaders.writer(rr, newHeaderVars(httptest.NewRequest("GET", "/", nil)))
+		w.WriteHeader(http.StatusOK)
+		if (rr.Header().Get("Strict-Transport-Security") != "") != (proto == "https") {
+			t.Errorf("%s: unexpected HSTS header '%s'", proto, rr.Header().Get("Strict-Transport-Security"))
+		}
+	}
+}
+
+func TestTicketRotator(t *testing.T) {
+	cert := testCertificate(t, time.Now().Add(time.Hour), "www.example.com")
+	cfg, err := newServerTLSConfig(TLSConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	tr := newTicketRotator(cfg, TLSConf{SessionTicketRotation: 3600})
+
+	cache := tls.NewLRUClientSessionCache(1)
+	resumed := func() bool {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		// the listener uses a copy of the configuration
+		s := tls.Server(server, cfg.Clone())
+		go s.Handshake()
+		c := tls.Client(client, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true, ClientSessionCache: cache, MaxVersion: tls.VersionTLS12})
+		err := c.Handshake()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.ConnectionState().DidResume
+	}
+
+	tt := []struct {
+		rotations int
+		resumed   bool
+		errMsg    string
+	}{
+		{0, false, "the first connection can't be resumed"},
+		{0, true, "a session should be resumed with the ticket"},
+		{ticketKeysKept - 1, true, "a session should be resumed with a previous key"},
+		{ticketKeysKept, false, "a session should not be resumed once its key is dropped"},
+	}
+
+	for _, tc := range tt {
+		for i := 0; i < tc.rotations; i++ {
+			tr.rotate()
+		}
+		if resumed() != tc.resumed {
+			t.Error(tc.errMsg)
+		}
+	}
+}
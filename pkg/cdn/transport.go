@@ -0,0 +1,230 @@
+package cdn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConnectTimeout      = 10000 // milliseconds
+	defaultTLSHandshakeTimeout = 10000 // milliseconds
+	defaultRequestTimeout      = 10000 // milliseconds
+	defaultIdleConnTimeout     = 90000 // milliseconds
+	defaultKeepAlive           = 10000 // milliseconds
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+
+	// proxyNone disables the proxy set in the environment
+	proxyNone = "none"
+)
+
+var (
+	validProxySchemes = []string{"http", "https", "socks5"}
+)
+
+// newTransport returns a transport dedicated to a single backend. Connections are always
+// established to the backend's origin, regardless of what the DNS says about the domain
+func newTransport(e endpoint, tc TransportConf, tlsCfg *tls.Config) *http.Transport {
+	connectTimeout := defaultConnectTimeout
+	if tc.ConnectTimeoutMS > 0 {
+		connectTimeout = tc.ConnectTimeoutMS
+	}
+
+	keepAlive := defaultKeepAlive
+	if tc.KeepAliveMS != 0 {
+		keepAlive = tc.KeepAliveMS
+	}
+
+	tlsHandshakeTimeout := defaultTLSHandshakeTimeout
+	if tc.TLSHandshakeTimeoutMS > 0 {
+		tlsHandshakeTimeout = tc.TLSHandshakeTimeoutMS
+	}
+
+	idleConnTimeout := defaultIdleConnTimeout
+	if tc.IdleConnTimeoutMS > 0 {
+		idleConnTimeout = tc.IdleConnTimeoutMS
+	}
+
+	maxIdleConns := defaultMaxIdleConns
+	if tc.MaxIdleConns > 0 {
+		maxIdleConns = tc.MaxIdleConns
+	}
+
+	maxIdleConnsPerHost := defaultMaxIdleConnsPerHost
+	if tc.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(connectTimeout) * time.Millisecond,
+		KeepAlive: time.Duration(keepAlive) * time.Millisecond,
+	}
+	op := newOriginProxy(tc.Proxy)
+
+	return &http.Transport{
+		Proxy: op.proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// the connections to the proxy aren't redirected to the origin
+			if op.isProxy(addr) {
+				return dialer.DialContext(ctx, network, addr)
+			}
+
+			if e.socket != "" {
+				return dialer.DialContext(ctx, "unix", e.socket)
+			}
+
+			// origins specified by hostname are resolved independently from the domain
+			if e.dns != nil {
+				return e.dns.dial(ctx, dialer, network)
+			}
+
+			// the address always includes the port, so we split
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			// override IP and/or port if defined
+			if e.IP != "" {
+				host = e.IP
+			}
+			if e.Port > 0 {
+				port = strconv.Itoa(e.Port)
+			}
+
+			return dialer.DialContext(ctx, network, net.JoinHostPort(host, port))
+		},
+		TLSClientConfig:       tlsCfg,
+		TLSHandshakeTimeout:   time.Duration(tlsHandshakeTimeout) * time.Millisecond,
+		ResponseHeaderTimeout: time.Duration(tc.ResponseHeaderTimeoutMS) * time.Millisecond,
+		IdleConnTimeout:       time.Duration(idleConnTimeout) * time.Millisecond,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		DisableKeepAlives:     tc.DisableKeepAlives,
+		ExpectContinueTimeout: 1 * time.Second,
+		Protocols:             originProtocols(tc.HTTP2),
+	}
+}
+
+// newClient returns the HTTP client used to talk to a backend
+func newClient(e endpoint, tc TransportConf, tlsCfg *tls.Config) *http.Client {
+	timeout := defaultRequestTimeout
+	if tc.TimeoutMS > 0 {
+		timeout = tc.TimeoutMS
+	}
+
+	var rt http.RoundTripper
+	switch {
+	case e.files != nil:
+		rt = e.files
+	case e.s3 != nil:
+		// the bucket is reached through its endpoint, without overriding the address
+		rt = &s3Transport{bucket: e.s3, next: newTransport(endpoint{}, tc, tlsCfg)}
+	default:
+		rt = newTransport(e, tc, tlsCfg)
+	}
+
+	client := &http.Client{
+		Transport: &protocolTransport{domain: e.Domain, next: rt},
+		Timeout:   time.Duration(timeout) * time.Millisecond,
+	}
+	if tc.PassRedirects {
+		// redirects are sent back to the client rather than followed
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// closeIdleConnections closes the idle connections to the origins of an endpoint, its routes, canary
+// and mirror
+func (e endpoint) closeIdleConnections() {
+	if e.client != nil {
+		e.client.CloseIdleConnections()
+	}
+	if e.mirror != nil {
+		e.mirror.client.CloseIdleConnections()
+	}
+	for _, r := range e.routes {
+		r.endpoint.closeIdleConnections()
+	}
+	if e.canary != nil {
+		e.canary.endpoint.closeIdleConnections()
+	}
+}
+
+// closeIdleConnections closes the idle connections of the transport wrapped by another one
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// originProxy chooses the proxy of the requests to an origin, the one set in the environment with
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY unless configured. The addresses of the proxies used are
+// kept, so that the connections to them are told apart from the ones to the origin
+type originProxy struct {
+	url   *url.URL
+	none  bool
+	addrs sync.Map
+}
+
+// newOriginProxy returns the proxy of a transport, the configuration has been validated
+func newOriginProxy(proxy string) *originProxy {
+	if proxy == proxyNone {
+		return &originProxy{none: true}
+	}
+	u, _ := url.Parse(proxy)
+	if proxy == "" {
+		u = nil
+	}
+	return &originProxy{url: u}
+}
+
+// proxy returns the proxy of a request, nil to connect directly
+func (op *originProxy) proxy(req *http.Request) (*url.URL, error) {
+	if op.none {
+		return nil, nil
+	}
+
+	u := op.url
+	if u == nil {
+		var err error
+		u, err = http.ProxyFromEnvironment(req)
+		if err != nil || u == nil {
+			return nil, err
+		}
+	}
+	op.addrs.Store(proxyAddr(u), true)
+	return u, nil
+}
+
+// isProxy checks an address is the one of a proxy used by the transport
+func (op *originProxy) isProxy(addr string) bool {
+	_, ok := op.addrs.Load(addr)
+	return ok
+}
+
+// proxyAddr returns the address dialed to reach a proxy, with the default port of its scheme
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,188 @@
+package cdn
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewClient(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer fast.Close()
+
+	slowEndpoint, err := newEndpoint(BackendConf{IP: "127.0.0.1", Port: listenerPort(t, slow), Transport: TransportConf{ResponseHeaderTimeoutMS: 50}}, "http", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastEndpoint, err := newEndpoint(BackendConf{IP: "127.0.0.1", Port: listenerPort(t, fast)}, "http", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slowEndpoint.client.Transport == fastEndpoint.client.Transport {
+		t.Fatal("backends should not share the same transport")
+	}
+
+	_, err = slowEndpoint.client.Get("http://slow.example.com/")
+	if err == nil {
+		t.Error("a request to a slow origin should time out waiting for the response headers")
+	}
+
+	// the domain is never resolved, connections always go to the origin of the backend
+	resp, err := fastEndpoint.client.Get("http://fast.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "fast.example.com" {
+		t.Errorf("expected the origin to receive the backend domain as host, received '%s'", string(b))
+	}
+}
+
+func TestClientRedirects(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	tt := []struct {
+		pass   bool
+		code   int
+		body   string
+		errMsg string
+	}{
+		{false, http.StatusOK, "/new", "redirects should be followed by default"},
+		{true, http.StatusFound, "", "redirects should be sent back with pass_redirects"},
+	}
+
+	for _, tc := range tt {
+		e, err := newEndpoint(BackendConf{IP: "127.0.0.1", Port: listenerPort(t, origin), Transport: TransportConf{PassRedirects: tc.pass}}, "http", 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := e.client.Get("http://www.example.com/old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code || (tc.body != "" && string(b) != tc.body) {
+			t.Errorf("%s: received %d '%s'", tc.errMsg, resp.StatusCode, string(b))
+		}
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	// the proxy receives the absolute URL of the request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxy " + r.URL.String()))
+	}))
+	defer proxy.Close()
+
+	tt := []struct {
+		proxy  string
+		body   string
+		errMsg string
+	}{
+		{proxy.URL, "proxy http://www.example.com/", "requests should be sent through the proxy"},
+		{proxyNone, "origin", "requests should be sent to the origin without proxy"},
+	}
+
+	for _, tc := range tt {
+		e, err := newEndpoint(BackendConf{IP: "127.0.0.1", Port: listenerPort(t, origin), Transport: TransportConf{Proxy: tc.proxy}}, "http", 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := e.client.Get("http://www.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tc.body {
+			t.Errorf("%s: received '%s'", tc.errMsg, string(b))
+		}
+	}
+
+	for _, proxy := range []string{"proxy.example.com:3128", "ftp://proxy.example.com", "http://"} {
+		valid, _ := TransportConf{Proxy: proxy}.IsValid()
+		if valid {
+			t.Errorf("%s should not be a valid proxy", proxy)
+		}
+	}
+}
+
+func TestReloadClosesIdleConnections(t *testing.T) {
+	var closed int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s.Config.ConnState = func(c net.Conn, cs http.ConnState) {
+		if cs == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{Name: "example", Domain: "www.example.com", IP: "127.0.0.1", Port: listenerPort(t, s)}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	cdn.httpHandler(httptest.NewRecorder(), req)
+
+	err = cdn.Reload(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&closed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Error("the idle connections of the previous backends should be closed on reload")
+	}
+}
+
+// listenerPort returns the port a test server is listening on
+func listenerPort(t *testing.T, s *httptest.Server) int {
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
@@ -0,0 +1,231 @@
+package cdn
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUpgradeIdleTimeout = 300000 // milliseconds
+	upgradeHandshakeTimeout   = 10 * time.Second
+)
+
+var (
+	errUpgradeNotSupported = errors.New("the origin doesn't support connection upgrades")
+)
+
+// upgradeTunnel forwards upgraded connections, like WebSockets, to the origin
+type upgradeTunnel struct {
+	domain         string
+	idleTimeout    time.Duration
+	maxConnections int64
+	active         *int64
+}
+
+// newUpgradeTunnel returns the tunnel of a backend. The number of connections is shared by every
+// copy of the endpoint
+func newUpgradeTunnel(domain string, uc UpgradeConf) *upgradeTunnel {
+	idleTimeout := defaultUpgradeIdleTimeout
+	if uc.IdleTimeoutMS > 0 {
+		idleTimeout = uc.IdleTimeoutMS
+	}
+
+	return &upgradeTunnel{
+		domain:         domain,
+		idleTimeout:    time.Duration(idleTimeout) * time.Millisecond,
+		maxConnections: int64(uc.MaxConnections),
+		active:         new(int64),
+	}
+}
+
+// isUpgrade checks whether the client is asking to switch protocol
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newUpgradeRequest returns the request sent to the origin to upgrade the connection. Unlike other
+// requests, every header and the query string are forwarded as they are
+func newUpgradeRequest(req *http.Request, fr string, e endpoint, vars *headerVars) (*http.Request, error) {
+	if req.URL.RawQuery != "" {
+		fr += "?" + req.URL.RawQuery
+	}
+
+	r, err := http.NewRequest(req.Method, fr, nil)
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(req.Context())
+	r.Header = req.Header.Clone()
+	if e.OriginHost != "" {
+		r.Host = e.OriginHost
+	}
+	e.requestHeaders.apply(r.Header, vars)
+	return r, nil
+}
+
+// acquire reserves a connection, returning false when the limit has been reached
+func (t *upgradeTunnel) acquire() bool {
+	n := atomic.AddInt64(t.active, 1)
+	if t.maxConnections > 0 && n > t.maxConnections {
+		atomic.AddInt64(t.active, -1)
+		return false
+	}
+	upgradedConnectionsMetric.WithLabelValues(t.domain).Inc()
+	return true
+}
+
+// release frees a connection reserved with acquire
+func (t *upgradeTunnel) release() {
+	atomic.AddInt64(t.active, -1)
+	upgradedConnectionsMetric.WithLabelValues(t.domain).Dec()
+}
+
+// serve sends the upgrade request to the origin and, if the origin switches protocol, tunnels the
+// connection in both directions until either side closes it or it's idle for too long. Any other
+// response is sent back to the client as it is
+func (t *upgradeTunnel) serve(w http.ResponseWriter, req *http.Request, rt http.RoundTripper) (int, error) {
+	if !t.acquire() {
+		upgradesMetric.WithLabelValues(t.domain, "rejected").Inc()
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable, fmt.Errorf("too many upgraded connections for %s", t.domain)
+	}
+	defer t.release()
+
+	ctx, cancel := context.WithTimeout(req.Context(), upgradeHandshakeTimeout)
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	cancel()
+	if err != nil {
+		upgradesMetric.WithLabelValues(t.domain, "error").Inc()
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return http.StatusBadGateway, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		upgradesMetric.WithLabelValues(t.domain, "refused").Inc()
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		upgradesMetric.WithLabelValues(t.domain, "error").Inc()
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return http.StatusBadGateway, errUpgradeNotSupported
+	}
+	defer backend.Close()
+
+	// the response is written by hand once the connection is hijacked, so the headers set so far
+	// (by header rules for example) are merged with the ones of the origin
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	hw, ok := w.(*headerRulesWriter)
+	if ok {
+		hw.rules.apply(hw.Header(), hw.vars)
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upgradesMetric.WithLabelValues(t.domain, "error").Inc()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return http.StatusInternalServerError, err
+	}
+	defer conn.Close()
+
+	// the deadlines of the server don't apply to the tunnel, the idle timeout does
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	w.Header().Write(brw)
+	brw.WriteString("\r\n")
+	err = brw.Flush()
+	if err != nil {
+		upgradesMetric.WithLabelValues(t.domain, "error").Inc()
+		return http.StatusSwitchingProtocols, err
+	}
+
+	upgradesMetric.WithLabelValues(t.domain, "success").Inc()
+	t.tunnel(conn, brw.Reader, backend)
+	return http.StatusSwitchingProtocols, nil
+}
+
+// tunnel copies data in both directions, closing both connections when one is closed or when
+// nothing has been sent for longer than the idle timeout
+func (t *upgradeTunnel) tunnel(client io.ReadWriteCloser, clientBuf *bufio.Reader, backend io.ReadWriteCloser) {
+	lastActivity := time.Now().UnixNano()
+	done := make(chan struct{})
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			close(done)
+			client.Close()
+			backend.Close()
+		})
+	}
+
+	copyData := func(dst io.Writer, src io.Reader, direction string) {
+		defer closeBoth()
+		b := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(b)
+			if n > 0 {
+				atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+				upgradedBytesMetric.WithLabelValues(t.domain, direction).Add(float64(n))
+				_, werr := dst.Write(b[:n])
+				if werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	go copyData(backend, clientBuf, "upstream")
+	go copyData(client, backend, "downstream")
+
+	tick := time.NewTicker(t.idleTimeout / 10)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+			if idle >= t.idleTimeout {
+				logrus.Debugf("closing upgraded connection for %s, idle for %s", t.domain, idle)
+				idleTimeoutsMetric.WithLabelValues(t.domain).Inc()
+				closeBoth()
+				return
+			}
+		}
+	}
+}
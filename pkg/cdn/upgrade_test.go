@@ -0,0 +1,95 @@
+package cdn
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoOrigin switches to a protocol echoing back whatever it receives
+func echoOrigin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// dialUpgrade opens a connection to the CDN and asks to upgrade it
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /live HTTP/1.1\r\nHost: www.example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestUpgrade(t *testing.T) {
+	origin := echoOrigin()
+	defer origin.Close()
+
+	c := DefaultConf()
+	c.HTTP.Backends = []BackendConf{{
+		Name:    "example",
+		Domain:  "www.example.com",
+		IP:      "127.0.0.1",
+		Port:    listenerPort(t, origin),
+		Upgrade: UpgradeConf{MaxConnections: 1, IdleTimeoutMS: 300},
+	}}
+	cdn, err := NewCDN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(http.HandlerFunc(cdn.httpHandler))
+	defer s.Close()
+
+	conn, br, resp := dialUpgrade(t, s.Listener.Addr().String())
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the connection to be upgraded, received %d", resp.StatusCode)
+	}
+
+	conn.Write([]byte("hello"))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(br, b)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("expected the data to go through the tunnel, received '%s' (%v)", b, err)
+	}
+
+	// only one connection is allowed
+	conn2, _, resp2 := dialUpgrade(t, s.Listener.Addr().String())
+	conn2.Close()
+	if resp2.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the connection over the limit to be rejected, received %d", resp2.StatusCode)
+	}
+
+	// the tunnel is closed once idle
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = br.ReadByte()
+	if err == nil {
+		t.Error("expected the idle connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("expected the idle connection to be closed by the idle timeout")
+	}
+}
@@ -0,0 +1,259 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	listenFDsStart = 3 // first inherited socket, after stdin, stdout and stderr as with systemd
+
+	envListenFDNames = "PARTICLES_LISTEN_FDNAMES" // names of the sockets passed by the previous process
+	envUpgradeParent = "PARTICLES_UPGRADE_PARENT" // PID of the previous process, stopped once the new one is ready
+)
+
+var (
+	sockets = &socketRegistry{listeners: make(map[string]*net.TCPListener)}
+)
+
+// socketRegistry keeps the sockets inherited from the previous process or from systemd, and the
+// ones listened on, which are passed to the next process on upgrades
+type socketRegistry struct {
+	mu        sync.Mutex
+	loaded    bool
+	inherited map[string]*os.File
+	unnamed   []*os.File
+	listeners map[string]*net.TCPListener
+}
+
+// inheritedNames returns the names of the inherited sockets, starting from the descriptor 3. The
+// sockets passed by systemd are unnamed unless FileDescriptorName is set in the socket unit
+func inheritedNames(getenv func(string) string, pid int) []string {
+	if names := getenv(envListenFDNames); names != "" {
+		return strings.Split(names, ":")
+	}
+
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := make([]string, n)
+	copy(names, strings.Split(getenv("LISTEN_FDNAMES"), ":"))
+	for i, name := range names {
+		// the default name of systemd
+		if name == "unknown" {
+			names[i] = ""
+		}
+	}
+	return names
+}
+
+// load reads the inherited sockets once. The variables describing them are removed, so that they
+// aren't passed on to other processes
+func (sr *socketRegistry) load() {
+	if sr.loaded {
+		return
+	}
+	sr.loaded = true
+	sr.inherited = make(map[string]*os.File)
+
+	for i, name := range inheritedNames(os.Getenv, os.Getpid()) {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		if name == "" {
+			sr.unnamed = append(sr.unnamed, f)
+			continue
+		}
+		sr.inherited[name] = f
+	}
+	for _, v := range []string{envListenFDNames, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+}
+
+// take returns the inherited socket with a name, or an unnamed one listening on the address
+func (sr *socketRegistry) take(name, addr string) (net.Listener, error) {
+	if f, ok := sr.inherited[name]; ok {
+		delete(sr.inherited, name)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+
+	for i, f := range sr.unnamed {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			continue
+		}
+		if sameAddress(ln.Addr(), addr) {
+			f.Close()
+			sr.unnamed = append(sr.unnamed[:i], sr.unnamed[i+1:]...)
+			return ln, nil
+		}
+		ln.Close()
+	}
+	return nil, nil
+}
+
+// sameAddress checks a socket listens on an address, like 0.0.0.0:80 or [::1]:8080
+func sameAddress(a net.Addr, addr string) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(ta.Port) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.Equal(ta.IP) || (ip.IsUnspecified() && ta.IP.IsUnspecified()))
+}
+
+// Listen returns the socket of a listener: the one inherited with its name or address if any,
+// otherwise a new one. With reusePort several processes can listen on the same address
+func Listen(name, addr string, reusePort bool) (net.Listener, error) {
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	sockets.load()
+
+	ln, err := sockets.take(name, addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket inherited for %s: %s", name, err)
+	}
+	if ln != nil {
+		logrus.Infof("using the inherited socket for %s", name)
+	} else {
+		lc := net.ListenConfig{}
+		if reusePort {
+			lc.Control = setReusePort
+		}
+		ln, err = lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("the socket of %s isn't a TCP socket", name)
+	}
+	sockets.listeners[name] = tl
+	return tl, nil
+}
+
+// setReusePort sets SO_REUSEPORT on a socket before it's bound
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Upgrade starts a new process of the same binary, with the same arguments, passing it the sockets
+// listened on. The new process stops this one once it's ready
+func Upgrade() (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	sockets.mu.Lock()
+	names := make([]string, 0, len(sockets.listeners))
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for name, ln := range sockets.listeners {
+		f, err := ln.File()
+		if err != nil {
+			// closed listeners aren't passed
+			continue
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	sockets.mu.Unlock()
+	defer func() {
+		for _, f := range files[listenFDsStart:] {
+			f.Close()
+		}
+	}()
+
+	env := []string{}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, envListenFDNames+"=") && !strings.HasPrefix(v, envUpgradeParent+"=") {
+			env = append(env, v)
+		}
+	}
+	env = append(env, envListenFDNames+"="+strings.Join(names, ":"), fmt.Sprintf("%s=%d", envUpgradeParent, os.Getpid()))
+
+	return os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+}
+
+// Ready is called once the listeners are open. The inherited sockets which weren't used are closed,
+// the previous process is stopped after an upgrade, and systemd is notified
+func Ready() {
+	sockets.mu.Lock()
+	sockets.load()
+	for name, f := range sockets.inherited {
+		logrus.Warnf("closing the inherited socket %s, no listener uses it", name)
+		f.Close()
+	}
+	for _, f := range sockets.unnamed {
+		f.Close()
+	}
+	sockets.inherited = make(map[string]*os.File)
+	sockets.unnamed = nil
+	sockets.mu.Unlock()
+
+	parent, err := strconv.Atoi(os.Getenv(envUpgradeParent))
+	os.Unsetenv(envUpgradeParent)
+	upgraded := err == nil && parent == os.Getppid()
+	if upgraded {
+		logrus.Infof("stopping the previous process %d", parent)
+		err = syscall.Kill(parent, syscall.SIGTERM)
+		if err != nil {
+			logrus.Errorf("error stopping the previous process: %s", err)
+		}
+	}
+
+	state := "READY=1"
+	if upgraded {
+		// systemd needs NotifyAccess=all to accept the new main process
+		state += fmt.Sprintf("\nMAINPID=%d", os.Getpid())
+	}
+	err = notifySystemd(state)
+	if err != nil {
+		logrus.Errorf("error notifying systemd: %s", err)
+	}
+}
+
+// notifySystemd sends a state to systemd if it's waiting for one, like sd_notify
+func notifySystemd(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestInheritedNames(t *testing.T) {
+	tt := []struct {
+		env    map[string]string
+		names  []string
+		errMsg string
+	}{
+		{map[string]string{}, nil, "no socket should be inherited by default"},
+		{map[string]string{envListenFDNames: "http-default:https-default:api"}, []string{"http-default", "https-default", "api"}, "the sockets of the previous process should be named"},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http-default:unknown"}, []string{"http-default", ""}, "the sockets of systemd should be named by FileDescriptorName"},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2"}, []string{"", ""}, "the sockets of systemd should be unnamed without FileDescriptorName"},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"}, nil, "the sockets of systemd should only be used by the process they're meant for"},
+	}
+
+	for _, tc := range tt {
+		names := inheritedNames(func(k string) string { return tc.env[k] }, 42)
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("%s: received %q", tc.errMsg, names)
+		}
+	}
+}
+
+// inheritSocket opens a socket and registers a copy of it as inherited, like the previous process does
+func inheritSocket(t *testing.T, name string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name == "" {
+		sockets.unnamed = append(sockets.unnamed, f)
+	} else {
+		sockets.inherited[name] = f
+	}
+	return ln.Addr().String()
+}
+
+func TestListen(t *testing.T) {
+	sockets = &socketRegistry{loaded: true, inherited: make(map[string]*os.File), listeners: make(map[string]*net.TCPListener)}
+
+	named := inheritSocket(t, "http-default")
+	unnamed := inheritSocket(t, "")
+	inheritSocket(t, "http-unused")
+
+	tt := []struct {
+		name   string
+		addr   string
+		errMsg string
+	}{
+		{"http-default", named, "the socket inherited with the name of the listener should be used"},
+		{"https-default", unnamed, "the unnamed socket listening on the address should be used"},
+	}
+
+	for _, tc := range tt {
+		// the address only matches the inherited sockets, which are already bound
+		ln, err := Listen(tc.name, tc.addr, false)
+		if err != nil {
+			t.Errorf("%s: %s", tc.errMsg, err)
+			continue
+		}
+		conn, err := net.Dial("tcp", tc.addr)
+		if err != nil {
+			t.Errorf("%s: %s", tc.errMsg, err)
+		} else {
+			conn.Close()
+		}
+		ln.Close()
+	}
+
+	Ready()
+	if len(sockets.inherited) != 0 || len(sockets.unnamed) != 0 {
+		t.Error("the inherited sockets not used should be closed once ready")
+	}
+	if len(sockets.listeners) != 2 {
+		t.Error("the sockets listened on should be kept for upgrades")
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	sockets = &socketRegistry{loaded: true, inherited: make(map[string]*os.File), listeners: make(map[string]*net.TCPListener)}
+
+	first, err := Listen("http-first", "127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := Listen("http-second", first.Addr().String(), true)
+	if err != nil {
+		t.Error("another socket should listen on the same address with SO_REUSEPORT")
+	} else {
+		second.Close()
+	}
+
+	_, err = Listen("http-third", first.Addr().String(), false)
+	if err == nil {
+		t.Error("another socket should not listen on the same address without SO_REUSEPORT")
+	}
+}
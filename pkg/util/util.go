@@ -13,6 +13,6 @@ func HandlerWithLogging(next http.HandlerFunc) http.HandlerFunc {
 		start := time.Now()
 		next.ServeHTTP(w, r)
 		duration := time.Since(start).Seconds()
-		logrus.Infof("%s %s%s %s %fs", r.RemoteAddr, r.Host, r.URL, r.UserAgent(), duration)
+		logrus.Infof("%s %s%s %s %s %fs", r.RemoteAddr, r.Host, r.URL, r.Proto, r.UserAgent(), duration)
 	}
 }